@@ -21,18 +21,33 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/statebased"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
 	pb "github.com/hyperledger/fabric/protos/peer"
 )
 
 // SimpleChaincode example simple Chaincode implementation
 type SimpleChaincode struct {
+	//handlers dispatches Invoke calls by function name. It is built on the first
+	//Invoke, guarded by handlersOnce, as the shim may run transactions concurrently.
+	handlers     map[string]func(shim.ChaincodeStubInterface, []string) pb.Response
+	handlersOnce sync.Once
 }
 
 type product struct {
@@ -41,8 +56,359 @@ type product struct {
 	Pname      string `json:"pname"` //the fieldtags are needed to keep case from bouncing around
 	Ptype      string `json:"ptype"`
 	Owner      string `json:"owner"`
+	//OwnerHistory lists previous owners, oldest first. Records created before this
+	//field existed unmarshal with a nil slice, which is treated as an empty history.
+	OwnerHistory []string `json:"ownerHistory"`
+	Status       string   `json:"status"` //lifecycle stage, see statusTransitions
+	Quantity     int      `json:"quantity"`
+	Location     string   `json:"location"` //last known location, as logged by logLocation
+	Manufacturer string   `json:"manufacturer"`
+	BatchNo      string   `json:"batchNo"`
+	Price        float64  `json:"price"`    //price of the last sale recorded by sellProduct
+	Currency     string   `json:"currency"` //ISO 4217 code of Price
+	//CreatedAt and UpdatedAt are transaction timestamps in Unix seconds, taken from
+	//GetTxTimestamp so every endorser computes the same value. Records created before
+	//these fields existed carry zero timestamps until their next mutation.
+	CreatedAt int64 `json:"createdAt"`
+	UpdatedAt int64 `json:"updatedAt"`
+	//Version starts at 1 and is incremented by every mutation. Mutation handlers take
+	//an optional expected version and reject the call if it is stale, giving clients
+	//compare-and-swap semantics. Records created before this field existed start at 0.
+	Version int `json:"version"`
+	//ChildPuids lists products split off from this one (or from products merged into it)
+	ChildPuids []string `json:"childPuids,omitempty"`
+	//ParentPuids lists the product this one was split from and the products merged into it
+	ParentPuids  []string `json:"parentPuids,omitempty"`
+	RecallReason string   `json:"recallReason,omitempty"`
+	//Archived products are kept in state and history but left out of the active indexes
+	Archived bool `json:"archived"`
+	//LastModifiedBy is the client identity (cid.GetID) that submitted the latest
+	//ownership change, which may be an agent acting for the owner. Blank if unknown.
+	LastModifiedBy string `json:"lastModifiedBy"`
+	//ExpiryDate is when a perishable product expires, Unix seconds; 0 means it doesn't
+	ExpiryDate int64 `json:"expiryDate,omitempty"`
+	//ContentHash anchors an off-chain product document: its hex SHA-256, lowercased
+	ContentHash string `json:"contentHash,omitempty"`
+	//TransferReasonHash is the hex SHA-256 of the confidential reason given for the
+	//latest transferProduct, blank if none was given. The reason itself stays off-chain.
+	TransferReasonHash string `json:"transferReasonHash,omitempty"`
+	//TransferNote is the public note given with the latest transferProduct, if any;
+	//earlier notes remain in the product's history
+	TransferNote string `json:"transferNote,omitempty"`
+	//CreatedBy is the client identity (cid.GetID) that minted the product; products
+	//split off from it keep the original minter. Blank if unknown.
+	CreatedBy string `json:"createdBy"`
+	//RequestID is the client-supplied id of the initProduct call that created the
+	//product, which makes retries of that call idempotent
+	RequestID string `json:"requestId,omitempty"`
+	//Owners maps each co-owner to its ownership percentage, summing to 100, for jointly
+	//owned products; Owner is then the co-owner with the largest share. Single-owner
+	//records, including all records created before this field existed, leave it empty
+	//and are treated as Owner holding 100%, see ownershipShares.
+	Owners map[string]float64 `json:"owners,omitempty"`
+	//ComplianceBreached is set once a sensor reading outside its acceptable range is
+	//logged for the product, see logSensorReading. It is never cleared.
+	ComplianceBreached bool `json:"complianceBreached"`
+	//RestoredFrom is the TxId whose value the latest restoreProduct rolled the product back to
+	RestoredFrom string `json:"restoredFrom,omitempty"`
+	//SerialNo is the per-type serial number issued by nextSerial when initProduct
+	//was asked for one, starting at 1; 0 means none was issued
+	SerialNo uint64 `json:"serialNo,omitempty"`
+	//Metadata holds free-form industry specific attributes, see setMetadata. Records
+	//without any, including those created before this field existed, leave it nil.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	//Weight is the product's weight in Unit, one of the keys of kilogramsPerUnit.
+	//Both are empty for products never weighed.
+	Weight float64 `json:"weight,omitempty"`
+	Unit   string  `json:"unit,omitempty"`
+	//LastTransferAt is the transaction timestamp of the latest change of owner, Unix
+	//seconds; 0 for products never transferred since this field was added
+	LastTransferAt int64 `json:"lastTransferAt,omitempty"`
+	//DisplayName is Pname as it was given, before lowercasing; Pname stays lowercased
+	//for the indexes and queries. Blank for records created before this field existed.
+	DisplayName string `json:"displayName,omitempty"`
+	//Escrow is set while the product is held in escrow, see escrowProduct; Owner is
+	//then escrowOwnerPrefix followed by the agent
+	Escrow *escrowHold `json:"escrow,omitempty"`
 }
 
+// escrowHold records who a product in escrow came from and who it is meant for
+type escrowHold struct {
+	Agent         string `json:"agent"`         //client identity that may release or cancel
+	OriginalOwner string `json:"originalOwner"` //owner before escrowProduct, given the product back by cancelEscrow
+	Recipient     string `json:"recipient"`     //owner given the product by releaseEscrow
+	Since         int64  `json:"since"`         //transaction timestamp of escrowProduct, Unix seconds
+}
+
+// ccProductSchema is the version of the ccProduct layout. Fields are only ever
+// added to ccProduct; renaming or removing one requires a new schema version.
+const ccProductSchema = 1
+
+// ccProduct is the product as returned by getProductForCC to other chaincodes.
+// Unlike the stored record its layout is a contract, see ccProductSchema.
+type ccProduct struct {
+	Schema  int    `json:"schema"`
+	Puid    string `json:"puid"`
+	DocType string `json:"docType"`
+	Pname   string `json:"pname"`
+	//DisplayName is the name in its original casing, falling back to pname
+	DisplayName string `json:"displayName"`
+	Ptype       string `json:"ptype"`
+	Owner       string `json:"owner"`
+	Status      string `json:"status"`
+	Quantity    int    `json:"quantity"`
+	Archived    bool   `json:"archived"`
+	Version     int    `json:"version"`
+	UpdatedAt   int64  `json:"updatedAt"` //Unix seconds
+}
+
+// batchProduct is one entry of initProductBatch's argument. It carries only what
+// initProduct takes from its caller; everything else in the product record is set
+// by the chaincode, so an entry can't forge lineage, escrow, co-owners or timestamps.
+type batchProduct struct {
+	ObjectType   string  `json:"docType"`
+	Puid         string  `json:"puid"`
+	Pname        string  `json:"pname"`
+	DisplayName  string  `json:"displayName"`
+	Ptype        string  `json:"ptype"`
+	Owner        string  `json:"owner"`
+	Quantity     int     `json:"quantity"` //0 takes the default of 1
+	Manufacturer string  `json:"manufacturer"`
+	BatchNo      string  `json:"batchNo"`
+	ExpiryDate   int64   `json:"expiryDate"`
+	ContentHash  string  `json:"contentHash"`
+	Weight       float64 `json:"weight"`
+	Unit         string  `json:"unit"`
+}
+
+// productPrivateDetails holds the attributes that only collection members may see
+type productPrivateDetails struct {
+	ObjectType       string  `json:"docType"` //docType is used to distinguish the various types of objects in state database
+	Puid             string  `json:"puid"`
+	Cost             float64 `json:"cost"`
+	SupplierContract string  `json:"supplierContract"`
+}
+
+// productPrivateCollection is the private data collection holding productPrivateDetails
+const productPrivateCollection = "collectionProductPrivate"
+
+// pendingTransfer is a proposed ownership change awaiting the recipient's acceptance.
+// It is stored under the pendingTransfer~puid composite key.
+type pendingTransfer struct {
+	ObjectType string `json:"docType"` //docType is used to distinguish the various types of objects in state database
+	Puid       string `json:"puid"`
+	From       string `json:"from"`
+	To         string `json:"to"`
+	ProposedAt int64  `json:"proposedAt"` //transaction timestamp, Unix seconds
+	//FromMSP is the MSP of the proposer, the counterparty of acceptTransfer and
+	//swapProducts for requireCoEndorsement. Empty in proposals made before it was recorded.
+	FromMSP string `json:"fromMSP,omitempty"`
+}
+
+// sensorReading is an environmental reading logged for a product. It is stored
+// under the puid~sensor~timestamp composite key, apart from the product record.
+type sensorReading struct {
+	ObjectType  string  `json:"docType"` //docType is used to distinguish the various types of objects in state database
+	Puid        string  `json:"puid"`
+	ReadingType string  `json:"readingType"`
+	Value       float64 `json:"value"`
+	Timestamp   int64   `json:"timestamp"`  //transaction timestamp, Unix seconds
+	OutOfRange  bool    `json:"outOfRange"` //the value is outside sensorRanges for its type
+}
+
+// sensorRange is the acceptable range of a reading type, bounds inclusive
+type sensorRange struct {
+	Min float64
+	Max float64
+}
+
+// sensorRanges lists the reading types logSensorReading accepts and their
+// acceptable ranges: 2-8 °C for the cold chain, at most 60% relative humidity
+var sensorRanges = map[string]sensorRange{
+	"temperature": {2, 8},
+	"humidity":    {0, 60},
+}
+
+// productTransferredEvent is the chaincode event emitted by transferProduct
+const productTransferredEvent = "ProductTransferred"
+
+type transferEvent struct {
+	Puid          string `json:"puid"`
+	PreviousOwner string `json:"previousOwner"`
+	NewOwner      string `json:"newOwner"`
+	Timestamp     int64  `json:"timestamp"`   //transaction timestamp, Unix seconds
+	InitiatedBy   string `json:"initiatedBy"` //submitting client identity, blank if unknown
+	TxID          string `json:"txId"`
+	//Changed lists every product field the transfer changed, see productDiff
+	Changed map[string]fieldChange `json:"changed"`
+}
+
+// productUpdatedEvent is the chaincode event emitted by updateProduct
+const productUpdatedEvent = "ProductUpdated"
+
+type updateEvent struct {
+	Puid    string                 `json:"puid"`
+	TxID    string                 `json:"txId"`
+	Changed map[string]fieldChange `json:"changed"`
+}
+
+// fieldChange is the old and new JSON value of a changed product field; a field
+// absent on one side is null
+type fieldChange struct {
+	From json.RawMessage `json:"from"`
+	To   json.RawMessage `json:"to"`
+}
+
+// productsBulkTransferredEvent is the chaincode event emitted by transferProductsByOwner
+const productsBulkTransferredEvent = "ProductsBulkTransferred"
+
+type bulkTransferEvent struct {
+	PreviousOwner string `json:"previousOwner"`
+	NewOwner      string `json:"newOwner"`
+	Count         int    `json:"count"`
+	Timestamp     int64  `json:"timestamp"` //transaction timestamp, Unix seconds
+}
+
+// productsBatchTransferredEvent is the chaincode event emitted by transferProductsBatch
+const productsBatchTransferredEvent = "ProductsBatchTransferred"
+
+type batchTransferEvent struct {
+	Transfers []batchTransfer `json:"transfers"` //ordered by puid
+	Timestamp int64           `json:"timestamp"` //transaction timestamp, Unix seconds
+	TxID      string          `json:"txId"`
+}
+
+// batchTransfer is one transfer made by transferProductsBatch
+type batchTransfer struct {
+	Puid          string `json:"puid"`
+	PreviousOwner string `json:"previousOwner"`
+	NewOwner      string `json:"newOwner"`
+	Version       int    `json:"version"` //version of the product after the transfer
+}
+
+// Chaincode events emitted by escrowProduct, releaseEscrow and cancelEscrow
+const (
+	productEscrowedEvent = "ProductEscrowed"
+	escrowReleasedEvent  = "EscrowReleased"
+	escrowCancelledEvent = "EscrowCancelled"
+)
+
+type escrowEvent struct {
+	Puid          string `json:"puid"`
+	Agent         string `json:"agent"`
+	OriginalOwner string `json:"originalOwner"`
+	Recipient     string `json:"recipient"`
+	NewOwner      string `json:"newOwner"`  //owner after the transaction
+	Timestamp     int64  `json:"timestamp"` //transaction timestamp, Unix seconds
+	TxID          string `json:"txId"`
+}
+
+// productsSwappedEvent is the chaincode event emitted by swapProducts
+const productsSwappedEvent = "ProductsSwapped"
+
+type swapEvent struct {
+	PuidA     string `json:"puidA"`
+	PuidB     string `json:"puidB"`
+	OwnerA    string `json:"ownerA"`    //owner of puidA before the swap, now owning puidB
+	OwnerB    string `json:"ownerB"`    //owner of puidB before the swap, now owning puidA
+	Timestamp int64  `json:"timestamp"` //transaction timestamp, Unix seconds
+	TxID      string `json:"txId"`
+}
+
+// productMovedEvent is the chaincode event emitted by logLocation
+const productMovedEvent = "ProductMoved"
+
+type locationEvent struct {
+	Puid             string `json:"puid"`
+	PreviousLocation string `json:"previousLocation"`
+	NewLocation      string `json:"newLocation"`
+	Timestamp        int64  `json:"timestamp"` //transaction timestamp, Unix seconds
+}
+
+// Product lifecycle stages
+const (
+	statusManufactured = "manufactured"
+	statusInTransit    = "in-transit"
+	statusDelivered    = "delivered"
+	statusRecalled     = "recalled"
+)
+
+// statusTransitions lists, for each lifecycle stage, the stages a product may move to next.
+// A stage missing from the map (or mapped to an empty list) is terminal. To add a stage,
+// add it as a key here and list it as a target of the stages that may lead to it.
+// Records created before Status existed have an empty status and are treated as manufactured.
+var statusTransitions = map[string][]string{
+	statusManufactured: {statusInTransit, statusRecalled},
+	statusInTransit:    {statusDelivered, statusRecalled},
+	statusDelivered:    {statusInTransit, statusRecalled},
+	statusRecalled:     {},
+}
+
+// productRecalledEvent is the chaincode event emitted by recallProduct
+const productRecalledEvent = "ProductRecalled"
+
+type recallEvent struct {
+	Puids     []string `json:"puids"`
+	Reason    string   `json:"reason"`
+	Timestamp int64    `json:"timestamp"` //transaction timestamp, Unix seconds
+}
+
+// productSoldEvent is the chaincode event emitted by sellProduct
+const productSoldEvent = "ProductSold"
+
+type saleEvent struct {
+	Puid          string  `json:"puid"`
+	PreviousOwner string  `json:"previousOwner"`
+	NewOwner      string  `json:"newOwner"`
+	Price         float64 `json:"price"`
+	Currency      string  `json:"currency"`
+	Timestamp     int64   `json:"timestamp"` //transaction timestamp, Unix seconds
+}
+
+// kilogramsPerUnit converts the weight units products may be weighed in to
+// kilograms: 1 g = 0.001 kg, and 1 lb = 0.45359237 kg exactly, the
+// international avoirdupois pound
+var kilogramsPerUnit = map[string]float64{
+	"kg": 1,
+	"g":  0.001,
+	"lb": 0.45359237,
+}
+
+// allowedCurrencies are the ISO 4217 codes sellProduct accepts
+var allowedCurrencies = map[string]bool{
+	"USD": true,
+	"EUR": true,
+	"GBP": true,
+	"INR": true,
+	"JPY": true,
+	"CNY": true,
+}
+
+// productStatusChangedEvent is the chaincode event emitted by changeStatus
+const productStatusChangedEvent = "ProductStatusChanged"
+
+type statusEvent struct {
+	Puid           string `json:"puid"`
+	PreviousStatus string `json:"previousStatus"`
+	NewStatus      string `json:"newStatus"`
+}
+
+// roleAttribute is the X.509 certificate attribute holding the caller's role
+const roleAttribute = "role"
+
+// regulatorRole may transfer products it does not own
+const regulatorRole = "regulator"
+
+// manufacturerRole may create new products
+const manufacturerRole = "manufacturer"
+
+// adminMSPID is the MSP whose members may run maintenance handlers
+const adminMSPID = "Org1MSP"
+
+// adminRole, held by a member of adminMSPID, may move products it does not own
+// with transferProductsBatch
+const adminRole = "admin"
+
 // ===================================================================================
 // Main
 // ===================================================================================
@@ -53,285 +419,7603 @@ func main() {
 	}
 }
 
+// configKey is the reserved state key the chaincode configuration is stored
+// under, see loadConfig. validatePuid rejects it as a puid, and the handlers
+// scanning product records skip it as it has no docType; only
+// queryProductByRangePaginated, which returns every key in its range as
+// stored, lists it.
+const configKey = "__config__"
+
+// chaincodeConfig holds the tunables handlers read at runtime, set by Init and setConfig
+type chaincodeConfig struct {
+	StrictOwners bool `json:"strictOwners"` //require registered owners, see assertRegisteredOwner
+	//StrictArgs rejects unknown fields in JSON arguments, see decodeArg. Every handler
+	//rejects more positional arguments than it takes whether or not it is set; strict
+	//mode covers what a count can't, the fields of JSON arguments, which json.Unmarshal
+	//drops silently when unknown, e.g. when misspelt or meant for a newer version.
+	StrictArgs              bool  `json:"strictArgs"`
+	MaxMetadataBytes        int   `json:"maxMetadataBytes"`        //cap on a product's metadata, see updateMetadata
+	TransferCooldownSeconds int64 `json:"transferCooldownSeconds"` //least time between transfers, see assertCooledDown
+	//NamespaceKeysByChannel prefixes product keys with the channel ID, see productKey.
+	//It can only be changed while the channel holds no products.
+	NamespaceKeysByChannel bool `json:"namespaceKeysByChannel"`
+}
+
+// configUpdate is the JSON object Init and setConfig accept. A field left out
+// keeps its current value, so upgrading without a config changes nothing.
+type configUpdate struct {
+	StrictOwners            *bool  `json:"strictOwners"`
+	StrictArgs              *bool  `json:"strictArgs"`
+	MaxMetadataBytes        *int   `json:"maxMetadataBytes"`
+	TransferCooldownSeconds *int64 `json:"transferCooldownSeconds"`
+	NamespaceKeysByChannel  *bool  `json:"namespaceKeysByChannel"`
+}
+
+// strictArgsIndex keys the flag that held StrictArgs before the configuration
+// was stored under configKey, like strictOwnersIndex for StrictOwners.
+// loadConfig still reads both while configKey is absent and saveConfig
+// deletes them.
+const strictArgsIndex = "config~strictArgs"
+
 // Init initializes chaincode
+// The optional argument is a JSON configUpdate, e.g. instantiate or upgrade with
+// {"Args":["init","{\"strictOwners\":true,\"transferCooldownSeconds\":60}"]}.
+// Unknown fields and invalid values fail the instantiation.
 // ===========================
 func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	_, args := stub.GetFunctionAndParameters()
+	if len(args) > 1 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 0 or 1"))
+	}
+	if len(args) == 0 || len(strings.TrimSpace(args[0])) == 0 {
+		return shim.Success(nil)
+	}
+
+	_, err := updateConfig(stub, []byte(args[0]))
+	if err != nil {
+		return errorResponse("", err)
+	}
 	return shim.Success(nil)
 }
 
-// Invoke - Our entry point for Invocations
-// ========================================
-func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
-	function, args := stub.GetFunctionAndParameters()
-	fmt.Println("invoke is running " + function)
+// ===========================================================================
+// getConfig - return the configuration in effect, every field included
+// ===========================================================================
+func (t *SimpleChaincode) getConfig(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 0"))
+	}
+	config, err := loadConfig(stub)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	configJSONasBytes, err := json.Marshal(config)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	return shim.Success(configJSONasBytes)
+}
+
+// ===========================================================================
+// setConfig - change configuration fields, admin only. Takes the same JSON
+// object as Init and returns the whole configuration after the change.
+// ===========================================================================
+func (t *SimpleChaincode) setConfig(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "{\"maxMetadataBytes\":8192}"
+	if len(args) != 1 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 1"))
+	}
+	err := assertAdmin(stub)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	config, err := updateConfig(stub, []byte(args[0]))
+	if err != nil {
+		return errorResponse("", err)
+	}
+	configJSONasBytes, err := json.Marshal(config)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	fmt.Println("- end setConfig " + string(configJSONasBytes))
+	return shim.Success(configJSONasBytes)
+}
+
+// loadConfig reads the configuration under configKey. Fields it lacks, and the
+// whole configuration on a channel where it was never set, take their defaults.
+func loadConfig(stub shim.ChaincodeStubInterface) (*chaincodeConfig, error) {
+	config := chaincodeConfig{
+		MaxMetadataBytes:        defaultMaxMetadataBytes,
+		TransferCooldownSeconds: defaultTransferCooldownSeconds,
+	}
+	configAsBytes, err := stub.GetState(configKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get config: %s", err)
+	}
+	if configAsBytes != nil {
+		err = json.Unmarshal(configAsBytes, &config)
+		if err != nil {
+			return nil, &codedError{codeCorruptRecord, fmt.Sprintf("Stored config is not valid, it may be corrupt: %s", err)}
+		}
+		return &config, nil
+	}
+
+	// ==== Never saved, honour the flags that predate configKey ====
+	for _, legacy := range []struct {
+		index string
+		flag  *bool
+	}{{strictOwnersIndex, &config.StrictOwners}, {strictArgsIndex, &config.StrictArgs}} {
+		flagKey, err := stub.CreateCompositeKey(legacy.index, []string{})
+		if err != nil {
+			return nil, err
+		}
+		flag, err := stub.GetState(flagKey)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get %s flag: %s", legacy.index, err)
+		}
+		*legacy.flag = flag != nil
+	}
+	return &config, nil
+}
+
+// updateConfig applies the JSON configUpdate data to the stored configuration,
+// validates the result and saves it
+func updateConfig(stub shim.ChaincodeStubInterface, data []byte) (*chaincodeConfig, error) {
+	update := configUpdate{}
+	err := unmarshalJSON(data, &update, true)
+	if err != nil {
+		return nil, validationError("Config must be a JSON object of known fields: %s", err)
+	}
+	config, err := loadConfig(stub)
+	if err != nil {
+		return nil, err
+	}
+	if update.StrictOwners != nil {
+		config.StrictOwners = *update.StrictOwners
+	}
+	if update.StrictArgs != nil {
+		config.StrictArgs = *update.StrictArgs
+	}
+	if update.MaxMetadataBytes != nil {
+		config.MaxMetadataBytes = *update.MaxMetadataBytes
+	}
+	if update.TransferCooldownSeconds != nil {
+		config.TransferCooldownSeconds = *update.TransferCooldownSeconds
+	}
+	if update.NamespaceKeysByChannel != nil && *update.NamespaceKeysByChannel != config.NamespaceKeysByChannel {
+		// existing records would be left under keys the handlers no longer read
+		stored, err := hasStoredProducts(stub)
+		if err != nil {
+			return nil, err
+		}
+		if stored {
+			return nil, conflictError("namespaceKeysByChannel can't be changed while the channel holds products")
+		}
+		config.NamespaceKeysByChannel = *update.NamespaceKeysByChannel
+	}
+
+	if config.MaxMetadataBytes <= 0 || config.MaxMetadataBytes > maxProductRecordBytes {
+		return nil, validationError("maxMetadataBytes must be between 1 and %d", maxProductRecordBytes)
+	}
+	if config.TransferCooldownSeconds < 0 {
+		return nil, validationError("transferCooldownSeconds must not be negative")
+	}
+	return config, saveConfig(stub, config)
+}
+
+// hasStoredProducts reports whether the world state holds any key other than
+// configKey and composite keys, i.e. a product record, prefixed or not
+func hasStoredProducts(stub shim.ChaincodeStubInterface) (bool, error) {
+	resultsIterator, err := stub.GetStateByRange("", "")
+	if err != nil {
+		return false, err
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return false, err
+		}
+		if responseRange.Key != configKey && !strings.ContainsRune(responseRange.Key, 0) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// saveConfig writes the configuration under configKey and drops the flags it replaces
+func saveConfig(stub shim.ChaincodeStubInterface, config *chaincodeConfig) error {
+	configJSONasBytes, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(configKey, configJSONasBytes)
+	if err != nil {
+		return err
+	}
+	for _, index := range []string{strictOwnersIndex, strictArgsIndex} {
+		flagKey, err := stub.CreateCompositeKey(index, []string{})
+		if err != nil {
+			return err
+		}
+		err = stub.DelState(flagKey)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeArg unmarshals the JSON argument data into v. When the configuration's
+// StrictArgs is set, a field v has no place for is an error rather than dropped.
+func decodeArg(stub shim.ChaincodeStubInterface, data []byte, v interface{}) error {
+	config, err := loadConfig(stub)
+	if err != nil {
+		return err
+	}
+	return unmarshalJSON(data, v, config.StrictArgs)
+}
+
+// unmarshalJSON is json.Unmarshal, rejecting unknown object fields when strict
+func unmarshalJSON(data []byte, v interface{}, strict bool) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+	err := decoder.Decode(v)
+	if err != nil {
+		return err
+	}
+	if _, err = decoder.Token(); err != io.EOF {
+		return fmt.Errorf("invalid character after top-level value")
+	}
+	return nil
+}
+
+// Invoke - Our entry point for Invocations
+// ========================================
+func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	function, args := stub.GetFunctionAndParameters()
+	fmt.Println("invoke is running " + function)
+	t.handlersOnce.Do(func() {
+		t.handlers = t.invokeHandlers()
+	})
+
+	handler, ok := t.handlers[function]
+	if !ok {
+		fmt.Println("invoke did not find func: " + function) //error
+		return errorResponse("", validationError("unknown function: %s, available: %v", function, t.functionNames()))
+	}
+	config, err := loadConfig(stub)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	return handler(&configuredStub{stub, config}, args)
+}
+
+// configuredStub is the stub Invoke hands to the handlers, carrying the
+// configuration as it was when the transaction started, so that productKey,
+// called for every product read or written, doesn't read it again each time
+type configuredStub struct {
+	shim.ChaincodeStubInterface
+	config *chaincodeConfig
+}
+
+// invokeHandlers maps every function name accepted by Invoke to its handler.
+// Adding a handler only takes a new entry here.
+func (t *SimpleChaincode) invokeHandlers() map[string]func(shim.ChaincodeStubInterface, []string) pb.Response {
+	return map[string]func(shim.ChaincodeStubInterface, []string) pb.Response{
+		"initProduct":                  t.initProduct,                  //create a new product
+		"initProductBatch":             t.initProductBatch,             //create many products in one transaction
+		"transferProduct":              t.transferProduct,              //change owner of a specific product
+		"readProduct":                  t.readProduct,                  //read a product
+		"queryProduct":                 t.queryProduct,                 //find product based on an ad hoc rich query
+		"getHistoryForProduct":         t.getHistoryForProduct,         //get history of values for a product
+		"deleteProduct":                t.deleteProduct,                //delete a product and its index entries
+		"updateProduct":                t.updateProduct,                //change name and/or type of a specific product
+		"queryProductWithPagination":   t.queryProductWithPagination,   //find products based on an ad hoc rich query, one page at a time
+		"getProductsByOwner":           t.getProductsByOwner,           //find products held by an owner using the owner~puid index
+		"changeStatus":                 t.changeStatus,                 //move a product to a new lifecycle stage
+		"splitProduct":                 t.splitProduct,                 //move part of a product's quantity into a new product
+		"mergeProduct":                 t.mergeProduct,                 //combine two products of the same type
+		"transferProductsByOwner":      t.transferProductsByOwner,      //move all products of one owner to another
+		"logLocation":                  t.logLocation,                  //record where a product currently is
+		"getProductsByType":            t.getProductsByType,            //find products of a type using the type~name~puid index
+		"queryProductByField":          t.queryProductByField,          //find products by a single field using a rich query
+		"initProductPrivateDetails":    t.initProductPrivateDetails,    //store private details of a product in a collection
+		"readProductPrivate":           t.readProductPrivate,           //read private details of a product
+		"getProductCount":              t.getProductCount,              //count products, optionally by type or owner
+		"getProductEndorsement":        t.getProductEndorsement,        //list the orgs that must endorse changes to a product
+		"recallProduct":                t.recallProduct,                //recall a product and everything split from it
+		"reindexProducts":              t.reindexProducts,              //rebuild the composite indexes from product records
+		"proposeTransfer":              t.proposeTransfer,              //propose a new owner for a product
+		"acceptTransfer":               t.acceptTransfer,               //accept a proposed transfer as the recipient
+		"rejectTransfer":               t.rejectTransfer,               //reject or cancel a proposed transfer
+		"getProductsByBatch":           t.getProductsByBatch,           //find products of a manufacturer's batch
+		"validateProduct":              t.validateProduct,              //check initProduct arguments without writing
+		"getProductWithHistory":        t.getProductWithHistory,        //read a product together with its history
+		"queryProductSorted":           t.queryProductSorted,           //find products by a field using a sorted rich query
+		"sellProduct":                  t.sellProduct,                  //transfer a product recording its sale price
+		"getProductsByOwnerAndType":    t.getProductsByOwnerAndType,    //find products of a type held by an owner
+		"archiveProduct":               t.archiveProduct,               //soft-delete a product
+		"unarchiveProduct":             t.unarchiveProduct,             //bring an archived product back
+		"exportProducts":               t.exportProducts,               //dump every product record
+		"getExpiredProducts":           t.getExpiredProducts,           //find products past their expiry date
+		"queryProductByRangePaginated": t.queryProductByRangePaginated, //page through products by puid range, works on LevelDB
+		"getLineage":                   t.getLineage,                   //walk a product's split/merge ancestry
+		"verifyContentHash":            t.verifyContentHash,            //check an off-chain document hash against the product
+		"getProductsModifiedSince":     t.getProductsModifiedSince,     //find products changed after a timestamp
+		"readProductsBulk":             t.readProductsBulk,             //read many products in one call
+		"getProductsCreatedBy":         t.getProductsCreatedBy,         //find products minted by a client identity
+		"logSensorReading":             t.logSensorReading,             //record an environmental reading for a product
+		"getSensorReadings":            t.getSensorReadings,            //list a product's environmental readings
+		"getProductAsMap":              t.getProductAsMap,              //read a product in the current record shape
+		"transferShare":                t.transferShare,                //move part of a co-owned product to another owner
+		"getProductsByRange":           t.getProductsByRange,           //find products by puid range
+		"restoreProduct":               t.restoreProduct,               //roll a product back to an earlier value
+		"registerOwner":                t.registerOwner,                //add owners to the registry
+		"deregisterOwner":              t.deregisterOwner,              //remove owners from the registry
+		"setStrictOwners":              t.setStrictOwners,              //require owners to be registered
+		"readProductPretty":            t.readProductPretty,            //read a product as indented JSON
+		"getSerialCounter":             t.getSerialCounter,             //show the last serial number issued per type
+		"setMetadata":                  t.setMetadata,                  //merge custom attributes into a product
+		"removeMetadataKey":            t.removeMetadataKey,            //drop a custom attribute from a product
+		"productExists":                t.productExists,                //check whether a puid is taken
+		"swapProducts":                 t.swapProducts,                 //exchange the owners of two products
+		"getProductsByPrefix":          t.getProductsByPrefix,          //find products whose puid starts with a prefix
+		"cloneProduct":                 t.cloneProduct,                 //create a product from an existing one
+		"getProductForCC":              t.getProductForCC,              //read a product for another chaincode
+		"getTotalWeightByOwner":        t.getTotalWeightByOwner,        //sum the weights of an owner's products
+		"getAuditLog":                  t.getAuditLog,                  //list the changes to many products in time order
+		"getUntransferredProducts":     t.getUntransferredProducts,     //find products that never changed owner
+		"listProducts":                 t.listProducts,                 //list products by any combination of owner, type and status
+		"getRecommendedIndexes":        t.getRecommendedIndexes,        //list the CouchDB indexes the rich queries need
+		"verifyOwnershipChain":         t.verifyOwnershipChain,         //check that a product's ownership history is contiguous
+		"transferProductsBatch":        t.transferProductsBatch,        //transfer many products to different owners at once
+		"getProductsByStatus":          t.getProductsByStatus,          //list products in a lifecycle stage
+		"escrowProduct":                t.escrowProduct,                //hold a product in escrow for an intended recipient
+		"releaseEscrow":                t.releaseEscrow,                //complete an escrow, giving the product to the recipient
+		"cancelEscrow":                 t.cancelEscrow,                 //end an escrow, giving the product back to its original owner
+		"getFieldHistory":              t.getFieldHistory,              //list the changes of one field of a product over time
+		"findDuplicateProducts":        t.findDuplicateProducts,        //group products sharing name, type and manufacturer
+		"getConfig":                    t.getConfig,                    //show the chaincode configuration
+		"setConfig":                    t.setConfig,                    //change the chaincode configuration
+		"verifyIndexIntegrity":         t.verifyIndexIntegrity,         //check every index entry against its product
+		"readProductStrict":            t.readProductStrict,            //read a product, checking the puid and record
+		"getProvenanceCertificate":     t.getProvenanceCertificate,     //assemble a digest-protected provenance certificate for a product
+		"verifyCertificate":            t.verifyCertificate,            //check a provenance certificate against its digest and the ledger
+	}
+}
+
+// functionNames returns the function names accepted by Invoke, sorted
+func (t *SimpleChaincode) functionNames() []string {
+	names := make([]string, 0, len(t.handlers))
+	for name := range t.handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ============================================================
+// initProduct - create a new product, store into chaincode state
+// ============================================================
+func (t *SimpleChaincode) initProduct(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+
+	//   0       1        2        3          4 (optional)  5 (optional)     6 (optional)     7 (optional) 8 (optional)   9 (optional) 10 (optional)   11 (optional) 12 (optional) 13 (optional) 14 (optional)
+	// "puid", "pname", "ptype", "owner", "quantity",   "endorsingMSP", "manufacturer", "batchNo",  "expiryDate", "docType",  "contentHash", "requestId", "autoSerial", "weight",     "unit"
+	// An empty optional argument takes its default. expiryDate is in Unix seconds,
+	// docType one of allowedDocTypes and "product" by default, contentHash a hex SHA-256.
+	// autoSerial "true" issues the product the next serial number of its type.
+	// A weight needs a unit, one of kg, g and lb.
+	// Resubmitting a call with the same requestId after it succeeded returns the
+	// original result instead of an "already exists" error. An empty puid is
+	// generated from the transaction id and returned in the response.
+	fmt.Println("- start init product")
+	newProduct, problems := parseProductArgs(withGeneratedPuid(stub, args))
+	if len(problems) > 0 {
+		return errorResponse("", &codedError{codeValidation, problems[0]})
+	}
+
+	// ==== Only manufacturers may mint products ====
+	err = assertRole(stub, manufacturerRole)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	productUID := newProduct.Puid
+
+	// ==== Check if product already exists ====
+	productAsBytes, err := stub.GetState(productKey(stub, productUID))
+	if err != nil {
+		return errorResponse(productUID, fmt.Errorf("Failed to get product: %s", err))
+	} else if productAsBytes != nil {
+		existing := product{}
+		err = json.Unmarshal(productAsBytes, &existing)
+		if err == nil && len(newProduct.RequestID) > 0 && existing.RequestID == newProduct.RequestID {
+			// ==== A retry of the call that created the product ====
+			fmt.Println("- end init product (retry of request " + existing.RequestID + ")")
+			return initProductResponse(stub, &existing, existing.CreatedAt)
+		}
+		fmt.Println("This product already exists: " + productUID)
+		if len(newProduct.RequestID) > 0 {
+			return errorResponse(productUID, alreadyExistsError("This product already exists: %s, it was created by a different request", productUID))
+		}
+		return errorResponse(productUID, alreadyExistsError("This product already exists: %s", productUID))
+	}
+
+	// ==== Names are unique within a type ====
+	err = assertUniqueTypeName(stub, newProduct.Ptype, newProduct.Pname, productUID)
+	if err != nil {
+		return errorResponse(productUID, err)
+	}
+	err = assertRegisteredOwner(stub, newProduct.Owner)
+	if err != nil {
+		return errorResponse(productUID, err)
+	}
+
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return errorResponse(productUID, err)
+	}
+	err = checkExpiryDate(newProduct, txTimestamp.Seconds)
+	if err != nil {
+		return errorResponse(productUID, err)
+	}
+
+	// ==== Complete product object and marshal to JSON ====
+	product := newProduct
+	product.CreatedAt = txTimestamp.Seconds
+	product.UpdatedAt = txTimestamp.Seconds
+	product.Version = 1
+	product.CreatedBy = submitterID(stub)
+	if len(args) > 12 && len(args[12]) > 0 {
+		autoSerial, _ := strconv.ParseBool(args[12]) //checked by parseProductArgs
+		if autoSerial {
+			product.SerialNo, err = nextSerial(stub, product.Ptype)
+			if err != nil {
+				return errorResponse(productUID, err)
+			}
+		}
+	}
+	productJSONasBytes, err := marshalProduct(product)
+	if err != nil {
+		return errorResponse(productUID, err)
+	}
+
+	// === Save product to state ===
+	err = stub.PutState(productKey(stub, productUID), productJSONasBytes)
+	if err != nil {
+		return errorResponse(productUID, err)
+	}
+
+	//  ==== Index the product to enable type, owner and batch range queries ====
+	//  Writes are only buffered in the transaction's write set until it commits, and
+	//  returning an error response discards all of them, so a failed index write can't leave
+	//  the primary record behind on its own and the order of the writes doesn't matter.
+	err = createProductIndexes(stub, product)
+	if err != nil {
+		return errorResponse(productUID, err)
+	}
+
+	// ==== Restrict future writes to the endorsing org, if requested ====
+	if len(args) > 5 && len(args[5]) > 0 {
+		err = setProductEndorsement(stub, productUID, args[5])
+		if err != nil {
+			return errorResponse(productUID, fmt.Errorf("Failed to set endorsement policy: %s", err))
+		}
+	}
+
+	fmt.Println("- end init product")
+	return initProductResponse(stub, product, txTimestamp.Seconds)
+}
+
+// initProductResponse confirms what initProduct wrote: {puid, indexKey, timestamp}
+func initProductResponse(stub shim.ChaincodeStubInterface, product *product, timestamp int64) pb.Response {
+	indexKeys, err := productIndexKeys(stub, product)
+	if err != nil {
+		return errorResponse(product.Puid, err)
+	}
+	typeNameIndexKey := indexKeys[0]
+
+	responseJSONasBytes, err := json.Marshal(struct {
+		Puid      string `json:"puid"`
+		IndexKey  string `json:"indexKey"`
+		Timestamp int64  `json:"timestamp"`
+	}{product.Puid, typeNameIndexKey, timestamp})
+	if err != nil {
+		return errorResponse(product.Puid, err)
+	}
+	return shim.Success(responseJSONasBytes)
+}
+
+// generatedPuidPrefix starts every puid minted by the chaincode
+const generatedPuidPrefix = "PRD-"
+
+// withGeneratedPuid returns initProduct's arguments with an empty puid replaced
+// by one derived from the transaction id. Every endorser sees the same
+// transaction id, so all of them derive the same puid, and transaction ids are
+// unique on the channel.
+func withGeneratedPuid(stub shim.ChaincodeStubInterface, args []string) []string {
+	if len(args) == 0 || len(args[0]) > 0 {
+		return args
+	}
+	txID := stub.GetTxID()
+	if len(txID) > 16 {
+		txID = txID[:16]
+	}
+	return append([]string{generatedPuidPrefix + txID}, args[1:]...)
+}
+
+// ==================================================================================
+// parseProductArgs runs initProduct's input sanitation over its arguments and
+// builds the product they describe. Every problem found is reported, in argument
+// order; the product is only usable when there are none.
+// ==================================================================================
+func parseProductArgs(args []string) (*product, []string) {
+	if len(args) < 4 || len(args) > 15 {
+		return nil, []string{"Incorrect number of arguments. Expecting 4 to 15"}
+	}
+
+	// ==== Input sanitation ====
+	problems := []string{}
+	if len(args[0]) <= 0 {
+		problems = append(problems, "1st argument must be a non-empty string")
+	} else if err := validatePuid(args[0]); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if len(args[1]) <= 0 {
+		problems = append(problems, "2nd argument must be a non-empty string")
+	}
+	if len(args[2]) <= 0 {
+		problems = append(problems, "3rd argument must be a non-empty string")
+	}
+	if len(args[3]) <= 0 {
+		problems = append(problems, "4th argument must be a non-empty string")
+	}
+
+	quantity := 1
+	if len(args) > 4 && len(args[4]) > 0 {
+		var err error
+		quantity, err = strconv.Atoi(args[4])
+		if err != nil {
+			problems = append(problems, "5th argument must be a numeric string")
+		} else if quantity <= 0 {
+			problems = append(problems, "5th argument must be a positive number")
+		}
+	}
+	manufacturer := ""
+	if len(args) > 6 {
+		manufacturer = strings.ToLower(args[6])
+	}
+	batchNo := ""
+	if len(args) > 7 {
+		batchNo = args[7]
+	}
+	if len(manufacturer) > 0 && len(batchNo) <= 0 {
+		problems = append(problems, "8th argument must be a non-empty string when a manufacturer is given")
+	}
+	var expiryDate int64
+	if len(args) > 8 && len(args[8]) > 0 {
+		var err error
+		expiryDate, err = strconv.ParseInt(args[8], 10, 64)
+		if err != nil {
+			problems = append(problems, "9th argument must be a numeric string")
+		}
+	}
+
+	objectType, err := parseDocType(args, 9)
+	if err != nil {
+		problems = append(problems, "10th argument: "+err.Error())
+	}
+	contentHash := ""
+	if len(args) > 10 && len(args[10]) > 0 {
+		contentHash = strings.ToLower(args[10])
+		if err := validateContentHash(contentHash); err != nil {
+			problems = append(problems, "11th argument: "+err.Error())
+		}
+	}
+	requestID := ""
+	if len(args) > 11 {
+		requestID = args[11]
+	}
+	if len(args) > 12 && len(args[12]) > 0 {
+		if _, err := strconv.ParseBool(args[12]); err != nil {
+			problems = append(problems, "13th argument must be true or false")
+		}
+	}
+	var weight float64
+	if len(args) > 13 && len(args[13]) > 0 {
+		var err error
+		weight, err = strconv.ParseFloat(args[13], 64)
+		if err != nil || math.IsNaN(weight) || math.IsInf(weight, 0) || weight < 0 {
+			problems = append(problems, "14th argument must be a non-negative number")
+		}
+	}
+	unit := ""
+	if len(args) > 14 {
+		unit = strings.ToLower(args[14])
+	}
+	if err := validateWeight(weight, unit); err != nil {
+		problems = append(problems, "15th argument: "+err.Error())
+	}
+	return &product{
+		ObjectType:   objectType,
+		Puid:         args[0],
+		Pname:        strings.ToLower(args[1]),
+		DisplayName:  args[1],
+		Ptype:        strings.ToLower(args[2]),
+		Owner:        args[3],
+		OwnerHistory: []string{},
+		Status:       statusManufactured,
+		Quantity:     quantity,
+		Manufacturer: manufacturer,
+		BatchNo:      batchNo,
+		ExpiryDate:   expiryDate,
+		ContentHash:  contentHash,
+		RequestID:    requestID,
+		Weight:       weight,
+		Unit:         unit,
+	}, problems
+}
+
+// validateWeight checks that a weight comes with one of the units of
+// kilogramsPerUnit; a unit without a weight is accepted
+func validateWeight(weight float64, unit string) error {
+	if len(unit) == 0 {
+		if weight != 0 {
+			return validationError("A weight needs a unit, one of kg, g and lb")
+		}
+		return nil
+	}
+	if _, ok := kilogramsPerUnit[unit]; !ok {
+		return validationError("Unknown unit: %s, allowed units: kg, g and lb", unit)
+	}
+	return nil
+}
+
+// serialCounterIndex keys the per-type serial counters read by nextSerial
+const serialCounterIndex = "counter~ptype"
+
+// ===========================================================================
+// nextSerial increments the serial counter of ptype and returns its new value,
+// so the first product of a type gets 1. The counter is read and written in the
+// same transaction, so concurrent transactions issuing serials of the same type
+// all read the same version of the counter key and all but the first to commit
+// fail MVCC validation. That conflict is what keeps serials unique; clients
+// minting many products of one type should send them one after another or use
+// initProductBatch.
+// ===========================================================================
+func nextSerial(stub shim.ChaincodeStubInterface, ptype string) (uint64, error) {
+	counterKey, err := stub.CreateCompositeKey(serialCounterIndex, []string{ptype})
+	if err != nil {
+		return 0, err
+	}
+	serial, err := getSerialCounterValue(stub, counterKey)
+	if err != nil {
+		return 0, err
+	}
+	serial++
+	err = stub.PutState(counterKey, []byte(strconv.FormatUint(serial, 10)))
+	if err != nil {
+		return 0, err
+	}
+	return serial, nil
+}
+
+// getSerialCounterValue reads the counter stored under counterKey, 0 if the type has none yet
+func getSerialCounterValue(stub shim.ChaincodeStubInterface, counterKey string) (uint64, error) {
+	counterAsBytes, err := stub.GetState(counterKey)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get serial counter: %s", err)
+	}
+	if counterAsBytes == nil {
+		return 0, nil
+	}
+	serial, err := strconv.ParseUint(string(counterAsBytes), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Stored serial counter is not a number: %s", err)
+	}
+	return serial, nil
+}
+
+// ===========================================================================
+// getSerialCounter - report the last serial number issued for a type, or for
+// every type when none is given: {"<ptype>": n, ...}
+// ===========================================================================
+func (t *SimpleChaincode) getSerialCounter(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0 (optional)
+	// "ptype"
+	if len(args) > 1 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 0 or 1"))
+	}
+	attributes := []string{}
+	if len(args) > 0 && len(args[0]) > 0 {
+		attributes = append(attributes, strings.ToLower(args[0]))
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(serialCounterIndex, attributes)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	defer resultsIterator.Close()
+
+	counters := make(map[string]uint64)
+	if len(attributes) > 0 {
+		counters[attributes[0]] = 0
+	}
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse("", err)
+		}
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return errorResponse("", err)
+		}
+		serial, err := strconv.ParseUint(string(responseRange.Value), 10, 64)
+		if err != nil {
+			return errorResponse("", &codedError{codeCorruptRecord, fmt.Sprintf("Stored serial counter is not a number: %s", err)})
+		}
+		counters[compositeKeyParts[0]] = serial
+	}
+
+	countersJSONasBytes, err := json.Marshal(counters)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	return shim.Success(countersJSONasBytes)
+}
+
+// validateContentHash checks that hash is a hex encoded SHA-256 digest
+func validateContentHash(hash string) error {
+	if len(hash) != 2*sha256.Size {
+		return fmt.Errorf("content hash must be %d hex characters", 2*sha256.Size)
+	}
+	if _, err := hex.DecodeString(hash); err != nil {
+		return fmt.Errorf("content hash must be a hex string")
+	}
+	return nil
+}
+
+// ===========================================================================
+// assertUniqueTypeName enforces that no two products of the same type share a
+// name. The type~name~puid index, active and archived, is searched on its type
+// and name components; an entry for any puid other than the given one is a
+// conflict. Products created by splitProduct deliberately keep the source's
+// type and name, as they are portions of the same product.
+// ===========================================================================
+func assertUniqueTypeName(stub shim.ChaincodeStubInterface, ptype string, pname string, puid string) error {
+	for _, indexName := range []string{"type~name~puid", archivedIndexPrefix + "type~name~puid"} {
+		resultsIterator, err := stub.GetStateByPartialCompositeKey(indexName, []string{ptype, pname})
+		if err != nil {
+			return err
+		}
+		for resultsIterator.HasNext() {
+			responseRange, err := resultsIterator.Next()
+			if err != nil {
+				resultsIterator.Close()
+				return err
+			}
+			_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+			if err != nil {
+				resultsIterator.Close()
+				return err
+			}
+			existingPuid := compositeKeyParts[len(compositeKeyParts)-1]
+			if existingPuid != puid {
+				resultsIterator.Close()
+				return alreadyExistsError("A product of type %s named %s already exists: %s", ptype, pname, existingPuid)
+			}
+		}
+		resultsIterator.Close()
+	}
+	return nil
+}
+
+// checkExpiryDate rejects an expiry date that isn't after the transaction time.
+// A zero ExpiryDate means the product doesn't expire.
+func checkExpiryDate(product *product, txTimestamp int64) error {
+	if product.ExpiryDate != 0 && product.ExpiryDate <= txTimestamp {
+		return validationError("Expiry date of %s must be in the future", product.Puid)
+	}
+	return nil
+}
+
+// ==================================================================================
+// validateProduct - dry run of initProduct. Takes the same arguments, runs the same
+// sanitation and duplicate check, and returns {"valid": bool, "problems": [...]}
+// without writing anything. An invalid product is reported, not failed.
+// ==================================================================================
+func (t *SimpleChaincode) validateProduct(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	newProduct, problems := parseProductArgs(withGeneratedPuid(stub, args))
+
+	// ==== Check if product already exists ====
+	if newProduct != nil && len(newProduct.Puid) > 0 {
+		productAsBytes, err := stub.GetState(productKey(stub, newProduct.Puid))
+		if err != nil {
+			return errorResponse("", fmt.Errorf("Failed to get product: %s", err))
+		} else if productAsBytes != nil {
+			problems = append(problems, "This product already exists: "+newProduct.Puid)
+		}
+		if len(newProduct.Ptype) > 0 && len(newProduct.Pname) > 0 {
+			err = assertUniqueTypeName(stub, newProduct.Ptype, newProduct.Pname, newProduct.Puid)
+			if err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+
+		txTimestamp, err := stub.GetTxTimestamp()
+		if err != nil {
+			return errorResponse("", err)
+		}
+		err = checkExpiryDate(newProduct, txTimestamp.Seconds)
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	reportJSONasBytes, err := json.Marshal(struct {
+		Valid    bool     `json:"valid"`
+		Problems []string `json:"problems"`
+	}{len(problems) == 0, problems})
+	if err != nil {
+		return errorResponse("", err)
+	}
+	return shim.Success(reportJSONasBytes)
+}
+
+// ==================================================================================
+// initProductBatch - create many products in one transaction from a JSON array of
+// product objects. Every product is validated before anything is written, so a
+// single bad entry rejects the whole batch. Entries take the fields of
+// batchProduct; any other field is dropped, or refused when StrictArgs is set.
+// ==================================================================================
+func (t *SimpleChaincode) initProductBatch(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "[{\"puid\":\"p1\",\"pname\":\"widget\",\"ptype\":\"10\",\"owner\":\"alice\"}, ...]"
+	if len(args) != 1 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 1"))
+	}
+
+	fmt.Println("- start init product batch")
+
+	// ==== Only manufacturers may mint products ====
+	err := assertRole(stub, manufacturerRole)
+	if err != nil {
+		return errorResponse("", err)
+	}
+
+	var entries []batchProduct
+	err = decodeArg(stub, []byte(args[0]), &entries)
+	if err != nil {
+		return errorResponse("", validationError("1st argument must be a JSON array of products: %s", err))
+	}
+	if len(entries) == 0 {
+		return errorResponse("", validationError("1st argument must contain at least one product"))
+	}
+
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return errorResponse("", err)
+	}
+
+	// ==== Input sanitation for every product before any write ====
+	products := make([]product, len(entries))
+	seen := make(map[string]bool)
+	seenTypeNames := make(map[string]bool)
+	for i, entry := range entries {
+		if len(entry.Puid) <= 0 || len(entry.Pname) <= 0 || len(entry.Ptype) <= 0 || len(entry.Owner) <= 0 {
+			return errorResponse("", validationError("Product %d must have non-empty puid, pname, ptype and owner", i))
+		}
+		err = validatePuid(entry.Puid)
+		if err != nil {
+			return errorResponse("", &codedError{errorCode(err), fmt.Sprintf("Product %d: %s", i, err)})
+		}
+		if seen[entry.Puid] {
+			return errorResponse("", validationError("Duplicate puid in batch: %s", entry.Puid))
+		}
+		seen[entry.Puid] = true
+
+		productAsBytes, err := stub.GetState(productKey(stub, entry.Puid))
+		if err != nil {
+			return errorResponse("", fmt.Errorf("Failed to get product: %s", err))
+		} else if productAsBytes != nil {
+			return errorResponse("", alreadyExistsError("This product already exists: %s", entry.Puid))
+		}
+
+		if entry.Quantity < 0 {
+			return errorResponse("", validationError("Product %d must have a positive quantity", i))
+		}
+		p := &products[i]
+		*p = product{
+			ObjectType:   strings.ToLower(entry.ObjectType),
+			Puid:         entry.Puid,
+			Pname:        strings.ToLower(entry.Pname),
+			DisplayName:  entry.DisplayName,
+			Ptype:        strings.ToLower(entry.Ptype),
+			Owner:        entry.Owner,
+			OwnerHistory: []string{},
+			Status:       statusManufactured,
+			Quantity:     entry.Quantity,
+			Manufacturer: strings.ToLower(entry.Manufacturer),
+			BatchNo:      entry.BatchNo,
+			CreatedAt:    txTimestamp.Seconds,
+			UpdatedAt:    txTimestamp.Seconds,
+			Version:      1,
+			ExpiryDate:   entry.ExpiryDate,
+			ContentHash:  strings.ToLower(entry.ContentHash),
+			CreatedBy:    submitterID(stub),
+			Weight:       entry.Weight,
+			Unit:         strings.ToLower(entry.Unit),
+		}
+		if len(p.ObjectType) == 0 {
+			p.ObjectType = defaultDocType
+		}
+		if !isAllowedDocType(p.ObjectType) {
+			return errorResponse("", validationError("Product %d: unknown docType: %s, allowed docTypes: %v", i, p.ObjectType, allowedDocTypes))
+		}
+		if len(p.DisplayName) == 0 {
+			p.DisplayName = entry.Pname
+		}
+		if p.Quantity == 0 {
+			p.Quantity = 1
+		}
+		typeName := p.Ptype + "\x00" + p.Pname
+		if seenTypeNames[typeName] {
+			return errorResponse("", validationError("Duplicate name in batch for type %s: %s", p.Ptype, p.Pname))
+		}
+		seenTypeNames[typeName] = true
+		err = assertUniqueTypeName(stub, p.Ptype, p.Pname, p.Puid)
+		if err != nil {
+			return errorResponse("", err)
+		}
+		err = assertRegisteredOwner(stub, p.Owner)
+		if err != nil {
+			return errorResponse("", &codedError{errorCode(err), fmt.Sprintf("Product %d: %s", i, err)})
+		}
+		if len(p.Manufacturer) > 0 && len(p.BatchNo) <= 0 {
+			return errorResponse("", validationError("Product %d must have a batchNo when a manufacturer is given", i))
+		}
+		err = checkExpiryDate(p, txTimestamp.Seconds)
+		if err != nil {
+			return errorResponse("", err)
+		}
+		if math.IsNaN(p.Weight) || math.IsInf(p.Weight, 0) || p.Weight < 0 {
+			return errorResponse("", validationError("Product %d must have a non-negative weight", i))
+		}
+		err = validateWeight(p.Weight, p.Unit)
+		if err != nil {
+			return errorResponse("", &codedError{errorCode(err), fmt.Sprintf("Product %d: %s", i, err)})
+		}
+		if len(p.ContentHash) > 0 {
+			err = validateContentHash(p.ContentHash)
+			if err != nil {
+				return errorResponse("", &codedError{errorCode(err), fmt.Sprintf("Product %d: %s", i, err)})
+			}
+		}
+	}
+
+	// === Save products and their indexes to state ===
+	for i := range products {
+		productJSONasBytes, err := marshalProduct(&products[i])
+		if err != nil {
+			return errorResponse("", err)
+		}
+		err = stub.PutState(productKey(stub, products[i].Puid), productJSONasBytes)
+		if err != nil {
+			return errorResponse("", err)
+		}
+		err = createProductIndexes(stub, &products[i])
+		if err != nil {
+			return errorResponse("", err)
+		}
+	}
+
+	responsePayload := fmt.Sprintf("{\"created\":%d}", len(products))
+	fmt.Println("- end init product batch: " + responsePayload)
+	return shim.Success([]byte(responsePayload))
+}
+
+// ==================================================================================
+// cloneProduct - create a product from an existing one used as a template. The
+// clone takes the source's type, owner, quantity, weight, location, manufacturer,
+// batch, expiry date, content hash, co-owners and metadata. Everything describing the
+// source's own life is reset as for a new product: status, version, timestamps,
+// owner history, lineage, sale price, recall, archiving, transfer reason and
+// note, serial number, compliance and restore marks. Names are unique within a
+// type, so the clone needs its own name. Its endorsement policy is not copied.
+// ==================================================================================
+func (t *SimpleChaincode) cloneProduct(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0             1          2
+	// "sourcePuid", "newPuid", "newPname"
+	if len(args) != 3 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 3"))
+	}
+
+	sourcePuid := args[0]
+	newPuid := args[1]
+	newPname := strings.ToLower(args[2])
+	if len(newPuid) <= 0 {
+		return errorResponse("", validationError("2nd argument must be a non-empty string"))
+	}
+	err := validatePuid(newPuid)
+	if err != nil {
+		return errorResponse(newPuid, err)
+	}
+	if len(newPname) <= 0 {
+		return errorResponse(newPuid, validationError("3rd argument must be a non-empty string"))
+	}
+	fmt.Println("- start cloneProduct ", sourcePuid, newPuid)
+
+	// ==== Only manufacturers may mint products ====
+	err = assertRole(stub, manufacturerRole)
+	if err != nil {
+		return errorResponse(newPuid, err)
+	}
+
+	sourceAsBytes, err := stub.GetState(productKey(stub, sourcePuid))
+	if err != nil {
+		return errorResponse(sourcePuid, fmt.Errorf("Failed to get product:%s", err))
+	} else if sourceAsBytes == nil {
+		return errorResponse(sourcePuid, notFoundError("Product does not exist: %s", sourcePuid))
+	}
+	source := product{}
+	err = json.Unmarshal(sourceAsBytes, &source)
+	if err != nil {
+		return errorResponse(sourcePuid, fmt.Errorf("Failed to decode JSON of: %s", sourcePuid))
+	}
+
+	existingAsBytes, err := stub.GetState(productKey(stub, newPuid))
+	if err != nil {
+		return errorResponse(newPuid, fmt.Errorf("Failed to get product:%s", err))
+	} else if existingAsBytes != nil {
+		return errorResponse(newPuid, alreadyExistsError("This product already exists: %s", newPuid))
+	}
+	err = assertUniqueTypeName(stub, source.Ptype, newPname, newPuid)
+	if err != nil {
+		return errorResponse(newPuid, err)
+	}
+	err = assertRegisteredOwner(stub, source.Owner)
+	if err != nil {
+		return errorResponse(newPuid, err)
+	}
+
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return errorResponse(newPuid, err)
+	}
+	clone := &product{
+		ObjectType:   source.ObjectType,
+		Puid:         newPuid,
+		Pname:        newPname,
+		DisplayName:  args[2],
+		Ptype:        source.Ptype,
+		Owner:        source.Owner,
+		OwnerHistory: []string{},
+		Status:       statusManufactured,
+		Quantity:     source.Quantity,
+		Location:     source.Location,
+		Manufacturer: source.Manufacturer,
+		BatchNo:      source.BatchNo,
+		CreatedAt:    txTimestamp.Seconds,
+		UpdatedAt:    txTimestamp.Seconds,
+		Version:      1,
+		ExpiryDate:   source.ExpiryDate,
+		ContentHash:  source.ContentHash,
+		CreatedBy:    submitterID(stub),
+		Weight:       source.Weight,
+		Unit:         source.Unit,
+	}
+	if len(source.Owners) > 0 {
+		clone.Owners = make(map[string]float64, len(source.Owners))
+		for owner, share := range source.Owners {
+			clone.Owners[owner] = share
+		}
+	}
+	if len(source.Metadata) > 0 {
+		clone.Metadata = make(map[string]string, len(source.Metadata))
+		for key, value := range source.Metadata {
+			clone.Metadata[key] = value
+		}
+	}
+	err = checkExpiryDate(clone, txTimestamp.Seconds)
+	if err != nil {
+		return errorResponse(newPuid, err)
+	}
+
+	cloneJSONasBytes, err := marshalProduct(clone)
+	if err != nil {
+		return errorResponse(newPuid, err)
+	}
+	err = stub.PutState(productKey(stub, newPuid), cloneJSONasBytes)
+	if err != nil {
+		return errorResponse(newPuid, err)
+	}
+	err = createProductIndexes(stub, clone)
+	if err != nil {
+		return errorResponse(newPuid, err)
+	}
+
+	fmt.Println("- end cloneProduct")
+	return initProductResponse(stub, clone, txTimestamp.Seconds)
+}
+
+// namespaceKeysByChannel reports whether the configuration's NamespaceKeysByChannel
+// is set. It is then that each product is stored under its channel ID followed
+// by channelKeySeparator and its puid instead of under the bare puid, so records
+// exported from or copied between channels show where they belong. Every
+// channel already has a world state of its own, so this is only a labelling
+// aid; it is off by default because turning it on would hide every existing
+// record from the handlers, and updateConfig refuses to change it on a channel
+// holding products. Turn it on with Init when instantiating the chaincode.
+// Only the product records are prefixed: the composite index keys, the
+// pending transfer, sensor and registry keys and private data keep their
+// layout and hold bare puids, which the handlers map through productKey.
+// Range handlers take bare puid bounds and return the prefixed keys in Key.
+// Rich query selectors match the fields of the record, which keep the bare
+// puid, so they need no change; the Key of their results is the prefixed key.
+// Outside Invoke the configuration is read from state, and taken as off when
+// it can't be read.
+func namespaceKeysByChannel(stub shim.ChaincodeStubInterface) bool {
+	if configured, ok := stub.(*configuredStub); ok {
+		return configured.config.NamespaceKeysByChannel
+	}
+	config, err := loadConfig(stub)
+	return err == nil && config.NamespaceKeysByChannel
+}
+
+// channelKeySeparator joins the channel ID and the puid in a namespaced key
+const channelKeySeparator = "/"
+
+// productKey returns the state key a product is stored under
+func productKey(stub shim.ChaincodeStubInterface, puid string) string {
+	if !namespaceKeysByChannel(stub) {
+		return puid
+	}
+	return stub.GetChannelID() + channelKeySeparator + puid
+}
+
+// productKeyRange maps a range of puids to the range of state keys holding
+// them. An empty end runs to the last product as it does for GetStateByRange.
+func productKeyRange(stub shim.ChaincodeStubInterface, startPuid string, endPuid string) (string, string) {
+	if !namespaceKeysByChannel(stub) {
+		return startPuid, endPuid
+	}
+	startKey := productKey(stub, startPuid)
+	if len(endPuid) == 0 {
+		return startKey, productKey(stub, string(utf8.MaxRune))
+	}
+	return startKey, productKey(stub, endPuid)
+}
+
+// maxPuidLength is the longest puid initProduct accepts, in bytes
+const maxPuidLength = 64
+
+// ===========================================================================
+// validatePuid rejects puids that would corrupt composite keys: Fabric joins
+// composite key components with the U+0000 delimiter, so a puid containing it
+// could collide with another index entry.
+// ===========================================================================
+func validatePuid(puid string) error {
+	if len(puid) > maxPuidLength {
+		return validationError("puid must be at most %d bytes long", maxPuidLength)
+	}
+	if !utf8.ValidString(puid) {
+		return validationError("puid must be a valid UTF-8 string")
+	}
+	if strings.ContainsRune(puid, 0) {
+		return validationError("puid must not contain the U+0000 character")
+	}
+	if strings.TrimSpace(puid) != puid {
+		return validationError("puid must not have leading or trailing whitespace")
+	}
+	if puid == configKey {
+		return validationError("puid %s is reserved", configKey)
+	}
+	return nil
+}
+
+// productIndexNames lists every composite-key index maintained for products.
+// productIndexKeys must return exactly one key per index named here.
+var productIndexNames = []string{"type~name~puid", "owner~puid", "mfr~batch~puid", "owner~type~puid", "creator~puid", "status~puid"}
+
+// archivedIndexPrefix is prepended to every index name for archived products, so they
+// drop out of the active indexes but can still be enumerated on request.
+const archivedIndexPrefix = "archived~"
+
+// ===========================================================================
+// productIndexKeys returns the composite keys, one per entry of
+// productIndexNames, under which a product is indexed. The puid is the last
+// component of every key, so entries stay distinct per product and the puid
+// can be recovered with SplitCompositeKey. Archived products are indexed
+// under the same names with archivedIndexPrefix in front.
+// ===========================================================================
+func productIndexKeys(stub shim.ChaincodeStubInterface, product *product) ([]string, error) {
+	prefix := ""
+	if product.Archived {
+		prefix = archivedIndexPrefix
+	}
+	typeNameIndexKey, err := stub.CreateCompositeKey(prefix+"type~name~puid", []string{product.Ptype, product.Pname, product.Puid})
+	if err != nil {
+		return nil, err
+	}
+	ownerPuidIndexKey, err := stub.CreateCompositeKey(prefix+"owner~puid", []string{product.Owner, product.Puid})
+	if err != nil {
+		return nil, err
+	}
+	mfrBatchIndexKey, err := stub.CreateCompositeKey(prefix+"mfr~batch~puid", []string{product.Manufacturer, product.BatchNo, product.Puid})
+	if err != nil {
+		return nil, err
+	}
+	ownerTypeIndexKey, err := stub.CreateCompositeKey(prefix+"owner~type~puid", []string{product.Owner, product.Ptype, product.Puid})
+	if err != nil {
+		return nil, err
+	}
+	// cid.GetID is base64 encoded, so it is safe to use as a composite key attribute
+	creatorIndexKey, err := stub.CreateCompositeKey(prefix+"creator~puid", []string{product.CreatedBy, product.Puid})
+	if err != nil {
+		return nil, err
+	}
+	status := product.Status
+	if status == "" { //record predates Status
+		status = statusManufactured
+	}
+	statusIndexKey, err := stub.CreateCompositeKey(prefix+"status~puid", []string{status, product.Puid})
+	if err != nil {
+		return nil, err
+	}
+	return []string{typeNameIndexKey, ownerPuidIndexKey, mfrBatchIndexKey, ownerTypeIndexKey, creatorIndexKey, statusIndexKey}, nil
+}
+
+// indexValue is the value stored under each index entry of a product: its puid,
+// so an entry can be checked against the key it is stored under, see
+// verifyIndexIntegrity. Entries written before this held a 0x00 byte until
+// reindexProducts rewrites them. A hash of the product would say more, but it
+// would change with every write of the product and so every entry would have
+// to be rewritten every time.
+func indexValue(product *product) []byte {
+	return []byte(product.Puid)
+}
+
+// ===========================================================================
+// createProductIndexes writes all index entries for a product
+// ===========================================================================
+func createProductIndexes(stub shim.ChaincodeStubInterface, product *product) error {
+	indexKeys, err := productIndexKeys(stub, product)
+	if err != nil {
+		return err
+	}
+	value := indexValue(product)
+	for _, indexKey := range indexKeys {
+		err = stub.PutState(indexKey, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ===========================================================================
+// deleteProductIndexes removes all index entries for a product
+// ===========================================================================
+func deleteProductIndexes(stub shim.ChaincodeStubInterface, product *product) error {
+	indexKeys, err := productIndexKeys(stub, product)
+	if err != nil {
+		return err
+	}
+	for _, indexKey := range indexKeys {
+		err = stub.DelState(indexKey)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ===========================================================================
+// updateProductIndexes moves a product's index entries from the keys derived
+// from its old value to those derived from its new value. Entries whose key
+// did not change are left alone.
+// ===========================================================================
+func updateProductIndexes(stub shim.ChaincodeStubInterface, oldProduct *product, newProduct *product) error {
+	oldKeys, err := productIndexKeys(stub, oldProduct)
+	if err != nil {
+		return err
+	}
+	newKeys, err := productIndexKeys(stub, newProduct)
+	if err != nil {
+		return err
+	}
+	for i := range oldKeys {
+		if oldKeys[i] == newKeys[i] {
+			continue
+		}
+		err = stub.DelState(oldKeys[i])
+		if err != nil {
+			return err
+		}
+		err = stub.PutState(newKeys[i], indexValue(newProduct))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ==================================================================================
+// initProductPrivateDetails - store the private details of an existing product in
+// the collectionProductPrivate private data collection.
+//
+// The details are passed in the transient map under the "product_private" key so
+// they never appear in the transaction written to the channel ledger:
+//
+//	{"puid":"1q2","cost":12.5,"supplierContract":"ACME-2019-04"}
+//
+// The chaincode must be instantiated with a collection definition such as:
+//
+//	[{"name":"collectionProductPrivate","policy":"OR('Org1MSP.member')",
+//	  "requiredPeerCount":0,"maxPeerCount":3,"blockToLive":0}]
+//
+// Only peers of organisations in the policy store the plaintext; every other peer
+// keeps just a hash, and readProduct keeps returning the public fields only.
+// ==================================================================================
+func (t *SimpleChaincode) initProductPrivateDetails(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return errorResponse("", validationError("Incorrect number of arguments. Private details must be passed in transient map."))
+	}
+
+	fmt.Println("- start init product private details")
+	transMap, err := stub.GetTransient()
+	if err != nil {
+		return errorResponse("", fmt.Errorf("Error getting transient: %s", err))
+	}
+	privateAsBytes, ok := transMap["product_private"]
+	if !ok {
+		return errorResponse("", validationError("product_private must be a key in the transient map"))
+	}
+
+	var details productPrivateDetails
+	err = decodeArg(stub, privateAsBytes, &details)
+	if err != nil {
+		return errorResponse("", validationError("Failed to decode JSON of: product_private: %s", err))
+	}
+	if len(details.Puid) <= 0 {
+		return errorResponse(details.Puid, validationError("puid field must be a non-empty string"))
+	}
+	if details.Cost < 0 {
+		return errorResponse(details.Puid, validationError("cost field must be a non-negative number"))
+	}
+
+	// ==== The public product record must exist ====
+	productAsBytes, err := stub.GetState(productKey(stub, details.Puid))
+	if err != nil {
+		return errorResponse(details.Puid, fmt.Errorf("Failed to get product: %s", err))
+	} else if productAsBytes == nil {
+		return errorResponse(details.Puid, notFoundError("Product does not exist: %s", details.Puid))
+	}
+	publicProduct := product{}
+	err = decodeProduct(details.Puid, productAsBytes, &publicProduct)
+	if err != nil {
+		return errorResponse(details.Puid, err)
+	}
+	err = assertOwnerOrRegulator(stub, publicProduct.Owner)
+	if err != nil {
+		return errorResponse(details.Puid, err)
+	}
+
+	details.ObjectType = "productPrivateDetails"
+	detailsJSONasBytes, err := json.Marshal(details)
+	if err != nil {
+		return errorResponse(details.Puid, err)
+	}
+	err = stub.PutPrivateData(productPrivateCollection, details.Puid, detailsJSONasBytes)
+	if err != nil {
+		return errorResponse(details.Puid, err)
+	}
+
+	fmt.Println("- end init product private details")
+	return shim.Success(nil)
+}
+
+// ==================================================================================
+// readProductPrivate - read a product's private details from collectionProductPrivate.
+// Only succeeds on peers of organisations that are members of the collection.
+// ==================================================================================
+func (t *SimpleChaincode) readProductPrivate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "puid"
+	if len(args) != 1 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting product ID of the product to query"))
+	}
+
+	puid := args[0]
+	valAsbytes, err := stub.GetPrivateData(productPrivateCollection, puid) //get the private details from chaincode state
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to get private details for %s", puid))
+	} else if valAsbytes == nil {
+		return errorResponse(puid, notFoundError("Product private details do not exist: %s", puid))
+	}
+
+	return shim.Success(valAsbytes)
+}
+
+// ===========================================================================
+// readProduct - read a product as stored. Failures carry an HTTP status, see
+// statusErrorResponse: 404 for a missing product, 400 for bad arguments.
+// ===========================================================================
+func (t *SimpleChaincode) readProduct(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var Puid string
+	var err error
+
+	//   0
+	// "puid"
+	if len(args) != 1 {
+		return statusErrorResponse("", validationError("Incorrect number of arguments. Expecting product ID of the product to query"))
+	}
+
+	Puid = args[0]
+	valAsbytes, err := stub.GetState(productKey(stub, Puid)) //get the product from chaincode state
+	if err != nil {
+		return statusErrorResponse(Puid, fmt.Errorf("Failed to get state for %s", Puid))
+	} else if valAsbytes == nil {
+		return statusErrorResponse(Puid, notFoundError("Product does not exist: %s", Puid))
+	}
+
+	return shim.Success(valAsbytes)
+}
+
+// ===========================================================================
+// readProductStrict - readProduct, also rejecting with 400 a puid initProduct
+// would not accept and checking the stored record is a product. A key holding
+// something else, such as the configuration, is reported as not found (404)
+// and a record that can't be decoded fails with CORRUPT_RECORD and 500.
+// ===========================================================================
+func (t *SimpleChaincode) readProductStrict(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "puid"
+	if len(args) != 1 {
+		return statusErrorResponse("", validationError("Incorrect number of arguments. Expecting 1"))
+	}
+
+	puid := args[0]
+	err := validatePuid(puid)
+	if err == nil && len(puid) == 0 {
+		err = validationError("puid must be a non-empty string")
+	}
+	if err != nil {
+		return statusErrorResponse(puid, err)
+	}
+	valAsbytes, err := stub.GetState(productKey(stub, puid))
+	if err != nil {
+		return statusErrorResponse(puid, fmt.Errorf("Failed to get state for %s", puid))
+	} else if valAsbytes == nil {
+		return statusErrorResponse(puid, notFoundError("Product does not exist: %s", puid))
+	}
+
+	current := product{}
+	err = decodeProduct(puid, valAsbytes, &current)
+	if err != nil {
+		return statusErrorResponse(puid, err)
+	}
+	if !isAllowedDocType(current.ObjectType) {
+		return statusErrorResponse(puid, notFoundError("Product does not exist: %s", puid))
+	}
+	return shim.Success(valAsbytes)
+}
+
+// ===========================================================================
+// getProductForCC - read a product for another chaincode calling this one with
+// stub.InvokeChaincode, e.g. InvokeChaincode("supply", [][]byte{[]byte(
+// "getProductForCC"), []byte(puid)}, ""), returning the ccProduct layout. The
+// handler only reads state, so it can be called from another channel, where
+// Fabric would discard writes anyway. A called chaincode sees the original
+// client as the submitter, so identity checks apply to that client, and events
+// it sets are dropped, so handlers emitting events should be invoked directly.
+// A missing product fails with a NOT_FOUND error envelope.
+// ===========================================================================
+func (t *SimpleChaincode) getProductForCC(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "puid"
+	if len(args) != 1 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 1"))
+	}
+
+	puid := args[0]
+	valAsbytes, err := stub.GetState(productKey(stub, puid))
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to get state for %s", puid))
+	} else if valAsbytes == nil {
+		return errorResponse(puid, notFoundError("Product does not exist: %s", puid))
+	}
+
+	current := product{}
+	err = json.Unmarshal(valAsbytes, &current)
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Stored record is not a valid product: %s", err))
+	}
+
+	responseJSONasBytes, err := json.Marshal(ccProduct{
+		Schema:      ccProductSchema,
+		Puid:        current.Puid,
+		DocType:     current.ObjectType,
+		Pname:       current.Pname,
+		DisplayName: displayName(&current),
+		Ptype:       current.Ptype,
+		Owner:       current.Owner,
+		Status:      current.Status,
+		Quantity:    current.Quantity,
+		Archived:    current.Archived,
+		Version:     current.Version,
+		UpdatedAt:   current.UpdatedAt,
+	})
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	return shim.Success(responseJSONasBytes)
+}
+
+// displayName returns the name of a product in its original casing, or Pname
+// for records created before DisplayName existed
+func displayName(product *product) string {
+	if len(product.DisplayName) > 0 {
+		return product.DisplayName
+	}
+	return product.Pname
+}
+
+// ===========================================================================
+// productExists - report {"exists": true|false} for a puid. Unlike readProduct
+// a missing product is not an error, so clients can check before creating one.
+// ===========================================================================
+func (t *SimpleChaincode) productExists(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "puid"
+	if len(args) != 1 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 1"))
+	}
+
+	puid := args[0]
+	valAsbytes, err := stub.GetState(productKey(stub, puid))
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to get state for %s", puid))
+	}
+
+	responseJSONasBytes, err := json.Marshal(struct {
+		Exists bool `json:"exists"`
+	}{valAsbytes != nil})
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	return shim.Success(responseJSONasBytes)
+}
+
+// ===========================================================================
+// getProductAsMap - read a product through the current product struct. Unlike
+// readProduct, which returns the stored bytes as they are, the record is decoded
+// and encoded again, so records written by older versions of this chaincode come
+// back in the current shape, with zero values for fields added since.
+// ===========================================================================
+func (t *SimpleChaincode) getProductAsMap(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "puid"
+	if len(args) != 1 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 1"))
+	}
+
+	puid := args[0]
+	valAsbytes, err := stub.GetState(productKey(stub, puid))
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to get state for %s", puid))
+	} else if valAsbytes == nil {
+		return errorResponse(puid, notFoundError("Product does not exist: %s", puid))
+	}
+
+	current := product{}
+	err = json.Unmarshal(valAsbytes, &current)
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Stored record is not a valid product: %s", err))
+	}
+	if current.OwnerHistory == nil { //record predates OwnerHistory
+		current.OwnerHistory = []string{}
+	}
+
+	productJSONasBytes, err := json.Marshal(current)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	return shim.Success(productJSONasBytes)
+}
+
+// ===========================================================================
+// readProductPretty - read a product indented for people, e.g. in audit exports.
+// readProduct stays compact; this is only an output mode and costs the extra
+// whitespace in the response.
+// ===========================================================================
+func (t *SimpleChaincode) readProductPretty(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "puid"
+	if len(args) != 1 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 1"))
+	}
+
+	puid := args[0]
+	valAsbytes, err := stub.GetState(productKey(stub, puid))
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to get state for %s", puid))
+	} else if valAsbytes == nil {
+		return errorResponse(puid, notFoundError("Product does not exist: %s", puid))
+	}
+
+	current := product{}
+	err = json.Unmarshal(valAsbytes, &current)
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Stored record is not a valid product: %s", err))
+	}
+
+	productJSONasBytes, err := json.MarshalIndent(current, "", "  ")
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	return shim.Success(productJSONasBytes)
+}
+
+// maxBulkReadPuids caps the puids readProductsBulk accepts per call
+const maxBulkReadPuids = 500
+
+// ===========================================================================
+// readProductsBulk - read many products in one call, e.g. to verify a shipment
+// manifest. Takes a JSON array of puids and returns a JSON object mapping each
+// puid to its record, or to null if there is no such product.
+// ===========================================================================
+func (t *SimpleChaincode) readProductsBulk(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "[\"p1\",\"p2\", ...]"
+	if len(args) != 1 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 1"))
+	}
+
+	var puids []string
+	err := json.Unmarshal([]byte(args[0]), &puids)
+	if err != nil {
+		return errorResponse("", validationError("1st argument must be a JSON array of puids: %s", err))
+	}
+	if len(puids) > maxBulkReadPuids {
+		return errorResponse("", validationError("Too many puids: %d, at most %d may be read per call", len(puids), maxBulkReadPuids))
+	}
+	fmt.Println("- start readProductsBulk ", len(puids))
+
+	records := make(map[string]json.RawMessage, len(puids))
+	for _, puid := range puids {
+		valAsbytes, err := stub.GetState(productKey(stub, puid))
+		if err != nil {
+			return errorResponse(puid, fmt.Errorf("Failed to get state for %s", puid))
+		}
+		if valAsbytes == nil {
+			records[puid] = nil // marshalled as null
+			continue
+		}
+		records[puid] = valAsbytes
+	}
+
+	recordsJSONasBytes, err := json.Marshal(records)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	return shim.Success(recordsJSONasBytes)
+}
+
+// transferReasonTransientKey is the transient map key transferProduct reads a
+// confidential transfer reason from
+const transferReasonTransientKey = "transfer_reason"
+
+// ===========================================================================
+// transferProduct - hand a product to a new owner. A confidential reason or
+// reference number may be passed in the transient map under "transfer_reason";
+// transient data is not written to the ledger, and only its SHA-256 is stored
+// in TransferReasonHash, so an auditor given the plaintext can check it later.
+// A short or guessable reason can be recovered from its hash by brute force, so
+// clients should add a random reference to it. A public note can be passed as
+// an argument instead; it is stored in TransferNote and so kept in history.
+// ===========================================================================
+func (t *SimpleChaincode) transferProduct(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0         1           2 (optional)         3 (optional) 4 (optional)
+	// "puid", "newOwner", "expectedVersion", "note",      "newOwnerMSP"
+	// newOwnerMSP is required when the product's last sale price is above
+	// highValueThreshold, see requireCoEndorsement.
+	if len(args) < 2 || len(args) > 5 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 2 to 5"))
+	}
+
+	puid := args[0]
+	newOwner := args[1]
+	fmt.Println("- start product transfer ", puid, newOwner)
+
+	productAsBytes, err := stub.GetState(productKey(stub, puid))
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to get product:%s", err))
+	} else if productAsBytes == nil {
+		return errorResponse(puid, notFoundError("Product does not exist"))
+	}
+
+	productToTransfer := product{}
+	err = decodeProduct(puid, productAsBytes, &productToTransfer)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	beforeTransfer := productToTransfer
+
+	err = checkVersion(&productToTransfer, args, 2)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	// ==== Only the current owner (or a regulator) may transfer ====
+	err = assertOwnerOrRegulator(stub, productToTransfer.Owner)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	// ==== Keep only a hash of the confidential reason, if one was given ====
+	transMap, err := stub.GetTransient()
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Error getting transient: %s", err))
+	}
+	productToTransfer.TransferReasonHash = ""
+	if reason, ok := transMap[transferReasonTransientKey]; ok && len(reason) > 0 {
+		reasonHash := sha256.Sum256(reason)
+		productToTransfer.TransferReasonHash = hex.EncodeToString(reasonHash[:])
+	}
+	productToTransfer.TransferNote = ""
+	if len(args) > 3 {
+		productToTransfer.TransferNote = strings.TrimSpace(args[3])
+	}
+
+	previousOwner := productToTransfer.Owner
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	newOwnerMSP := ""
+	if len(args) > 4 {
+		newOwnerMSP = args[4]
+	}
+	err = moveProductToOwner(stub, &productToTransfer, newOwner, newOwnerMSP, txTimestamp.Seconds)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	// ==== Notify subscribers of the ownership change ====
+	changed, err := productDiff(&beforeTransfer, &productToTransfer)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	eventJSONasBytes, err := json.Marshal(transferEvent{puid, previousOwner, newOwner, txTimestamp.Seconds, productToTransfer.LastModifiedBy, stub.GetTxID(), changed})
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = stub.SetEvent(productTransferredEvent, eventJSONasBytes)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	fmt.Println("- end of product transfer (success)")
+	return shim.Success(nil)
+}
+
+// ==================================================================
+// deleteProduct - remove a product key/value pair and its index from state,
+// along with its pending transfer and sensor readings. An escrow hold is part
+// of the product record and goes with it. Only the owner (or a regulator) may
+// delete a product.
+// ==================================================================
+func (t *SimpleChaincode) deleteProduct(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var productJSON product
+	//   0         1 (optional)
+	// "puid", "expectedVersion"
+	if len(args) != 1 && len(args) != 2 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 1 or 2"))
+	}
+	puid := args[0]
+
+	// to maintain the type~name~puid index, we need to read the product first and get its type and name
+	valAsbytes, err := stub.GetState(productKey(stub, puid)) //get the product from chaincode state
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to get state for %s", puid))
+	} else if valAsbytes == nil {
+		return errorResponse(puid, notFoundError("Product does not exist: %s", puid))
+	}
+
+	err = decodeProduct(puid, valAsbytes, &productJSON)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = checkVersion(&productJSON, args, 1)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = assertOwnerOrRegulator(stub, productJSON.Owner)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	err = stub.DelState(productKey(stub, puid)) //remove the product from chaincode state
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to delete state:%s", err))
+	}
+
+	// maintain the indexes
+	err = deleteProductIndexes(stub, &productJSON)
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to delete state:%s", err))
+	}
+
+	// ==== Remove the records kept apart from the product ====
+	err = deleteProductRecords(stub, puid)
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to delete state:%s", err))
+	}
+
+	fmt.Println("- end delete product (success)")
+	return shim.Success(nil)
+}
+
+// deleteProductRecords removes the pending transfer and the sensor readings
+// of puid, which are stored under their own composite keys
+func deleteProductRecords(stub shim.ChaincodeStubInterface, puid string) error {
+	pendingKey, err := stub.CreateCompositeKey("pendingTransfer~puid", []string{puid})
+	if err != nil {
+		return err
+	}
+	err = stub.DelState(pendingKey)
+	if err != nil {
+		return err
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("puid~sensor~timestamp", []string{puid})
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+
+	readingKeys := []string{}
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		readingKeys = append(readingKeys, responseRange.Key)
+	}
+	for _, readingKey := range readingKeys {
+		err = stub.DelState(readingKey)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ==================================================================
+// archiveProduct - soft-delete a product. The record stays in state with
+// Archived set and its index entries move under archivedIndexPrefix, so
+// enumeration and rich queries skip it unless asked to include archived
+// products. getHistoryForProduct still returns every version, archived or not.
+// ==================================================================
+func (t *SimpleChaincode) archiveProduct(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return setProductArchived(stub, args, true)
+}
+
+// ==================================================================
+// unarchiveProduct - undo archiveProduct, restoring the active index entries
+// ==================================================================
+func (t *SimpleChaincode) unarchiveProduct(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return setProductArchived(stub, args, false)
+}
+
+// setProductArchived implements archiveProduct and unarchiveProduct
+func setProductArchived(stub shim.ChaincodeStubInterface, args []string, archived bool) pb.Response {
+
+	//   0         1 (optional)
+	// "puid", "expectedVersion"
+	if len(args) != 1 && len(args) != 2 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 1 or 2"))
+	}
+	puid := args[0]
+	fmt.Println("- start setProductArchived ", puid, archived)
+
+	productAsBytes, err := stub.GetState(productKey(stub, puid))
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to get product:%s", err))
+	} else if productAsBytes == nil {
+		return errorResponse(puid, notFoundError("Product does not exist: %s", puid))
+	}
+
+	oldProduct := product{}
+	err = json.Unmarshal(productAsBytes, &oldProduct)
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to decode JSON of: %s", puid))
+	}
+	if oldProduct.Archived == archived {
+		if archived {
+			return errorResponse(puid, conflictError("Product is already archived: %s", puid))
+		}
+		return errorResponse(puid, conflictError("Product is not archived: %s", puid))
+	}
+	err = checkVersion(&oldProduct, args, 1)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = assertOwnerOrRegulator(stub, oldProduct.Owner)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	newProduct := oldProduct
+	newProduct.Archived = archived
+	markModified(&newProduct, txTimestamp.Seconds)
+
+	productJSONasBytes, err := marshalProduct(&newProduct)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = stub.PutState(productKey(stub, puid), productJSONasBytes)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	// every index key changes namespace, so this moves all of them
+	err = updateProductIndexes(stub, &oldProduct, &newProduct)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	fmt.Println("- end setProductArchived (success)")
+	return shim.Success(productJSONasBytes)
+}
+
+// ===========================================================================
+// updateProduct - change the name and/or type of a product, keeping the
+// type~name~puid index consistent. An empty argument leaves that field unchanged.
+// Only the owner (or a regulator) may update a product.
+// ===========================================================================
+func (t *SimpleChaincode) updateProduct(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0        1            2            3 (optional)
+	// "puid", "newPname", "newPtype", "expectedVersion"
+	if len(args) != 3 && len(args) != 4 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 3 or 4"))
+	}
+
+	puid := args[0]
+	newPname := strings.ToLower(args[1])
+	newPtype := strings.ToLower(args[2])
+	fmt.Println("- start product update ", puid, newPname, newPtype)
+
+	productAsBytes, err := stub.GetState(productKey(stub, puid))
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to get product:%s", err))
+	} else if productAsBytes == nil {
+		return errorResponse(puid, notFoundError("Product does not exist"))
+	}
+
+	productToUpdate := product{}
+	err = json.Unmarshal(productAsBytes, &productToUpdate) //unmarshal it aka JSON.parse()
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = checkVersion(&productToUpdate, args, 3)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = assertOwnerOrRegulator(stub, productToUpdate.Owner)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	oldProduct := productToUpdate
+	if len(newPname) > 0 {
+		productToUpdate.Pname = newPname
+		productToUpdate.DisplayName = args[1]
+	}
+	if len(newPtype) > 0 {
+		productToUpdate.Ptype = newPtype
+	}
+	err = assertUniqueTypeName(stub, productToUpdate.Ptype, productToUpdate.Pname, puid)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	markModified(&productToUpdate, txTimestamp.Seconds)
+
+	productJSONasBytes, err := marshalProduct(&productToUpdate)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = stub.PutState(productKey(stub, puid), productJSONasBytes) //rewrite the product
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	// maintain the indexes; only entries whose components changed are rewritten
+	err = updateProductIndexes(stub, &oldProduct, &productToUpdate)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	// ==== Notify subscribers of what changed ====
+	changed, err := productDiff(&oldProduct, &productToUpdate)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	eventJSONasBytes, err := json.Marshal(updateEvent{puid, stub.GetTxID(), changed})
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = stub.SetEvent(productUpdatedEvent, eventJSONasBytes)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	fmt.Println("- end of product update (success)")
+	return shim.Success(productJSONasBytes)
+}
+
+// ===========================================================================
+// productDiff compares two versions of a product field by field, on their JSON
+// encoding, and returns a fieldChange for every field whose value differs,
+// keyed by its JSON name. Bookkeeping fields such as version and updatedAt are
+// included, as consumers may cache them too.
+// ===========================================================================
+func productDiff(before *product, after *product) (map[string]fieldChange, error) {
+	var beforeFields, afterFields map[string]json.RawMessage
+	for _, entry := range []struct {
+		product *product
+		fields  *map[string]json.RawMessage
+	}{{before, &beforeFields}, {after, &afterFields}} {
+		productAsBytes, err := json.Marshal(entry.product)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(productAsBytes, entry.fields)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	changed := make(map[string]fieldChange)
+	for field, from := range beforeFields {
+		if to, ok := afterFields[field]; !ok || !bytes.Equal(from, to) {
+			changed[field] = fieldChange{from, afterFields[field]}
+		}
+	}
+	for field, to := range afterFields {
+		if _, ok := beforeFields[field]; !ok {
+			changed[field] = fieldChange{nil, to}
+		}
+	}
+	return changed, nil
+}
+
+// ===========================================================================
+// checkVersion compares a product's Version with the expected version passed
+// at args[pos]. A missing or empty argument skips the check.
+// ===========================================================================
+func checkVersion(product *product, args []string, pos int) error {
+	if len(args) <= pos || len(args[pos]) == 0 {
+		return nil
+	}
+	expectedVersion, err := strconv.Atoi(args[pos])
+	if err != nil {
+		return validationError("Expected version must be a numeric string")
+	}
+	if expectedVersion != product.Version {
+		return conflictError("Version mismatch for %s: expected %d, current %d", product.Puid, expectedVersion, product.Version)
+	}
+	return nil
+}
+
+// transferBlockedStatuses are the lifecycle stages in which a product may not
+// change hands
+var transferBlockedStatuses = []string{statusRecalled}
+
+// assertTransferable rejects a transfer of a product whose Status is listed in
+// transferBlockedStatuses, or which is archived, co-owned or in escrow
+func assertTransferable(product *product) error {
+	err := assertShareTransferable(product)
+	if err != nil {
+		return err
+	}
+	if len(product.Owners) > 1 {
+		return conflictError("Product %s is co-owned, use transferShare to move ownership", product.Puid)
+	}
+	return nil
+}
+
+// assertShareTransferable is assertTransferable for transferShare, which is how
+// co-owned products change hands: it rejects products in a blocked status,
+// archived or in escrow
+func assertShareTransferable(product *product) error {
+	for _, blocked := range transferBlockedStatuses {
+		if product.Status == blocked {
+			return conflictError("Product %s cannot be transferred while its status is %s", product.Puid, product.Status)
+		}
+	}
+	if product.Archived {
+		return conflictError("Product %s cannot be transferred while it is archived", product.Puid)
+	}
+	if product.Escrow != nil {
+		return conflictError("Product %s is in escrow with %s, only releaseEscrow or cancelEscrow can move it", product.Puid, product.Escrow.Agent)
+	}
+	return nil
+}
+
+// assertNotOwner rejects a transfer of a product to the owner it already has,
+// which would only add a no-op entry to its history. Owners are identities and
+// are compared exactly: ids differing only in case are different owners.
+func assertNotOwner(product *product, newOwner string) error {
+	if newOwner == product.Owner {
+		return conflictError("Product %s is already owned by %s", product.Puid, product.Owner)
+	}
+	return nil
+}
+
+// defaultTransferCooldownSeconds is the least time between two transfers of the
+// same product unless configured otherwise, to slow down laundering a product's
+// provenance through a chain of quick hand-offs
+const defaultTransferCooldownSeconds = 60
+
+// assertCooledDown rejects a transfer of a product less than the configured
+// TransferCooldownSeconds after its previous one, reporting how long is left
+func assertCooledDown(stub shim.ChaincodeStubInterface, product *product, txTimestamp int64) error {
+	if product.LastTransferAt == 0 {
+		return nil
+	}
+	config, err := loadConfig(stub)
+	if err != nil {
+		return err
+	}
+	elapsed := txTimestamp - product.LastTransferAt
+	if elapsed < config.TransferCooldownSeconds {
+		return conflictError("Product %s was transferred %ds ago, it can be transferred again in %ds", product.Puid, elapsed, config.TransferCooldownSeconds-elapsed)
+	}
+	return nil
+}
+
+// maxProductRecordBytes is the largest product record the write paths store.
+// Fabric keeps every value in blocks and gRPC messages whose size limits are
+// set per network, so a record growing past them through Metadata or a long
+// OwnerHistory would fail at commit with a low-level error; this rejects it
+// before PutState instead.
+const maxProductRecordBytes = 1 << 20
+
+// marshalProduct encodes a product for PutState and rejects records larger
+// than maxProductRecordBytes
+func marshalProduct(p *product) ([]byte, error) {
+	productJSONasBytes, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	if len(productJSONasBytes) > maxProductRecordBytes {
+		return nil, validationError("Product record too large: %s would be %d bytes, at most %d allowed", p.Puid, len(productJSONasBytes), maxProductRecordBytes)
+	}
+	return productJSONasBytes, nil
+}
+
+// submitterID returns the identity of the client that submitted the transaction,
+// or "" when none can be read (e.g. a mock stub without a creator), so that
+// recording it never fails the transaction
+func submitterID(stub shim.ChaincodeStubInterface) string {
+	callerID, err := cid.GetID(stub)
+	if err != nil {
+		return ""
+	}
+	return callerID
+}
+
+// markModified stamps a product with the mutation's transaction time and bumps its Version
+func markModified(product *product, txTimestamp int64) {
+	product.UpdatedAt = txTimestamp
+	product.Version++
+}
+
+// ===========================================================================
+// moveProductToOwner checks the product may be transferred and that newOwner
+// is not its owner already and is registered when strict owners mode is on,
+// and that the transfer cooldown has passed since its last transfer,
+// changes its owner, records the previous owner in OwnerHistory, stamps
+// LastModifiedBy with the submitting identity, rewrites the product and moves
+// its owner~puid index entry. A product priced above highValueThreshold also
+// gets a policy requiring the submitter's org and newOwnerMSP to endorse its
+// later changes, see requireCoEndorsement, and is refused without newOwnerMSP.
+// ===========================================================================
+func moveProductToOwner(stub shim.ChaincodeStubInterface, productToTransfer *product, newOwner string, newOwnerMSP string, txTimestamp int64) error {
+	err := assertTransferable(productToTransfer)
+	if err != nil {
+		return err
+	}
+	err = assertNotOwner(productToTransfer, newOwner)
+	if err != nil {
+		return err
+	}
+	err = assertRegisteredOwner(stub, newOwner)
+	if err != nil {
+		return err
+	}
+	err = assertCooledDown(stub, productToTransfer, txTimestamp)
+	if err != nil {
+		return err
+	}
+	err = reassignOwner(stub, productToTransfer, newOwner, txTimestamp)
+	if err != nil {
+		return err
+	}
+	return requireCoEndorsement(stub, productToTransfer, newOwnerMSP)
+}
+
+// reassignOwner is the write half of moveProductToOwner, without its checks.
+// The escrow handlers use it directly, as the escrow holding owner is not a
+// real owner and the end of an escrow completes a transfer already checked.
+func reassignOwner(stub shim.ChaincodeStubInterface, productToTransfer *product, newOwner string, txTimestamp int64) error {
+	oldProduct := *productToTransfer
+	previousOwner := productToTransfer.Owner
+	if productToTransfer.OwnerHistory == nil { //record predates OwnerHistory
+		productToTransfer.OwnerHistory = []string{}
+	}
+	productToTransfer.OwnerHistory = append(productToTransfer.OwnerHistory, previousOwner)
+	productToTransfer.Owner = newOwner //change the owner
+	productToTransfer.Owners = nil     //a single owner again
+	productToTransfer.LastModifiedBy = submitterID(stub)
+	productToTransfer.LastTransferAt = txTimestamp
+	markModified(productToTransfer, txTimestamp)
+
+	productJSONasBytes, err := marshalProduct(productToTransfer)
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(productKey(stub, productToTransfer.Puid), productJSONasBytes) //rewrite the product
+	if err != nil {
+		return err
+	}
+
+	// ==== Move the product to the new owner in the indexes ====
+	return updateProductIndexes(stub, &oldProduct, productToTransfer)
+}
+
+// shareTolerance absorbs floating point error when checking that shares sum to 100
+const shareTolerance = 1e-9
+
+// ownershipShares returns a product's ownership percentages, treating a
+// single-owner record as its Owner holding 100%
+func ownershipShares(product *product) map[string]float64 {
+	shares := make(map[string]float64)
+	if len(product.Owners) == 0 {
+		shares[product.Owner] = 100
+		return shares
+	}
+	for owner, share := range product.Owners {
+		shares[owner] = share
+	}
+	return shares
+}
+
+// majorityOwner returns the owner with the largest share; ties go to the
+// lexicographically smallest owner so every endorser picks the same one
+func majorityOwner(shares map[string]float64) string {
+	owner := ""
+	for candidate, share := range shares {
+		if owner == "" || share > shares[owner] || (share == shares[owner] && candidate < owner) {
+			owner = candidate
+		}
+	}
+	return owner
+}
+
+// ===========================================================================
+// transferShare - move a percentage of a product's ownership from one
+// co-owner to another. Only the giving co-owner (or a regulator) may do so.
+// Shares that drop to zero are removed, and a product left with one owner
+// becomes a single-owner record again. Owner follows the largest share, and
+// when it changes the previous one is recorded in OwnerHistory and, as for
+// transferProduct, a product priced above highValueThreshold gets a policy
+// requiring the new owner's org, see requireCoEndorsement. Products that may
+// not change hands, see assertShareTransferable, or that have a pending
+// transfer are refused.
+// ===========================================================================
+func (t *SimpleChaincode) transferShare(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0         1            2          3          4 (optional)       5 (optional)
+	// "puid", "fromOwner", "toOwner", "percent", "expectedVersion", "newOwnerMSP"
+	// newOwnerMSP is the MSP ID of the org of the owner with the largest share
+	// afterwards, required when that owner changes on a high-value product.
+	if len(args) < 4 || len(args) > 6 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 4 to 6"))
+	}
+
+	puid := args[0]
+	fromOwner := args[1]
+	toOwner := args[2]
+	if len(fromOwner) <= 0 || len(toOwner) <= 0 {
+		return errorResponse(puid, validationError("Owners must be non-empty strings"))
+	}
+	if fromOwner == toOwner {
+		return errorResponse(puid, validationError("Cannot transfer a share to the same owner"))
+	}
+	percent, err := strconv.ParseFloat(args[3], 64)
+	if err != nil || math.IsNaN(percent) || math.IsInf(percent, 0) || percent <= 0 || percent > 100 {
+		return errorResponse(puid, validationError("4th argument must be a percentage greater than 0 and at most 100"))
+	}
+	fmt.Println("- start transferShare ", puid, fromOwner, toOwner, percent)
+
+	productAsBytes, err := stub.GetState(productKey(stub, puid))
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to get product:%s", err))
+	} else if productAsBytes == nil {
+		return errorResponse(puid, notFoundError("Product does not exist: %s", puid))
+	}
+	oldProduct := product{}
+	err = decodeProduct(puid, productAsBytes, &oldProduct)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = checkVersion(&oldProduct, args, 4)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = assertOwnerOrRegulator(stub, fromOwner)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = assertShareTransferable(&oldProduct)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = assertRegisteredOwner(stub, toOwner)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	_, _, err = getPendingTransfer(stub, puid)
+	if err == nil {
+		return errorResponse(puid, conflictError("Product %s has a pending transfer, it must be accepted or cancelled first", puid))
+	} else if errorCode(err) != codeNotFound {
+		return errorResponse(puid, err)
+	}
+
+	// ==== Move the share, the owner list is only valid if it still sums to 100 ====
+	shares := ownershipShares(&oldProduct)
+	if shares[fromOwner] < percent-shareTolerance {
+		return errorResponse(puid, conflictError("%s owns %g%% of %s, cannot transfer %g%%", fromOwner, shares[fromOwner], puid, percent))
+	}
+	shares[fromOwner] -= percent
+	shares[toOwner] += percent
+	total := 0.0
+	for owner, share := range shares {
+		if share < -shareTolerance {
+			return errorResponse(puid, conflictError("Share of %s would become negative", owner))
+		}
+		if share <= shareTolerance {
+			delete(shares, owner)
+			continue
+		}
+		total += share
+	}
+	if math.Abs(total-100) > shareTolerance {
+		return errorResponse(puid, conflictError("Shares of %s would sum to %g%%, not 100%%", puid, total))
+	}
+
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	newProduct := oldProduct
+	newProduct.Owners = shares
+	if len(shares) == 1 {
+		newProduct.Owners = nil
+	}
+	newProduct.Owner = majorityOwner(shares)
+	if newProduct.Owner != oldProduct.Owner {
+		err = assertCooledDown(stub, &oldProduct, txTimestamp.Seconds)
+		if err != nil {
+			return errorResponse(puid, err)
+		}
+		newProduct.OwnerHistory = append(append([]string{}, oldProduct.OwnerHistory...), oldProduct.Owner)
+		newProduct.LastTransferAt = txTimestamp.Seconds
+		newOwnerMSP := ""
+		if len(args) > 5 {
+			newOwnerMSP = args[5]
+		}
+		err = requireCoEndorsement(stub, &newProduct, newOwnerMSP)
+		if err != nil {
+			return errorResponse(puid, err)
+		}
+	}
+	newProduct.LastModifiedBy = submitterID(stub)
+	markModified(&newProduct, txTimestamp.Seconds)
+
+	productJSONasBytes, err := marshalProduct(&newProduct)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = stub.PutState(productKey(stub, puid), productJSONasBytes)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = updateProductIndexes(stub, &oldProduct, &newProduct)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	fmt.Println("- end transferShare (success)")
+	return shim.Success(productJSONasBytes)
+}
+
+// ==== Example: GetStateByPartialCompositeKey/RangeQuery =========================================
+// transferProductsByOwner moves every product held by one owner to another, e.g. after an
+// acquisition. Uses a GetStateByPartialCompositeKey (range query) against the owner~puid 'index'.
+// Committing peers will re-execute range queries to guarantee that result sets are stable
+// between endorsement time and commit time, so this is safe to use in an update transaction.
+// ===========================================================================================
+func (t *SimpleChaincode) transferProductsByOwner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0           1           2 (optional)
+	// "oldOwner", "newOwner", "newOwnerMSP"
+	// newOwnerMSP is required when any of the products is priced above
+	// highValueThreshold, see requireCoEndorsement.
+	if len(args) != 2 && len(args) != 3 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 2 or 3"))
+	}
+
+	oldOwner := args[0]
+	newOwner := args[1]
+	if oldOwner == newOwner {
+		return errorResponse("", validationError("Old and new owner are the same: %s", oldOwner))
+	}
+	newOwnerMSP := ""
+	if len(args) > 2 {
+		newOwnerMSP = args[2]
+	}
+	fmt.Println("- start transferProductsByOwner ", oldOwner, newOwner)
+
+	// ==== Only the current owner (or a regulator) may transfer ====
+	err := assertOwnerOrRegulator(stub, oldOwner)
+	if err != nil {
+		return errorResponse("", err)
+	}
+
+	puids, err := getPuidsByOwner(stub, oldOwner)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	if len(puids) == 0 {
+		return errorResponse("", notFoundError("No products found for owner: %s", oldOwner))
+	}
+
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return errorResponse("", err)
+	}
+
+	for _, puid := range puids {
+		productAsBytes, err := stub.GetState(productKey(stub, puid))
+		if err != nil {
+			return errorResponse(puid, fmt.Errorf("Failed to get product:%s", err))
+		} else if productAsBytes == nil {
+			return errorResponse(puid, notFoundError("Product does not exist: %s", puid))
+		}
+
+		productToTransfer := product{}
+		err = json.Unmarshal(productAsBytes, &productToTransfer) //unmarshal it aka JSON.parse()
+		if err != nil {
+			return errorResponse(puid, err)
+		}
+
+		err = moveProductToOwner(stub, &productToTransfer, newOwner, newOwnerMSP, txTimestamp.Seconds)
+		if err != nil {
+			return errorResponse(puid, &codedError{errorCode(err), fmt.Sprintf("Transfer failed for %s: %s", puid, err)})
+		}
+	}
+
+	// ==== One summary event for the whole transaction ====
+	eventJSONasBytes, err := json.Marshal(bulkTransferEvent{oldOwner, newOwner, len(puids), txTimestamp.Seconds})
+	if err != nil {
+		return errorResponse("", err)
+	}
+	err = stub.SetEvent(productsBulkTransferredEvent, eventJSONasBytes)
+	if err != nil {
+		return errorResponse("", err)
+	}
+
+	responsePayload := fmt.Sprintf("Transferred %d products from %s to %s", len(puids), oldOwner, newOwner)
+	fmt.Println("- end transferProductsByOwner: " + responsePayload)
+	return shim.Success([]byte(responsePayload))
+}
+
+// maxBatchTransfers caps the number of products transferProductsBatch moves in one transaction
+const maxBatchTransfers = 100
+
+// ===========================================================================
+// transferProductsBatch - move many products to different owners in one
+// transaction, from a JSON object mapping puid to new owner. The caller must
+// own each product (or be a regulator), unless it is an admin: a member of
+// adminMSPID carrying adminRole, who may override ownership, e.g. to move the
+// products of an identity that was revoked. Every transfer
+// is checked before anything is written and the transaction fails as a whole
+// if any is rejected, naming each rejected puid and why, so either all of the
+// products move or none do. Products priced above highValueThreshold need the
+// new owner's MSP and so must go through transferProduct. One
+// ProductsBatchTransferred event lists all of the transfers, and the response
+// maps each puid to its transfer.
+// ===========================================================================
+func (t *SimpleChaincode) transferProductsBatch(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "{\"p1\":\"bob\",\"p2\":\"carol\", ...}"
+	if len(args) != 1 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 1"))
+	}
+
+	var newOwners map[string]string
+	err := json.Unmarshal([]byte(args[0]), &newOwners)
+	if err != nil {
+		return errorResponse("", validationError("1st argument must be a JSON object mapping puid to new owner: %s", err))
+	}
+	if len(newOwners) == 0 {
+		return errorResponse("", validationError("1st argument must contain at least one transfer"))
+	}
+	if len(newOwners) > maxBatchTransfers {
+		return errorResponse("", validationError("At most %d transfers are allowed in one batch, got %d", maxBatchTransfers, len(newOwners)))
+	}
+	// every endorser must write and report the transfers in the same order
+	puids := make([]string, 0, len(newOwners))
+	for puid := range newOwners {
+		puids = append(puids, puid)
+	}
+	sort.Strings(puids)
+	fmt.Println("- start transferProductsBatch ", len(puids))
+
+	admin := assertAdmin(stub) == nil && assertRole(stub, adminRole) == nil
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return errorResponse("", err)
+	}
+
+	// ==== Check every transfer before any write ====
+	products := make([]product, len(puids))
+	var rejected []string
+	var firstErr error
+	for i, puid := range puids {
+		err := checkBatchTransfer(stub, puid, newOwners[puid], admin, txTimestamp.Seconds, &products[i])
+		if err != nil {
+			rejected = append(rejected, puid+": "+err.Error())
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if len(rejected) > 0 {
+		message := fmt.Sprintf("%d of %d transfers rejected, nothing was transferred: %s", len(rejected), len(puids), strings.Join(rejected, "; "))
+		return errorResponse("", &codedError{errorCode(firstErr), message})
+	}
+
+	// ==== Apply them ====
+	transfers := []batchTransfer{}
+	results := map[string]batchTransfer{}
+	for i, puid := range puids {
+		previousOwner := products[i].Owner
+		err = moveProductToOwner(stub, &products[i], newOwners[puid], "", txTimestamp.Seconds) //high-value products were rejected above
+		if err != nil {
+			return errorResponse(puid, err)
+		}
+		transfer := batchTransfer{puid, previousOwner, products[i].Owner, products[i].Version}
+		transfers = append(transfers, transfer)
+		results[puid] = transfer
+	}
+
+	// ==== One summary event for the whole transaction ====
+	eventJSONasBytes, err := json.Marshal(batchTransferEvent{transfers, txTimestamp.Seconds, stub.GetTxID()})
+	if err != nil {
+		return errorResponse("", err)
+	}
+	err = stub.SetEvent(productsBatchTransferredEvent, eventJSONasBytes)
+	if err != nil {
+		return errorResponse("", err)
+	}
+
+	resultsJSONasBytes, err := json.Marshal(results)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	fmt.Println("- end transferProductsBatch ", len(transfers))
+	return shim.Success(resultsJSONasBytes)
+}
+
+// checkBatchTransfer reads puid into productToTransfer and checks that
+// transferProductsBatch may move it to newOwner, with the same checks as
+// moveProductToOwner plus the caller's ownership, which admins skip
+func checkBatchTransfer(stub shim.ChaincodeStubInterface, puid string, newOwner string, admin bool, txTimestamp int64, productToTransfer *product) error {
+	if len(newOwner) <= 0 {
+		return validationError("New owner must be a non-empty string")
+	}
+	productAsBytes, err := stub.GetState(productKey(stub, puid))
+	if err != nil {
+		return fmt.Errorf("Failed to get product:%s", err)
+	} else if productAsBytes == nil {
+		return notFoundError("Product does not exist")
+	}
+	err = decodeProduct(puid, productAsBytes, productToTransfer)
+	if err != nil {
+		return err
+	}
+	if !admin {
+		err = assertOwnerOrRegulator(stub, productToTransfer.Owner)
+		if err != nil {
+			return err
+		}
+	}
+	if productToTransfer.Price > highValueThreshold {
+		return validationError("Product is priced above %d and needs the new owner's MSP, use transferProduct", highValueThreshold)
+	}
+	err = assertTransferable(productToTransfer)
+	if err != nil {
+		return err
+	}
+	err = assertNotOwner(productToTransfer, newOwner)
+	if err != nil {
+		return err
+	}
+	err = assertRegisteredOwner(stub, newOwner)
+	if err != nil {
+		return err
+	}
+	return assertCooledDown(stub, productToTransfer, txTimestamp)
+}
+
+// ===========================================================================
+// getPuidsByOwner lists the puids in the owner~puid index for an owner. The
+// iterator is fully drained and closed before returning, so callers may
+// modify the index afterwards.
+// ===========================================================================
+func getPuidsByOwner(stub shim.ChaincodeStubInterface, owner string) ([]string, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("owner~puid", []string{owner})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	puids := []string{}
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return nil, err
+		}
+		puids = append(puids, compositeKeyParts[1])
+	}
+	return puids, nil
+}
+
+// ===========================================================================
+// setProductEndorsement sets a key-level endorsement policy on a product so
+// that any later change to it must be endorsed by a peer of each given MSP.
+//
+// Key-level (state-based) endorsement is checked at validation time in place of
+// the chaincode-level policy from instantiation, but only for keys that carry
+// one: the write that sets the policy here is still endorsed under the
+// chaincode-level policy, and index keys keep using it. The policy bytes are a
+// serialized SignaturePolicyEnvelope built by the statebased helper, which
+// requires a signature from a PEER role principal of every listed org.
+// ===========================================================================
+func setProductEndorsement(stub shim.ChaincodeStubInterface, puid string, mspids ...string) error {
+	endorsementPolicy, err := statebased.NewStateEP(nil)
+	if err != nil {
+		return err
+	}
+	err = endorsementPolicy.AddOrgs(statebased.RoleTypePeer, mspids...)
+	if err != nil {
+		return err
+	}
+	policyBytes, err := endorsementPolicy.Policy()
+	if err != nil {
+		return err
+	}
+	return stub.SetStateValidationParameter(productKey(stub, puid), policyBytes)
+}
+
+// highValueThreshold is the Price, in the product's own Currency, above which
+// a product changing hands must afterwards be co-endorsed by both parties
+const highValueThreshold = 10000
+
+// ===========================================================================
+// requireCoEndorsement sets the key-level endorsement policy of a product whose
+// Price is above highValueThreshold to require a peer of the submitter's MSP and
+// a peer of counterpartyMSP, the other side of the sale or transfer. Fabric
+// checks a key's policy when validating the transactions that write the key
+// after the policy was committed, so this transaction itself is endorsed as
+// usual and every later change, including the next transfer, needs both orgs.
+// The policy bytes are built as described at setProductEndorsement; the
+// current policy can be read with getProductEndorsement. Products at or below
+// the threshold keep their policy.
+// ===========================================================================
+func requireCoEndorsement(stub shim.ChaincodeStubInterface, product *product, counterpartyMSP string) error {
+	if product.Price <= highValueThreshold {
+		return nil
+	}
+	if len(counterpartyMSP) <= 0 {
+		return validationError("Product %s is priced at %g %s, above %d, the MSP ID of the new owner's org is required", product.Puid, product.Price, product.Currency, highValueThreshold)
+	}
+	submitterMSP, err := cid.GetMSPID(stub)
+	if err != nil {
+		return fmt.Errorf("Failed to get caller MSP: %s", err)
+	}
+	if submitterMSP == counterpartyMSP {
+		return setProductEndorsement(stub, product.Puid, submitterMSP)
+	}
+	return setProductEndorsement(stub, product.Puid, submitterMSP, counterpartyMSP)
+}
+
+// ===========================================================================
+// getProductEndorsement - list the orgs in a product's key-level endorsement
+// policy. An empty list means the chaincode-level policy applies.
+// ===========================================================================
+func (t *SimpleChaincode) getProductEndorsement(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "puid"
+	if len(args) != 1 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 1"))
+	}
+
+	puid := args[0]
+	policyBytes, err := stub.GetStateValidationParameter(productKey(stub, puid))
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to get endorsement policy: %s", err))
+	}
+
+	orgs := []string{}
+	if len(policyBytes) > 0 {
+		endorsementPolicy, err := statebased.NewStateEP(policyBytes)
+		if err != nil {
+			return errorResponse(puid, err)
+		}
+		orgs = endorsementPolicy.ListOrgs()
+	}
+
+	responseJSONasBytes, err := json.Marshal(struct {
+		Puid string   `json:"puid"`
+		Orgs []string `json:"orgs"`
+	}{puid, orgs})
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	return shim.Success(responseJSONasBytes)
+}
+
+// ===========================================================================
+// assertRole checks that the submitting identity's certificate carries the
+// role attribute with the given value
+// ===========================================================================
+func assertRole(stub shim.ChaincodeStubInterface, role string) error {
+	value, found, err := cid.GetAttributeValue(stub, roleAttribute)
+	if err != nil {
+		return fmt.Errorf("Failed to get caller attributes: %s", err)
+	}
+	if !found {
+		return forbiddenError("Caller certificate has no %s attribute, %s required", roleAttribute, role)
+	}
+	if value != role {
+		return forbiddenError("Caller %s is %s, %s required", roleAttribute, value, role)
+	}
+	return nil
+}
+
+// ===========================================================================
+// assertAdmin checks that the submitting identity belongs to adminMSPID
+// ===========================================================================
+func assertAdmin(stub shim.ChaincodeStubInterface) error {
+	mspid, err := cid.GetMSPID(stub)
+	if err != nil {
+		return fmt.Errorf("Failed to get caller MSP: %s", err)
+	}
+	if mspid != adminMSPID {
+		return forbiddenError("Caller MSP %s is not allowed to perform this operation", mspid)
+	}
+	return nil
+}
+
+// ===========================================================================
+// errorResponse wraps a failure in the JSON envelope
+// {"code": "...", "message": "...", "error": "...", "puid": "..."} so clients can
+// parse errors uniformly and branch on the code, see errorCode. error repeats the
+// message for clients written against the envelope before codes were added. puid
+// is omitted when it doesn't apply.
+// ===========================================================================
+func errorResponse(puid string, err error) pb.Response {
+	errJSONasBytes, _ := json.Marshal(struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+		Error   string `json:"error"`
+		Puid    string `json:"puid,omitempty"`
+	}{errorCode(err), err.Error(), err.Error(), puid})
+	return shim.Error(string(errJSONasBytes))
+}
+
+// statusErrorResponse is errorResponse with pb.Response.Status set to the HTTP
+// status matching the error code, see httpStatusByCode, instead of the 500 of
+// shim.Error, for clients that map chaincode responses to HTTP. Every status
+// from shim.ERRORTHRESHOLD (400) up is an error to the peer, so the transaction
+// fails the same way and only the status differs.
+func statusErrorResponse(puid string, err error) pb.Response {
+	response := errorResponse(puid, err)
+	if status, ok := httpStatusByCode[errorCode(err)]; ok {
+		response.Status = status
+	}
+	return response
+}
+
+// httpStatusByCode maps error codes to HTTP statuses; codes not listed keep 500
+var httpStatusByCode = map[string]int32{
+	codeNotFound:      404,
+	codeAlreadyExists: 409,
+	codeValidation:    400,
+	codeForbidden:     403,
+	codeConflict:      409,
+}
+
+// Error codes reported in the code field of errorResponse
+const (
+	codeNotFound      = "NOT_FOUND"
+	codeAlreadyExists = "ALREADY_EXISTS"
+	codeValidation    = "VALIDATION"
+	codeForbidden     = "FORBIDDEN"
+	codeConflict      = "CONFLICT" //the request is valid but the current state doesn't allow it
+	codeInternal      = "INTERNAL"
+	codeCorruptRecord = "CORRUPT_RECORD" //a stored record can't be decoded
+)
+
+// codedError is an error that carries one of the error codes
+type codedError struct {
+	code    string
+	message string
+}
+
+func (e *codedError) Error() string {
+	return e.message
+}
+
+// notFoundError reports a product or record that does not exist
+func notFoundError(format string, a ...interface{}) error {
+	return &codedError{codeNotFound, fmt.Sprintf(format, a...)}
+}
+
+// alreadyExistsError reports a record that would be created twice
+func alreadyExistsError(format string, a ...interface{}) error {
+	return &codedError{codeAlreadyExists, fmt.Sprintf(format, a...)}
+}
+
+// validationError reports bad arguments
+func validationError(format string, a ...interface{}) error {
+	return &codedError{codeValidation, fmt.Sprintf(format, a...)}
+}
+
+// forbiddenError reports a caller that may not perform the operation
+func forbiddenError(format string, a ...interface{}) error {
+	return &codedError{codeForbidden, fmt.Sprintf(format, a...)}
+}
+
+// conflictError reports an operation the product's current state rules out,
+// such as a stale expected version or a transfer of a recalled product
+func conflictError(format string, a ...interface{}) error {
+	return &codedError{codeConflict, fmt.Sprintf(format, a...)}
+}
+
+// ===========================================================================
+// decodeProduct unmarshals the stored record of puid into p. A record that is
+// not valid UTF-8 or not a JSON product fails with a CORRUPT_RECORD error
+// naming the puid, unlike a missing product, which GetState reports as nil.
+// ===========================================================================
+func decodeProduct(puid string, productAsBytes []byte, p *product) error {
+	if !utf8.Valid(productAsBytes) {
+		return &codedError{codeCorruptRecord, fmt.Sprintf("Stored record of %s is not valid UTF-8, it may be corrupt", puid)}
+	}
+	err := json.Unmarshal(productAsBytes, p) //unmarshal it aka JSON.parse()
+	if err != nil {
+		return &codedError{codeCorruptRecord, fmt.Sprintf("Stored record of %s is not a valid product, it may be corrupt: %s", puid, err)}
+	}
+	return nil
+}
+
+// errorCode returns the code of err, or codeInternal for errors that carry none,
+// such as those of the shim or of JSON decoding
+func errorCode(err error) string {
+	if coded, ok := err.(*codedError); ok {
+		return coded.code
+	}
+	return codeInternal
+}
+
+// ===========================================================================
+// assertOwnerOrRegulator checks that the submitting identity owns the product,
+// unless the caller carries the regulator role attribute in its certificate
+// ===========================================================================
+func assertOwnerOrRegulator(stub shim.ChaincodeStubInterface, owner string) error {
+	role, found, err := cid.GetAttributeValue(stub, roleAttribute)
+	if err != nil {
+		return fmt.Errorf("Failed to get caller attributes: %s", err)
+	}
+	if found && role == regulatorRole {
+		return nil
+	}
+
+	callerID, err := cid.GetID(stub)
+	if err != nil {
+		return fmt.Errorf("Failed to get caller identity: %s", err)
+	}
+	// identities are base64, so they are compared exactly
+	if callerID != owner {
+		return forbiddenError("Caller is not the owner of this product: %s", owner)
+	}
+	return nil
+}
+
+// ownerRegistryIndex keys the set of registered owner IDs, one empty-valued
+// composite key per owner, in the same way as the product indexes
+const ownerRegistryIndex = "registered~owner"
+
+// strictOwnersIndex keys the flag that turned owner registry checks on before
+// the configuration was stored under configKey, see chaincodeConfig. Strict
+// owners mode is opt-in and products keep accepting any owner until an admin
+// enables it with setStrictOwners or setConfig.
+const strictOwnersIndex = "config~strictOwners"
+
+// ===========================================================================
+// registerOwner - add owner IDs to the registry, admin only
+// ===========================================================================
+func (t *SimpleChaincode) registerOwner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0        1 ...
+	// "owner", "owner", ...
+	if len(args) < 1 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting at least 1"))
+	}
+	err := assertAdmin(stub)
+	if err != nil {
+		return errorResponse("", err)
+	}
+
+	value := []byte{0x00}
+	for _, arg := range args {
+		owner := arg
+		if len(owner) <= 0 {
+			return errorResponse("", validationError("Owners must be non-empty strings"))
+		}
+		ownerKey, err := stub.CreateCompositeKey(ownerRegistryIndex, []string{owner})
+		if err != nil {
+			return errorResponse("", err)
+		}
+		err = stub.PutState(ownerKey, value)
+		if err != nil {
+			return errorResponse("", err)
+		}
+	}
+	return shim.Success(nil)
+}
+
+// ===========================================================================
+// deregisterOwner - remove owner IDs from the registry, admin only. Products
+// already held by a removed owner are left alone, but in strict mode nothing
+// can be transferred to it any more.
+// ===========================================================================
+func (t *SimpleChaincode) deregisterOwner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0        1 ...
+	// "owner", "owner", ...
+	if len(args) < 1 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting at least 1"))
+	}
+	err := assertAdmin(stub)
+	if err != nil {
+		return errorResponse("", err)
+	}
+
+	for _, arg := range args {
+		ownerKey, err := stub.CreateCompositeKey(ownerRegistryIndex, []string{arg})
+		if err != nil {
+			return errorResponse("", err)
+		}
+		err = stub.DelState(ownerKey)
+		if err != nil {
+			return errorResponse("", err)
+		}
+	}
+	return shim.Success(nil)
+}
+
+// ===========================================================================
+// setStrictOwners - turn owner registry checks on or off, admin only
+// ===========================================================================
+func (t *SimpleChaincode) setStrictOwners(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "true"
+	if len(args) != 1 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 1"))
+	}
+	strict, err := strconv.ParseBool(args[0])
+	if err != nil {
+		return errorResponse("", validationError("1st argument must be true or false"))
+	}
+	err = assertAdmin(stub)
+	if err != nil {
+		return errorResponse("", err)
+	}
+
+	config, err := loadConfig(stub)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	config.StrictOwners = strict
+	err = saveConfig(stub, config)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	return shim.Success(nil)
+}
+
+// assertRegisteredOwner rejects an owner missing from the registry when strict
+// owners mode is enabled, and accepts any owner otherwise. Owners starting with
+// escrowOwnerPrefix are always rejected, as only escrowProduct may use them.
+func assertRegisteredOwner(stub shim.ChaincodeStubInterface, owner string) error {
+	if strings.HasPrefix(owner, escrowOwnerPrefix) {
+		return validationError("Owner %s is reserved for products in escrow", owner)
+	}
+	config, err := loadConfig(stub)
+	if err != nil {
+		return err
+	}
+	if !config.StrictOwners {
+		return nil
+	}
+
+	ownerKey, err := stub.CreateCompositeKey(ownerRegistryIndex, []string{owner})
+	if err != nil {
+		return err
+	}
+	registered, err := stub.GetState(ownerKey)
+	if err != nil {
+		return fmt.Errorf("Failed to get owner registration: %s", err)
+	}
+	if registered == nil {
+		return validationError("Owner %s is not registered", owner)
+	}
+	return nil
+}
+
+// ===========================================================================
+// getTotalWeightByOwner - sum the weights of the active products held by an
+// owner, found through the owner~puid index, converted to kilograms with
+// kilogramsPerUnit. Returns {"owner", "totalKg", "byUnit", "unweighed"}, where
+// byUnit sums the weights in the unit they were recorded in and unweighed
+// counts the products without a weight.
+// ===========================================================================
+func (t *SimpleChaincode) getTotalWeightByOwner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "owner"
+	if len(args) != 1 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 1"))
+	}
+
+	owner := args[0]
+	fmt.Println("- start getTotalWeightByOwner ", owner)
+
+	puids, err := getPuidsByOwner(stub, owner)
+	if err != nil {
+		return errorResponse("", err)
+	}
+
+	totalKg := 0.0
+	byUnit := make(map[string]float64)
+	unweighed := 0
+	for _, puid := range puids {
+		productAsBytes, err := stub.GetState(productKey(stub, puid))
+		if err != nil {
+			return errorResponse(puid, fmt.Errorf("Failed to get product:%s", err))
+		} else if productAsBytes == nil {
+			continue // index entry without a product, see reindexProducts
+		}
+		p := product{}
+		err = json.Unmarshal(productAsBytes, &p)
+		if err != nil {
+			return errorResponse(puid, fmt.Errorf("Failed to decode JSON of: %s", puid))
+		}
+		factor, ok := kilogramsPerUnit[p.Unit]
+		if !ok || p.Weight == 0 {
+			unweighed++
+			continue
+		}
+		totalKg += p.Weight * factor
+		byUnit[p.Unit] += p.Weight
+	}
+
+	responseJSONasBytes, err := json.Marshal(struct {
+		Owner     string             `json:"owner"`
+		TotalKg   float64            `json:"totalKg"`
+		ByUnit    map[string]float64 `json:"byUnit"`
+		Unweighed int                `json:"unweighed"`
+	}{owner, totalKg, byUnit, unweighed})
+	if err != nil {
+		return errorResponse("", err)
+	}
+	return shim.Success(responseJSONasBytes)
+}
+
+// ==== Example: GetStateByPartialCompositeKey/RangeQuery =========================================
+// getProductsByOwner returns every product held by the given owner.
+// Uses a GetStateByPartialCompositeKey (range query) against the owner~puid 'index'
+// and reads the full product record for each puid found. An owner with no products
+// gets an empty array.
+// Archived products are left out unless the optional includeArchived argument is true.
+// With a pageSize only that many index entries are read and resolved, and the result is
+// wrapped with the record count and the bookmark for the next page.
+// ===========================================================================================
+func (t *SimpleChaincode) getProductsByOwner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0        1                    2             3
+	// "owner", ["includeArchived"], ["pageSize"], ["bookmark"]
+	if len(args) < 1 || len(args) > 4 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 1 to 4"))
+	}
+
+	owner := args[0]
+	includeArchived, err := parseIncludeArchived(args, 1)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	fmt.Println("- start getProductsByOwner ", owner)
+
+	pageSize, bookmark, err := parsePagination(args, 2)
+	if err != nil {
+		return errorResponse("", err)
+	}
+
+	buffer, err := getProductsByIndexWithPagination(stub, "owner~puid", []string{owner}, includeArchived, pageSize, bookmark)
+	if err != nil {
+		return errorResponse("", err)
+	}
+
+	fmt.Printf("- getProductsByOwner queryResult:\n%s\n", buffer.String())
+
+	return shim.Success(buffer.Bytes())
+}
+
+// ==== Example: GetStateByPartialCompositeKey/RangeQuery =========================================
+// getProductsByType returns every product of the given type.
+// Uses a GetStateByPartialCompositeKey (range query) against the type~name~puid 'index'
+// and reads the full product record for each puid found.
+// Archived products are left out unless the optional includeArchived argument is true.
+// With a pageSize only that many index entries are read and resolved, and the result is
+// wrapped with the record count and the bookmark for the next page.
+// ===========================================================================================
+func (t *SimpleChaincode) getProductsByType(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0        1                    2             3
+	// "ptype", ["includeArchived"], ["pageSize"], ["bookmark"]
+	if len(args) < 1 || len(args) > 4 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 1 to 4"))
+	}
+
+	ptype := strings.ToLower(args[0])
+	includeArchived, err := parseIncludeArchived(args, 1)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	fmt.Println("- start getProductsByType ", ptype)
+
+	pageSize, bookmark, err := parsePagination(args, 2)
+	if err != nil {
+		return errorResponse("", err)
+	}
+
+	buffer, err := getProductsByIndexWithPagination(stub, "type~name~puid", []string{ptype}, includeArchived, pageSize, bookmark)
+	if err != nil {
+		return errorResponse("", err)
+	}
+
+	fmt.Printf("- getProductsByType queryResult:\n%s\n", buffer.String())
+
+	return shim.Success(buffer.Bytes())
+}
+
+// ==== Example: GetStateByPartialCompositeKey/RangeQuery =========================================
+// getProductsByStatus returns every product in the given lifecycle stage.
+// Uses a GetStateByPartialCompositeKey (range query) against the status~puid 'index'
+// and reads the full product record for each puid found. Records created before
+// Status existed are listed as manufactured. Products written before the index
+// existed are missing from it until reindexProducts is run.
+// Archived products are left out unless the optional includeArchived argument is true.
+// With a pageSize only that many index entries are read and resolved, and the result is
+// wrapped with the record count and the bookmark for the next page.
+// ===========================================================================================
+func (t *SimpleChaincode) getProductsByStatus(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0         1                    2             3
+	// "status", ["includeArchived"], ["pageSize"], ["bookmark"]
+	if len(args) < 1 || len(args) > 4 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 1 to 4"))
+	}
+
+	status := strings.ToLower(args[0])
+	if _, ok := statusTransitions[status]; !ok {
+		return errorResponse("", validationError("Unknown status: %s", status))
+	}
+	includeArchived, err := parseIncludeArchived(args, 1)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	fmt.Println("- start getProductsByStatus ", status)
+
+	pageSize, bookmark, err := parsePagination(args, 2)
+	if err != nil {
+		return errorResponse("", err)
+	}
+
+	buffer, err := getProductsByIndexWithPagination(stub, "status~puid", []string{status}, includeArchived, pageSize, bookmark)
+	if err != nil {
+		return errorResponse("", err)
+	}
+
+	fmt.Printf("- getProductsByStatus queryResult:\n%s\n", buffer.String())
+
+	return shim.Success(buffer.Bytes())
+}
+
+// ==== Example: GetStateByPartialCompositeKey/RangeQuery =========================================
+// getProductsByOwnerAndType returns every product of the given type held by the given owner.
+// Uses a GetStateByPartialCompositeKey (range query) on both leading components of the
+// owner~type~puid 'index' and reads the full product record for each puid found.
+// Archived products are left out unless the optional includeArchived argument is true.
+// With a pageSize only that many index entries are read and resolved, and the result is
+// wrapped with the record count and the bookmark for the next page.
+// ===========================================================================================
+func (t *SimpleChaincode) getProductsByOwnerAndType(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0        1        2                    3             4
+	// "owner", "ptype", ["includeArchived"], ["pageSize"], ["bookmark"]
+	if len(args) < 2 || len(args) > 5 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 2 to 5"))
+	}
+
+	owner := args[0]
+	ptype := strings.ToLower(args[1])
+	includeArchived, err := parseIncludeArchived(args, 2)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	fmt.Println("- start getProductsByOwnerAndType ", owner, ptype)
+
+	pageSize, bookmark, err := parsePagination(args, 3)
+	if err != nil {
+		return errorResponse("", err)
+	}
+
+	buffer, err := getProductsByIndexWithPagination(stub, "owner~type~puid", []string{owner, ptype}, includeArchived, pageSize, bookmark)
+	if err != nil {
+		return errorResponse("", err)
+	}
+
+	fmt.Printf("- getProductsByOwnerAndType queryResult:\n%s\n", buffer.String())
+
+	return shim.Success(buffer.Bytes())
+}
+
+// ==== Example: GetStateByPartialCompositeKey/RangeQuery =========================================
+// getProductsByBatch returns every product of a manufacturer's batch, e.g. to scope a recall.
+// Uses a GetStateByPartialCompositeKey (range query) against the mfr~batch~puid 'index'
+// and reads the full product record for each puid found.
+// Archived products are left out unless the optional includeArchived argument is true.
+// With a pageSize only that many index entries are read and resolved, and the result is
+// wrapped with the record count and the bookmark for the next page.
+// ===========================================================================================
+func (t *SimpleChaincode) getProductsByBatch(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0               1          2                    3             4
+	// "manufacturer", "batchNo", ["includeArchived"], ["pageSize"], ["bookmark"]
+	if len(args) < 2 || len(args) > 5 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 2 to 5"))
+	}
+
+	manufacturer := strings.ToLower(args[0])
+	batchNo := args[1]
+	if len(manufacturer) <= 0 || len(batchNo) <= 0 {
+		return errorResponse("", validationError("Manufacturer and batch number must be non-empty strings"))
+	}
+	includeArchived, err := parseIncludeArchived(args, 2)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	fmt.Println("- start getProductsByBatch ", manufacturer, batchNo)
+
+	pageSize, bookmark, err := parsePagination(args, 3)
+	if err != nil {
+		return errorResponse("", err)
+	}
+
+	buffer, err := getProductsByIndexWithPagination(stub, "mfr~batch~puid", []string{manufacturer, batchNo}, includeArchived, pageSize, bookmark)
+	if err != nil {
+		return errorResponse("", err)
+	}
+
+	fmt.Printf("- getProductsByBatch queryResult:\n%s\n", buffer.String())
+
+	return shim.Success(buffer.Bytes())
+}
+
+// ==== Example: GetStateByPartialCompositeKey/RangeQuery =========================================
+// getProductsCreatedBy returns every product minted by the given client identity, as
+// recorded in CreatedBy (the cid.GetID value, passed exactly as stored).
+// Uses a GetStateByPartialCompositeKey (range query) against the creator~puid 'index'
+// and reads the full product record for each puid found.
+// Archived products are left out unless the optional includeArchived argument is true.
+// With a pageSize only that many index entries are read and resolved, and the result is
+// wrapped with the record count and the bookmark for the next page.
+// ===========================================================================================
+func (t *SimpleChaincode) getProductsCreatedBy(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0            1                    2             3
+	// "creatorID", ["includeArchived"], ["pageSize"], ["bookmark"]
+	if len(args) < 1 || len(args) > 4 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 1 to 4"))
+	}
+
+	creatorID := args[0]
+	if len(creatorID) <= 0 {
+		return errorResponse("", validationError("1st argument must be a non-empty string"))
+	}
+	includeArchived, err := parseIncludeArchived(args, 1)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	fmt.Println("- start getProductsCreatedBy ", creatorID)
+
+	pageSize, bookmark, err := parsePagination(args, 2)
+	if err != nil {
+		return errorResponse("", err)
+	}
+
+	buffer, err := getProductsByIndexWithPagination(stub, "creator~puid", []string{creatorID}, includeArchived, pageSize, bookmark)
+	if err != nil {
+		return errorResponse("", err)
+	}
+
+	fmt.Printf("- getProductsCreatedBy queryResult:\n%s\n", buffer.String())
+
+	return shim.Success(buffer.Bytes())
+}
+
+// ===========================================================================
+// listProducts - list the active products matching any combination of owner,
+// ptype and status filters, an empty filter matching everything. The most
+// selective index available for the filters given is range queried and the
+// remaining filters are applied to the records read: owner and ptype use the
+// owner~type~puid index, owner alone owner~puid, ptype alone type~name~puid
+// and status alone status~puid. With owner or ptype, status is filtered in
+// memory; no filter at all is a range scan over every product record. With a
+// pageSize each call reads that many index entries or records and the result
+// is wrapped with the count of records returned and the bookmark for the next
+// page, as for the other paged handlers. Because of the in-memory filters a page may hold fewer than
+// pageSize records, even none; only an empty bookmark means the end.
+// ===========================================================================
+func (t *SimpleChaincode) listProducts(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0 (optional)  1 (optional)  2 (optional)  3 (optional)  4 (optional)
+	// "owner",      "ptype",      "status",     "pageSize",   "bookmark"
+	if len(args) > 5 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 0 to 5"))
+	}
+	filters := make([]string, 3)
+	for i := 0; i < len(args) && i < 3; i++ {
+		filters[i] = strings.ToLower(args[i])
+		if i == 0 {
+			filters[i] = args[i] //owners keep their case
+		}
+	}
+	owner, ptype, status := filters[0], filters[1], filters[2]
+	pageSize, bookmark, err := parsePagination(args, 3)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	fmt.Println("- start listProducts ", owner, ptype, status, pageSize, bookmark)
+
+	indexName := ""
+	var attributes []string
+	switch {
+	case len(owner) > 0 && len(ptype) > 0:
+		indexName, attributes = "owner~type~puid", []string{owner, ptype}
+	case len(owner) > 0:
+		indexName, attributes = "owner~puid", []string{owner}
+	case len(ptype) > 0:
+		indexName, attributes = "type~name~puid", []string{ptype}
+	case len(status) > 0:
+		indexName, attributes = "status~puid", []string{status}
+	}
+
+	var resultsIterator shim.StateQueryIteratorInterface
+	var responseMetadata *pb.QueryResponseMetadata
+	startKey, endKey := productKeyRange(stub, "", "")
+	switch {
+	case len(indexName) > 0 && pageSize > 0:
+		resultsIterator, responseMetadata, err = stub.GetStateByPartialCompositeKeyWithPagination(indexName, attributes, pageSize, bookmark)
+	case len(indexName) > 0:
+		resultsIterator, err = stub.GetStateByPartialCompositeKey(indexName, attributes)
+	case pageSize > 0:
+		resultsIterator, responseMetadata, err = stub.GetStateByRangeWithPagination(startKey, endKey, pageSize, bookmark)
+	default:
+		resultsIterator, err = stub.GetStateByRange(startKey, endKey)
+	}
+	if err != nil {
+		return errorResponse("", err)
+	}
+	defer resultsIterator.Close()
+
+	var candidates []QueryResult
+	if len(indexName) > 0 {
+		candidates, err = collectProductsFromIndexIterator(stub, resultsIterator)
+		if err != nil {
+			return errorResponse("", err)
+		}
+	} else {
+		for resultsIterator.HasNext() {
+			queryResponse, err := resultsIterator.Next()
+			if err != nil {
+				return errorResponse("", err)
+			}
+			if strings.ContainsRune(queryResponse.Key, 0) {
+				continue // composite key
+			}
+			candidates = append(candidates, QueryResult{queryResponse.Key, queryResponse.Value})
+		}
+	}
+
+	// ==== Apply the filters no index covered ====
+	results := []QueryResult{}
+	for _, candidate := range candidates {
+		p := product{}
+		if json.Unmarshal(candidate.Record, &p) != nil || !isAllowedDocType(p.ObjectType) || p.Archived {
+			continue
+		}
+		if len(status) > 0 && p.Status != status {
+			continue
+		}
+		results = append(results, candidate)
+	}
+
+	buffer, err := marshalQueryResults(results)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	if responseMetadata != nil {
+		buffer = addPaginationMetadataToQueryResults(buffer, &pb.QueryResponseMetadata{
+			FetchedRecordsCount: int32(len(results)),
+			Bookmark:            responseMetadata.Bookmark,
+		})
+	}
+	fmt.Printf("- listProducts queryResult:\n%s\n", buffer.String())
+	return shim.Success(buffer.Bytes())
+}
+
+// ==== Example: GetStateByPartialCompositeKey/RangeQuery =========================================
+// getProductCount returns {"count": N} for all products, or for those matching an optional
+// ptype or owner filter. Only the index keys are iterated; no product record is read.
+// Fabric has no native count on either LevelDB or CouchDB, so this is still a range scan
+// over the index, just a much cheaper one than reading every record.
+// ===========================================================================================
+func (t *SimpleChaincode) getProductCount(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0 (optional)     1 (optional)
+	// "ptype"|"owner",  "value"
+	if len(args) != 0 && len(args) != 2 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 0 or 2"))
+	}
+
+	indexName := "type~name~puid"
+	attributes := []string{}
+	if len(args) == 2 {
+		switch args[0] {
+		case "ptype":
+			attributes = []string{strings.ToLower(args[1])}
+		case "owner":
+			indexName = "owner~puid"
+			attributes = []string{args[1]}
+		default:
+			return errorResponse("", validationError("Unknown filter: %s, allowed filters: [ptype owner]", args[0]))
+		}
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(indexName, attributes)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	defer resultsIterator.Close()
+
+	count := 0
+	for resultsIterator.HasNext() {
+		_, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse("", err)
+		}
+		count++
+	}
+
+	return shim.Success([]byte(fmt.Sprintf("{\"count\":%d}", count)))
+}
+
+// =========================================================================================
+// constructProductResponseFromIndexIterator builds a JSON array of QueryRecords from an
+// iterator over a composite-key index whose last component is the puid. The full product
+// record is read for every entry; entries pointing at a missing product are skipped.
+// =========================================================================================
+func constructProductResponseFromIndexIterator(stub shim.ChaincodeStubInterface, resultsIterator shim.StateQueryIteratorInterface) (*bytes.Buffer, error) {
+	results, err := collectProductsFromIndexIterator(stub, resultsIterator)
+	if err != nil {
+		return nil, err
+	}
+	return marshalQueryResults(results)
+}
+
+// ===========================================================================
+// getProductsByIndex reads the products found under the given leading
+// components of an index. With includeArchived the matching entries of the
+// archived copy of the index are appended after the active ones.
+// ===========================================================================
+func getProductsByIndex(stub shim.ChaincodeStubInterface, indexName string, attributes []string, includeArchived bool) (*bytes.Buffer, error) {
+	indexNames := []string{indexName}
+	if includeArchived {
+		indexNames = append(indexNames, archivedIndexPrefix+indexName)
+	}
+
+	results := []QueryResult{}
+	for _, name := range indexNames {
+		resultsIterator, err := stub.GetStateByPartialCompositeKey(name, attributes)
+		if err != nil {
+			return nil, err
+		}
+		indexResults, err := collectProductsFromIndexIterator(stub, resultsIterator)
+		resultsIterator.Close()
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, indexResults...)
+	}
+
+	return marshalQueryResults(results)
+}
+
+// archivedBookmarkPrefix marks a getProductsByIndexWithPagination bookmark that
+// continues in the archived copy of an index
+const archivedBookmarkPrefix = "archived:"
+
+// ===========================================================================
+// getProductsByIndexWithPagination is getProductsByIndex limited to pageSize
+// index entries per call; only those entries are resolved to product records.
+// A pageSize of 0 returns everything, unwrapped, as getProductsByIndex does.
+// With includeArchived the active index is paged through first and then the
+// archived one; bookmarks for the latter carry archivedBookmarkPrefix.
+// ===========================================================================
+func getProductsByIndexWithPagination(stub shim.ChaincodeStubInterface, indexName string, attributes []string, includeArchived bool, pageSize int32, bookmark string) (*bytes.Buffer, error) {
+	if pageSize == 0 {
+		return getProductsByIndex(stub, indexName, attributes, includeArchived)
+	}
+
+	inArchive := strings.HasPrefix(bookmark, archivedBookmarkPrefix)
+	if inArchive && !includeArchived {
+		return nil, fmt.Errorf("Bookmark continues in archived products, includeArchived must be true")
+	}
+	name := indexName
+	if inArchive {
+		name = archivedIndexPrefix + indexName
+		bookmark = strings.TrimPrefix(bookmark, archivedBookmarkPrefix)
+	}
+
+	resultsIterator, responseMetadata, err := stub.GetStateByPartialCompositeKeyWithPagination(name, attributes, pageSize, bookmark)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	buffer, err := constructProductResponseFromIndexIterator(stub, resultsIterator)
+	if err != nil {
+		return nil, err
+	}
+
+	nextPage := &pb.QueryResponseMetadata{
+		FetchedRecordsCount: responseMetadata.FetchedRecordsCount,
+		Bookmark:            responseMetadata.Bookmark,
+	}
+	if inArchive && responseMetadata.FetchedRecordsCount < pageSize {
+		nextPage.Bookmark = "" // both indexes are exhausted
+	} else if inArchive {
+		nextPage.Bookmark = archivedBookmarkPrefix + responseMetadata.Bookmark
+	} else if includeArchived && responseMetadata.FetchedRecordsCount < pageSize {
+		// the active index is exhausted, carry on with the archived one
+		nextPage.Bookmark = archivedBookmarkPrefix
+	}
+
+	return addPaginationMetadataToQueryResults(buffer, nextPage), nil
+}
+
+// parsePagination reads the optional pageSize and bookmark at args[pos] and
+// args[pos+1]. A missing or empty pageSize means no pagination.
+func parsePagination(args []string, pos int) (int32, string, error) {
+	if len(args) <= pos || len(args[pos]) == 0 {
+		return 0, "", nil
+	}
+	pageSize, err := strconv.ParseInt(args[pos], 10, 32)
+	if err != nil || pageSize <= 0 {
+		return 0, "", validationError("pageSize must be a positive numeric string")
+	}
+	bookmark := ""
+	if len(args) > pos+1 {
+		bookmark = args[pos+1]
+	}
+	return int32(pageSize), bookmark, nil
+}
+
+// ===========================================================================
+// collectProductsFromIndexIterator reads the product each entry of an index
+// iterator points at, skipping stale entries
+// ===========================================================================
+func collectProductsFromIndexIterator(stub shim.ChaincodeStubInterface, resultsIterator shim.StateQueryIteratorInterface) ([]QueryResult, error) {
+	results := []QueryResult{}
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		// get the puid from the composite key
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return nil, err
+		}
+		returnedPuid := compositeKeyParts[len(compositeKeyParts)-1]
+
+		productAsBytes, err := stub.GetState(productKey(stub, returnedPuid))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get product: %s", err)
+		} else if productAsBytes == nil {
+			continue // stale index entry
+		}
+
+		results = append(results, QueryResult{returnedPuid, productAsBytes})
+	}
+	return results, nil
+}
+
+// parseIncludeArchived reads the optional includeArchived flag at args[pos].
+// A missing or empty argument means false.
+func parseIncludeArchived(args []string, pos int) (bool, error) {
+	if len(args) <= pos || len(args[pos]) == 0 {
+		return false, nil
+	}
+	includeArchived, err := strconv.ParseBool(args[pos])
+	if err != nil {
+		return false, validationError("includeArchived must be true or false")
+	}
+	return includeArchived, nil
+}
+
+// ===========================================================================
+// changeStatus - move a product to a new lifecycle stage. Only transitions
+// listed in statusTransitions are permitted, and only the owner (or a
+// regulator) may make them.
+// ===========================================================================
+func (t *SimpleChaincode) changeStatus(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0         1               2 (optional)
+	// "puid", "in-transit", "expectedVersion"
+	if len(args) != 2 && len(args) != 3 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 2 or 3"))
+	}
+
+	puid := args[0]
+	newStatus := strings.ToLower(args[1])
+	fmt.Println("- start changeStatus ", puid, newStatus)
+
+	if _, ok := statusTransitions[newStatus]; !ok {
+		return errorResponse(puid, validationError("Unknown status: %s", newStatus))
+	}
+
+	productAsBytes, err := stub.GetState(productKey(stub, puid))
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to get product:%s", err))
+	} else if productAsBytes == nil {
+		return errorResponse(puid, notFoundError("Product does not exist"))
+	}
+
+	productToChange := product{}
+	err = json.Unmarshal(productAsBytes, &productToChange) //unmarshal it aka JSON.parse()
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = checkVersion(&productToChange, args, 2)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = assertOwnerOrRegulator(stub, productToChange.Owner)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	oldProduct := productToChange
+
+	currentStatus := productToChange.Status
+	if currentStatus == "" { //record predates Status
+		currentStatus = statusManufactured
+	}
+	if !isAllowedTransition(currentStatus, newStatus) {
+		return errorResponse(puid, conflictError("Invalid status transition from %s to %s", currentStatus, newStatus))
+	}
+	productToChange.Status = newStatus
+
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	markModified(&productToChange, txTimestamp.Seconds)
+
+	productJSONasBytes, err := marshalProduct(&productToChange)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = stub.PutState(productKey(stub, puid), productJSONasBytes) //rewrite the product
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	// ==== Move the product to its new status~puid bucket ====
+	err = updateProductIndexes(stub, &oldProduct, &productToChange)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	eventJSONasBytes, err := json.Marshal(statusEvent{puid, currentStatus, newStatus})
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = stub.SetEvent(productStatusChangedEvent, eventJSONasBytes)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	fmt.Println("- end changeStatus (success)")
+	return shim.Success(productJSONasBytes)
+}
+
+// isAllowedTransition reports whether statusTransitions permits moving from one stage to another
+func isAllowedTransition(from string, to string) bool {
+	for _, allowed := range statusTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// ===========================================================================
+// splitProduct - move part of a product's quantity into a new product. The new
+// product copies the source's attributes and gets a puid derived from the source
+// puid and the transaction id, so every endorser derives the same value. The
+// source's weight is shared between the two in proportion to quantity. Only
+// the owner (or a regulator) may split a product, and not while it could not
+// be transferred, see assertTransferable.
+// ===========================================================================
+func (t *SimpleChaincode) splitProduct(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0        1           2 (optional)
+	// "puid", "amount", "expectedVersion"
+	if len(args) != 2 && len(args) != 3 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 2 or 3"))
+	}
+
+	puid := args[0]
+	amount, err := strconv.Atoi(args[1])
+	if err != nil {
+		return errorResponse(puid, validationError("2nd argument must be a numeric string"))
+	}
+	if amount <= 0 {
+		return errorResponse(puid, validationError("2nd argument must be a positive number"))
+	}
+	fmt.Println("- start splitProduct ", puid, amount)
+
+	productAsBytes, err := stub.GetState(productKey(stub, puid))
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to get product:%s", err))
+	} else if productAsBytes == nil {
+		return errorResponse(puid, notFoundError("Product does not exist"))
+	}
+
+	source := product{}
+	err = json.Unmarshal(productAsBytes, &source) //unmarshal it aka JSON.parse()
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = checkVersion(&source, args, 2)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = assertOwnerOrRegulator(stub, source.Owner)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = assertTransferable(&source)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	if amount > source.Quantity {
+		return errorResponse(puid, conflictError("Cannot split %d from %s, only %d available", amount, puid, source.Quantity))
+	}
+
+	txID := stub.GetTxID()
+	if len(txID) <= 0 {
+		return errorResponse(puid, fmt.Errorf("Transaction id is empty, cannot derive the new product's puid"))
+	}
+	if len(txID) > 8 {
+		txID = txID[:8]
+	}
+	childPuid := puid + "-" + txID
+	err = validatePuid(childPuid)
+	if err != nil {
+		return errorResponse(puid, validationError("Cannot derive a valid puid for the new product %s: %s", childPuid, err))
+	}
+	childAsBytes, err := stub.GetState(productKey(stub, childPuid))
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to get product:%s", err))
+	} else if childAsBytes != nil {
+		return errorResponse(puid, alreadyExistsError("This product already exists: %s", childPuid))
+	}
+
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	child := source
+	child.Puid = childPuid
+	child.OwnerHistory = []string{}
+	child.ChildPuids = nil
+	child.ParentPuids = []string{puid}
+	// ==== Drop what belongs to the source's own requests and events ====
+	child.Owners = nil
+	child.Escrow = nil
+	child.RequestID = ""
+	child.SerialNo = 0
+	child.RecallReason = ""
+	child.RestoredFrom = ""
+	child.TransferNote = ""
+	child.TransferReasonHash = ""
+	child.Quantity = amount
+	child.Weight = source.Weight * float64(amount) / float64(source.Quantity)
+	child.CreatedAt = txTimestamp.Seconds
+	child.UpdatedAt = txTimestamp.Seconds
+	child.Version = 1
+
+	source.Quantity -= amount
+	source.Weight -= child.Weight
+	source.ChildPuids = append(source.ChildPuids, childPuid)
+	markModified(&source, txTimestamp.Seconds)
+
+	sourceJSONasBytes, err := marshalProduct(&source)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = stub.PutState(productKey(stub, puid), sourceJSONasBytes)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	childJSONasBytes, err := marshalProduct(&child)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = stub.PutState(productKey(stub, childPuid), childJSONasBytes)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = createProductIndexes(stub, &child)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	fmt.Println("- end splitProduct (success)")
+	return shim.Success(childJSONasBytes)
+}
+
+// ===========================================================================
+// mergeProduct - fold the quantity and weight of a second product into the first,
+// converting the weight to the first's unit. Both must
+// share the same Ptype and Owner, the caller must be that owner (or a regulator)
+// and both must be transferable, see assertTransferable. The first inherits a
+// compliance breach of the second, which is removed from state with its pending
+// transfer and sensor readings.
+// ===========================================================================
+func (t *SimpleChaincode) mergeProduct(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0              1              2 (optional)              3 (optional)
+	// "targetPuid", "sourcePuid", "expectedTargetVersion", "expectedSourceVersion"
+	if len(args) < 2 || len(args) > 4 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 2 to 4"))
+	}
+
+	targetPuid := args[0]
+	sourcePuid := args[1]
+	if targetPuid == sourcePuid {
+		return errorResponse(targetPuid, validationError("Cannot merge a product into itself"))
+	}
+	fmt.Println("- start mergeProduct ", targetPuid, sourcePuid)
+
+	target := product{}
+	source := product{}
+	for _, entry := range []struct {
+		puid string
+		dest *product
+	}{{targetPuid, &target}, {sourcePuid, &source}} {
+		productAsBytes, err := stub.GetState(productKey(stub, entry.puid))
+		if err != nil {
+			return errorResponse(targetPuid, fmt.Errorf("Failed to get product:%s", err))
+		} else if productAsBytes == nil {
+			return errorResponse(targetPuid, notFoundError("Product does not exist: %s", entry.puid))
+		}
+		err = json.Unmarshal(productAsBytes, entry.dest)
+		if err != nil {
+			return errorResponse(targetPuid, err)
+		}
+	}
+
+	err := checkVersion(&target, args, 2)
+	if err != nil {
+		return errorResponse(targetPuid, err)
+	}
+	err = checkVersion(&source, args, 3)
+	if err != nil {
+		return errorResponse(targetPuid, err)
+	}
+
+	if target.Ptype != source.Ptype {
+		return errorResponse(targetPuid, conflictError("Cannot merge products of different types: %s and %s", target.Ptype, source.Ptype))
+	}
+	if target.Owner != source.Owner {
+		return errorResponse(targetPuid, conflictError("Cannot merge products with different owners: %s and %s", target.Owner, source.Owner))
+	}
+	err = assertOwnerOrRegulator(stub, target.Owner)
+	if err != nil {
+		return errorResponse(targetPuid, err)
+	}
+	for _, p := range []*product{&target, &source} {
+		err = assertTransferable(p)
+		if err != nil {
+			return errorResponse(targetPuid, err)
+		}
+	}
+
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return errorResponse(targetPuid, err)
+	}
+	target.Quantity += source.Quantity
+	addWeight(&target, &source)
+	target.ComplianceBreached = target.ComplianceBreached || source.ComplianceBreached
+	target.ChildPuids = append(target.ChildPuids, source.ChildPuids...)
+	target.ParentPuids = append(target.ParentPuids, sourcePuid)
+	markModified(&target, txTimestamp.Seconds)
+
+	err = stub.DelState(productKey(stub, sourcePuid))
+	if err != nil {
+		return errorResponse(targetPuid, fmt.Errorf("Failed to delete state:%s", err))
+	}
+	err = deleteProductIndexes(stub, &source)
+	if err != nil {
+		return errorResponse(targetPuid, fmt.Errorf("Failed to delete state:%s", err))
+	}
+	err = deleteProductRecords(stub, sourcePuid)
+	if err != nil {
+		return errorResponse(targetPuid, fmt.Errorf("Failed to delete state:%s", err))
+	}
+
+	targetJSONasBytes, err := marshalProduct(&target)
+	if err != nil {
+		return errorResponse(targetPuid, err)
+	}
+	err = stub.PutState(productKey(stub, targetPuid), targetJSONasBytes)
+	if err != nil {
+		return errorResponse(targetPuid, err)
+	}
+
+	fmt.Println("- end mergeProduct (success)")
+	return shim.Success(targetJSONasBytes)
+}
+
+// addWeight adds the weight of source to target in target's unit. A target
+// never weighed takes source's weight and unit.
+func addWeight(target *product, source *product) {
+	if source.Weight == 0 {
+		return
+	}
+	if target.Weight == 0 || len(target.Unit) == 0 {
+		target.Weight = source.Weight
+		target.Unit = source.Unit
+		return
+	}
+	sourceFactor, sourceKnown := kilogramsPerUnit[source.Unit]
+	targetFactor, targetKnown := kilogramsPerUnit[target.Unit]
+	if !sourceKnown || !targetKnown {
+		return //rejected on input, see validateWeight
+	}
+	target.Weight += source.Weight * sourceFactor / targetFactor
+}
+
+// ===========================================================================
+// verifyContentHash - report whether a candidate hash of an off-chain product
+// document matches the ContentHash anchored on-chain, as {"puid","match"}.
+// A product without a ContentHash never matches.
+// ===========================================================================
+func (t *SimpleChaincode) verifyContentHash(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0        1
+	// "puid", "contentHash"
+	if len(args) != 2 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 2"))
+	}
+
+	puid := args[0]
+	candidate := strings.ToLower(args[1])
+	err := validateContentHash(candidate)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	productAsBytes, err := stub.GetState(productKey(stub, puid))
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to get product:%s", err))
+	} else if productAsBytes == nil {
+		return errorResponse(puid, notFoundError("Product does not exist: %s", puid))
+	}
+	p := product{}
+	err = json.Unmarshal(productAsBytes, &p)
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to decode JSON of: %s", puid))
+	}
+
+	resultJSONasBytes, err := json.Marshal(struct {
+		Puid  string `json:"puid"`
+		Match bool   `json:"match"`
+	}{puid, len(p.ContentHash) > 0 && p.ContentHash == candidate})
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	return shim.Success(resultJSONasBytes)
+}
+
+// maxLineageDepth bounds how many generations getLineage walks up
+const maxLineageDepth = 32
+
+// lineageEntry is one ancestor in the flat list returned by getLineage
+type lineageEntry struct {
+	Puid        string   `json:"puid"`
+	Depth       int      `json:"depth"` //0 for the requested product, 1 for its parents, ...
+	ParentPuids []string `json:"parentPuids,omitempty"`
+	Missing     bool     `json:"missing,omitempty"`   //the product is no longer in state, e.g. merged away
+	Truncated   bool     `json:"truncated,omitempty"` //parents not followed, maxLineageDepth reached
+}
+
+// ===========================================================================
+// getLineage - return the split/merge ancestry of a product as a flat, depth
+// first list of lineageEntry, starting with the product itself at depth 0.
+// Each ancestor is listed once, at the first depth it is reached, so shared
+// ancestors and cycles don't repeat. Parents that no longer exist in state are
+// marked missing; mergeProduct removes its source, so merged products show up
+// that way and their own history is available through getHistoryForProduct.
+// ===========================================================================
+func (t *SimpleChaincode) getLineage(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "puid"
+	if len(args) != 1 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 1"))
+	}
+
+	puid := args[0]
+	fmt.Println("- start getLineage ", puid)
+
+	productAsBytes, err := stub.GetState(productKey(stub, puid))
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to get product:%s", err))
+	} else if productAsBytes == nil {
+		return errorResponse(puid, notFoundError("Product does not exist: %s", puid))
+	}
+
+	lineage := []lineageEntry{}
+	visited := make(map[string]bool)
+	err = appendLineage(stub, puid, 0, visited, &lineage)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	lineageJSONasBytes, err := json.Marshal(lineage)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	fmt.Println("- end getLineage (success)")
+	return shim.Success(lineageJSONasBytes)
+}
+
+// appendLineage appends puid and, recursively, its not yet visited ancestors to lineage
+func appendLineage(stub shim.ChaincodeStubInterface, puid string, depth int, visited map[string]bool, lineage *[]lineageEntry) error {
+	visited[puid] = true
+	entry := lineageEntry{Puid: puid, Depth: depth}
+
+	productAsBytes, err := stub.GetState(productKey(stub, puid))
+	if err != nil {
+		return fmt.Errorf("Failed to get product: %s", err)
+	} else if productAsBytes == nil {
+		entry.Missing = true
+		*lineage = append(*lineage, entry)
+		return nil
+	}
+	p := product{}
+	err = json.Unmarshal(productAsBytes, &p)
+	if err != nil {
+		return fmt.Errorf("Failed to decode JSON of: %s", puid)
+	}
+	entry.ParentPuids = p.ParentPuids
+	entry.Truncated = depth >= maxLineageDepth && len(p.ParentPuids) > 0
+	*lineage = append(*lineage, entry)
+	if entry.Truncated {
+		return nil
+	}
+
+	for _, parentPuid := range p.ParentPuids {
+		if visited[parentPuid] {
+			continue
+		}
+		err = appendLineage(stub, parentPuid, depth+1, visited, lineage)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ===========================================================================
+// logSensorReading - record an environmental reading for a product, e.g. for
+// cold-chain compliance. Readings are kept under their own puid~sensor~timestamp
+// keys so they don't grow the product record. A reading outside the range given
+// in sensorRanges sets ComplianceBreached on the product. The timestamp component
+// is the transaction time in zero-padded Unix nanoseconds, so readings sort by time.
+// Readings are logged by the owner (or a regulator).
+// ===========================================================================
+func (t *SimpleChaincode) logSensorReading(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0        1              2
+	// "puid", "temperature", "5.5"
+	if len(args) != 3 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 3"))
+	}
+
+	puid := args[0]
+	readingType := strings.ToLower(args[1])
+	acceptable, ok := sensorRanges[readingType]
+	if !ok {
+		return errorResponse(puid, validationError("Unknown reading type: %s", readingType))
+	}
+	value, err := strconv.ParseFloat(args[2], 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return errorResponse(puid, validationError("3rd argument must be a numeric string"))
+	}
+	fmt.Println("- start logSensorReading ", puid, readingType, value)
+
+	productAsBytes, err := stub.GetState(productKey(stub, puid))
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to get product:%s", err))
+	} else if productAsBytes == nil {
+		return errorResponse(puid, notFoundError("Product does not exist: %s", puid))
+	}
+	productToCheck := product{}
+	err = json.Unmarshal(productAsBytes, &productToCheck)
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to decode JSON of: %s", puid))
+	}
+	err = assertOwnerOrRegulator(stub, productToCheck.Owner)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	nanos := txTimestamp.Seconds*int64(time.Second) + int64(txTimestamp.Nanos)
+	readingKey, err := stub.CreateCompositeKey("puid~sensor~timestamp", []string{puid, readingType, fmt.Sprintf("%019d", nanos)})
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	existingAsBytes, err := stub.GetState(readingKey)
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to get sensor reading:%s", err))
+	} else if existingAsBytes != nil {
+		return errorResponse(puid, alreadyExistsError("A %s reading is already logged at this time", readingType))
+	}
+
+	reading := sensorReading{"sensorReading", puid, readingType, value, txTimestamp.Seconds, value < acceptable.Min || value > acceptable.Max}
+	readingJSONasBytes, err := json.Marshal(reading)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = stub.PutState(readingKey, readingJSONasBytes)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	// ==== Flag the product on its first out of range reading ====
+	if reading.OutOfRange && !productToCheck.ComplianceBreached {
+		productToCheck.ComplianceBreached = true
+		markModified(&productToCheck, txTimestamp.Seconds)
+		productJSONasBytes, err := marshalProduct(&productToCheck)
+		if err != nil {
+			return errorResponse(puid, err)
+		}
+		err = stub.PutState(productKey(stub, puid), productJSONasBytes)
+		if err != nil {
+			return errorResponse(puid, err)
+		}
+	}
+
+	fmt.Println("- end logSensorReading (success)")
+	return shim.Success(readingJSONasBytes)
+}
+
+// ===========================================================================
+// getSensorReadings - return a product's sensor readings, oldest first, as a
+// JSON array. The optional reading type restricts them to one sensor; readings
+// of all types are otherwise ordered by type, then time.
+// ===========================================================================
+func (t *SimpleChaincode) getSensorReadings(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0         1 (optional)
+	// "puid", "readingType"
+	if len(args) != 1 && len(args) != 2 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 1 or 2"))
+	}
+
+	puid := args[0]
+	attributes := []string{puid}
+	if len(args) > 1 && len(args[1]) > 0 {
+		attributes = append(attributes, strings.ToLower(args[1]))
+	}
+	fmt.Println("- start getSensorReadings ", attributes)
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("puid~sensor~timestamp", attributes)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	defer resultsIterator.Close()
+
+	readings := []sensorReading{}
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse(puid, err)
+		}
+		reading := sensorReading{}
+		err = json.Unmarshal(responseRange.Value, &reading)
+		if err != nil {
+			return errorResponse(puid, fmt.Errorf("Failed to decode sensor reading: %s", err))
+		}
+		readings = append(readings, reading)
+	}
+
+	readingsJSONasBytes, err := json.Marshal(readings)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	return shim.Success(readingsJSONasBytes)
+}
+
+// ===========================================================================
+// logLocation - record a product's current location. Each call rewrites the
+// product, so the movement trail is available through getHistoryForProduct.
+// Locations are logged by the owner (or a regulator).
+// ===========================================================================
+func (t *SimpleChaincode) logLocation(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0         1                        2 (optional)
+	// "puid", "Warehouse-7, Mumbai", "expectedVersion"
+	if len(args) != 2 && len(args) != 3 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 2 or 3"))
+	}
+
+	puid := args[0]
+	location := strings.TrimSpace(args[1])
+	if len(location) <= 0 {
+		return errorResponse(puid, validationError("2nd argument must be a non-empty string"))
+	}
+	fmt.Println("- start logLocation ", puid, location)
+
+	productAsBytes, err := stub.GetState(productKey(stub, puid))
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to get product:%s", err))
+	} else if productAsBytes == nil {
+		return errorResponse(puid, notFoundError("Product does not exist"))
+	}
+
+	productToMove := product{}
+	err = json.Unmarshal(productAsBytes, &productToMove) //unmarshal it aka JSON.parse()
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = checkVersion(&productToMove, args, 2)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = assertOwnerOrRegulator(stub, productToMove.Owner)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	previousLocation := productToMove.Location
+	productToMove.Location = location
+	markModified(&productToMove, txTimestamp.Seconds)
+
+	productJSONasBytes, err := marshalProduct(&productToMove)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = stub.PutState(productKey(stub, puid), productJSONasBytes) //rewrite the product
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	eventJSONasBytes, err := json.Marshal(locationEvent{puid, previousLocation, location, txTimestamp.Seconds})
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = stub.SetEvent(productMovedEvent, eventJSONasBytes)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	fmt.Println("- end logLocation (success)")
+	return shim.Success(productJSONasBytes)
+}
+
+// defaultMaxMetadataBytes caps the total length of a product's metadata keys and
+// values unless configured otherwise
+const defaultMaxMetadataBytes = 4096
+
+// ===========================================================================
+// setMetadata - merge key-values into a product's Metadata, replacing the
+// values of keys it already has
+// ===========================================================================
+func (t *SimpleChaincode) setMetadata(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0         1                                  2 (optional)
+	// "puid", "{\"grade\":\"A\",\"origin\":\"IN\"}", "expectedVersion"
+	if len(args) != 2 && len(args) != 3 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 2 or 3"))
+	}
+
+	var entries map[string]string
+	err := json.Unmarshal([]byte(args[1]), &entries)
+	if err != nil {
+		return errorResponse("", validationError("2nd argument must be a JSON object of string values: %s", err))
+	}
+	if len(entries) == 0 {
+		return errorResponse("", validationError("2nd argument must contain at least one key"))
+	}
+	for key := range entries {
+		if len(strings.TrimSpace(key)) <= 0 {
+			return errorResponse("", validationError("Metadata keys must be non-empty strings"))
+		}
+	}
+
+	return updateMetadata(stub, args[0], args, 2, func(metadata map[string]string) error {
+		for key, value := range entries {
+			metadata[key] = value
+		}
+		return nil
+	})
+}
+
+// ===========================================================================
+// removeMetadataKey - delete a key from a product's Metadata
+// ===========================================================================
+func (t *SimpleChaincode) removeMetadataKey(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0        1       2 (optional)
+	// "puid", "key", "expectedVersion"
+	if len(args) != 2 && len(args) != 3 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 2 or 3"))
+	}
+
+	key := args[1]
+	return updateMetadata(stub, args[0], args, 2, func(metadata map[string]string) error {
+		if _, ok := metadata[key]; !ok {
+			return notFoundError("Product %s has no metadata key %s", args[0], key)
+		}
+		delete(metadata, key)
+		return nil
+	})
+}
+
+// updateMetadata checks the caller owns the product (or is a regulator), applies
+// change to its Metadata, checks the result is within the configured
+// MaxMetadataBytes and rewrites the product
+func updateMetadata(stub shim.ChaincodeStubInterface, puid string, args []string, versionPos int, change func(map[string]string) error) pb.Response {
+	productAsBytes, err := stub.GetState(productKey(stub, puid))
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to get product:%s", err))
+	} else if productAsBytes == nil {
+		return errorResponse(puid, notFoundError("Product does not exist"))
+	}
+
+	productToUpdate := product{}
+	err = json.Unmarshal(productAsBytes, &productToUpdate) //unmarshal it aka JSON.parse()
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = checkVersion(&productToUpdate, args, versionPos)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = assertOwnerOrRegulator(stub, productToUpdate.Owner)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	if productToUpdate.Metadata == nil { //record has no metadata yet
+		productToUpdate.Metadata = make(map[string]string)
+	}
+	err = change(productToUpdate.Metadata)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	size := 0
+	for key, value := range productToUpdate.Metadata {
+		size += len(key) + len(value)
+	}
+	config, err := loadConfig(stub)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	if size > config.MaxMetadataBytes {
+		return errorResponse(puid, validationError("Metadata of %s would be %d bytes, at most %d allowed", puid, size, config.MaxMetadataBytes))
+	}
+	if len(productToUpdate.Metadata) == 0 {
+		productToUpdate.Metadata = nil
+	}
+
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	markModified(&productToUpdate, txTimestamp.Seconds)
+
+	productJSONasBytes, err := marshalProduct(&productToUpdate)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = stub.PutState(productKey(stub, puid), productJSONasBytes) //rewrite the product
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	return shim.Success(productJSONasBytes)
+}
+
+// ===========================================================================
+// recallProduct - mark a product and everything split from it as recalled.
+// Descendants are found by following ChildPuids. Products that are already
+// recalled are left untouched, so recalling twice is a no-op.
+//
+// Fabric keeps only the last event set in a transaction, so a single
+// ProductRecalled event lists every product recalled by this call.
+// ===========================================================================
+func (t *SimpleChaincode) recallProduct(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0         1          2 (optional)
+	// "puid", "reason", "expectedVersion"
+	if len(args) != 2 && len(args) != 3 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 2 or 3"))
+	}
+
+	puid := args[0]
+	reason := strings.TrimSpace(args[1])
+	if len(reason) <= 0 {
+		return errorResponse(puid, validationError("2nd argument must be a non-empty string"))
+	}
+	fmt.Println("- start recallProduct ", puid, reason)
+
+	productAsBytes, err := stub.GetState(productKey(stub, puid))
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to get product:%s", err))
+	} else if productAsBytes == nil {
+		return errorResponse(puid, notFoundError("Product does not exist"))
+	}
+
+	root := product{}
+	err = json.Unmarshal(productAsBytes, &root) //unmarshal it aka JSON.parse()
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = checkVersion(&root, args, 2)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	// ==== Only the current owner (or a regulator) may recall ====
+	err = assertOwnerOrRegulator(stub, root.Owner)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	// ==== Walk the product and its descendants breadth first ====
+	recalled := []string{}
+	visited := map[string]bool{puid: true}
+	queue := []product{root}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		for _, childPuid := range current.ChildPuids {
+			if visited[childPuid] {
+				continue
+			}
+			visited[childPuid] = true
+			childAsBytes, err := stub.GetState(productKey(stub, childPuid))
+			if err != nil {
+				return errorResponse(puid, fmt.Errorf("Failed to get product:%s", err))
+			} else if childAsBytes == nil {
+				continue // merged away or deleted
+			}
+			child := product{}
+			err = json.Unmarshal(childAsBytes, &child)
+			if err != nil {
+				return errorResponse(puid, err)
+			}
+			queue = append(queue, child)
+		}
+
+		if current.Status == statusRecalled {
+			continue
+		}
+		oldProduct := current
+		current.Status = statusRecalled
+		current.RecallReason = reason
+		markModified(&current, txTimestamp.Seconds)
+
+		productJSONasBytes, err := marshalProduct(&current)
+		if err != nil {
+			return errorResponse(puid, err)
+		}
+		err = stub.PutState(productKey(stub, current.Puid), productJSONasBytes) //rewrite the product
+		if err != nil {
+			return errorResponse(puid, err)
+		}
+		err = updateProductIndexes(stub, &oldProduct, &current)
+		if err != nil {
+			return errorResponse(puid, err)
+		}
+		recalled = append(recalled, current.Puid)
+	}
+
+	if len(recalled) > 0 {
+		eventJSONasBytes, err := json.Marshal(recallEvent{recalled, reason, txTimestamp.Seconds})
+		if err != nil {
+			return errorResponse(puid, err)
+		}
+		err = stub.SetEvent(productRecalledEvent, eventJSONasBytes)
+		if err != nil {
+			return errorResponse(puid, err)
+		}
+	}
+
+	responseJSONasBytes, _ := json.Marshal(struct {
+		Recalled []string `json:"recalled"`
+	}{recalled})
+	fmt.Println("- end recallProduct (success)")
+	return shim.Success(responseJSONasBytes)
+}
+
+// ===========================================================================
+// reindexProducts - admin maintenance handler that rebuilds the composite
+// indexes from the authoritative product records. Index entries that no product
+// accounts for are deleted, missing ones are recreated, entries whose value is
+// not indexValue, such as those written before it held the puid, are rewritten,
+// and entries of the retired type~name index are dropped.
+// ===========================================================================
+func (t *SimpleChaincode) reindexProducts(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 0"))
+	}
+
+	err := assertAdmin(stub)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	fmt.Println("- start reindexProducts")
+
+	// ==== Collect the index keys every product should have ====
+	// A range query with empty bounds covers every simple (non-composite) key.
+	resultsIterator, err := stub.GetStateByRange(productKeyRange(stub, "", ""))
+	if err != nil {
+		return errorResponse("", err)
+	}
+	defer resultsIterator.Close()
+
+	expectedKeys := make(map[string][]byte) //index key to its value
+	var expectedOrder []string
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse("", err)
+		}
+		p := product{}
+		if json.Unmarshal(queryResponse.Value, &p) != nil || !isAllowedDocType(p.ObjectType) {
+			continue
+		}
+		indexKeys, err := productIndexKeys(stub, &p)
+		if err != nil {
+			return errorResponse("", err)
+		}
+		for _, indexKey := range indexKeys {
+			expectedKeys[indexKey] = indexValue(&p)
+			expectedOrder = append(expectedOrder, indexKey)
+		}
+	}
+
+	// ==== Remove stale entries, fix the values of the good ones ====
+	removed := 0
+	rewritten := 0
+	existingKeys := make(map[string]bool)
+	indexNames := []string{"type~name"}
+	for _, indexName := range productIndexNames {
+		indexNames = append(indexNames, indexName, archivedIndexPrefix+indexName)
+	}
+	for _, indexName := range indexNames {
+		indexIterator, err := stub.GetStateByPartialCompositeKey(indexName, []string{})
+		if err != nil {
+			return errorResponse("", err)
+		}
+		for indexIterator.HasNext() {
+			responseRange, err := indexIterator.Next()
+			if err != nil {
+				indexIterator.Close()
+				return errorResponse("", err)
+			}
+			if value, ok := expectedKeys[responseRange.Key]; ok {
+				existingKeys[responseRange.Key] = true
+				if !bytes.Equal(responseRange.Value, value) {
+					err = stub.PutState(responseRange.Key, value)
+					if err != nil {
+						indexIterator.Close()
+						return errorResponse("", err)
+					}
+					rewritten++
+				}
+				continue
+			}
+			err = stub.DelState(responseRange.Key)
+			if err != nil {
+				indexIterator.Close()
+				return errorResponse("", fmt.Errorf("Failed to delete state:%s", err))
+			}
+			removed++
+		}
+		indexIterator.Close()
+	}
+
+	// ==== Recreate missing entries ====
+	added := 0
+	for _, indexKey := range expectedOrder {
+		if existingKeys[indexKey] {
+			continue
+		}
+		err = stub.PutState(indexKey, expectedKeys[indexKey])
+		if err != nil {
+			return errorResponse("", err)
+		}
+		added++
+	}
+
+	responsePayload := fmt.Sprintf("{\"added\":%d,\"removed\":%d,\"rewritten\":%d}", added, removed, rewritten)
+	fmt.Println("- end reindexProducts: " + responsePayload)
+	return shim.Success([]byte(responsePayload))
+}
+
+// indexProblem is one index entry found wrong by verifyIndexIntegrity
+type indexProblem struct {
+	Index      string   `json:"index"`
+	Attributes []string `json:"attributes"` //components of the composite key, the puid last
+	Kind       string   `json:"kind"`
+	Message    string   `json:"message"`
+}
+
+// ===========================================================================
+// verifyIndexIntegrity - check every entry of the product indexes, active and
+// archived, against the product it names, and report each wrong one as
+// {"index", "attributes", "kind", "message"}. The kinds are:
+//   - legacyValue: the value is the 0x00 byte written before it held the puid
+//   - badValue: the value is neither that nor the puid of the key
+//   - orphaned: no product is stored under the puid
+//   - corruptProduct: the product record can't be decoded
+//   - mismatch: the product exists but is not indexed under this key, e.g. a
+//     forged owner~puid entry or one left behind by an out-of-band write
+//
+// reindexProducts repairs all of them from the product records. This reads
+// every index entry and the product of each, so its cost grows with the
+// number of products; it is meant for audits, not the hot path.
+// ===========================================================================
+func (t *SimpleChaincode) verifyIndexIntegrity(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 0"))
+	}
+	fmt.Println("- start verifyIndexIntegrity")
+
+	indexNames := []string{}
+	for _, indexName := range productIndexNames {
+		indexNames = append(indexNames, indexName, archivedIndexPrefix+indexName)
+	}
+	expectedKeys := map[string]map[string]bool{} //by puid, nil for a missing product
+	corrupt := map[string]bool{}
+	checked := 0
+	problems := []indexProblem{}
+	for _, indexName := range indexNames {
+		indexIterator, err := stub.GetStateByPartialCompositeKey(indexName, []string{})
+		if err != nil {
+			return errorResponse("", err)
+		}
+		for indexIterator.HasNext() {
+			responseRange, err := indexIterator.Next()
+			if err != nil {
+				indexIterator.Close()
+				return errorResponse("", err)
+			}
+			_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+			if err != nil || len(compositeKeyParts) == 0 {
+				indexIterator.Close()
+				return errorResponse("", fmt.Errorf("Malformed key in index %s", indexName))
+			}
+			checked++
+			problem := func(kind string, format string, args ...interface{}) {
+				problems = append(problems, indexProblem{indexName, compositeKeyParts, kind, fmt.Sprintf(format, args...)})
+			}
+			puid := compositeKeyParts[len(compositeKeyParts)-1]
+
+			// ==== The value must name the same product as the key ====
+			if bytes.Equal(responseRange.Value, []byte{0x00}) {
+				problem("legacyValue", "Entry predates puid values")
+			} else if string(responseRange.Value) != puid {
+				problem("badValue", "Entry holds %q, not its puid %s", responseRange.Value, puid)
+			}
+
+			// ==== The product must exist and be indexed under the key ====
+			keys, seen := expectedKeys[puid]
+			if !seen {
+				productAsBytes, err := stub.GetState(productKey(stub, puid))
+				if err != nil {
+					indexIterator.Close()
+					return errorResponse(puid, fmt.Errorf("Failed to get product:%s", err))
+				}
+				if productAsBytes != nil {
+					p := product{}
+					if decodeProduct(puid, productAsBytes, &p) != nil {
+						corrupt[puid] = true
+					} else {
+						indexKeys, err := productIndexKeys(stub, &p)
+						if err != nil {
+							indexIterator.Close()
+							return errorResponse(puid, err)
+						}
+						keys = map[string]bool{}
+						for _, indexKey := range indexKeys {
+							keys[indexKey] = true
+						}
+					}
+				}
+				expectedKeys[puid] = keys
+			}
+			switch {
+			case corrupt[puid]:
+				problem("corruptProduct", "Product %s can't be decoded", puid)
+			case keys == nil:
+				problem("orphaned", "Product %s does not exist", puid)
+			case !keys[responseRange.Key]:
+				problem("mismatch", "Product %s is not indexed under this key", puid)
+			}
+		}
+		indexIterator.Close()
+	}
+
+	reportJSONasBytes, err := json.Marshal(struct {
+		Checked    int            `json:"checked"`
+		Consistent bool           `json:"consistent"`
+		Problems   []indexProblem `json:"problems"`
+	}{checked, len(problems) == 0, problems})
+	if err != nil {
+		return errorResponse("", err)
+	}
+	fmt.Printf("- end verifyIndexIntegrity: %d problems in %d entries\n", len(problems), checked)
+	return shim.Success(reportJSONasBytes)
+}
+
+// ===========================================================================
+// exportProducts - dump every product record as a JSON array of {"Key","Record"},
+// e.g. for migrations and audits.
+// The range query with empty bounds covers simple keys only, but composite keys
+// (index entries, pending transfers) are still skipped explicitly, along with
+// anything whose docType isn't in allowedDocTypes, so only genuine records are
+// returned. This reads the whole product set in one go and can be expensive;
+// call it off the hot path.
+// ===========================================================================
+func (t *SimpleChaincode) exportProducts(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 0"))
+	}
+	fmt.Println("- start exportProducts")
+
+	resultsIterator, err := stub.GetStateByRange(productKeyRange(stub, "", ""))
+	if err != nil {
+		return errorResponse("", err)
+	}
+	defer resultsIterator.Close()
+
+	results := []QueryResult{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse("", err)
+		}
+		if strings.ContainsRune(queryResponse.Key, 0) {
+			continue // composite key
+		}
+		p := product{}
+		if json.Unmarshal(queryResponse.Value, &p) != nil || !isAllowedDocType(p.ObjectType) {
+			continue
+		}
+
+		results = append(results, QueryResult{queryResponse.Key, queryResponse.Value})
+	}
+
+	buffer, err := marshalQueryResults(results)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	fmt.Printf("- end exportProducts: %d products\n", len(results))
+	return shim.Success(buffer.Bytes())
+}
+
+// ===========================================================================
+// getProductsByRange - return the products whose puid lies in [startKey, endKey),
+// in puid order, as a JSON array of {"Key","Record"}. As with every Fabric range
+// query the start key is included and the end key is not; an empty endKey runs
+// to the last product and an empty startKey starts at the first. Composite keys
+// and records that aren't products are skipped. Works on every state database,
+// LevelDB included; see queryProductByRangePaginated to page through large ranges.
+// ===========================================================================
+func (t *SimpleChaincode) getProductsByRange(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0           1
+	// "startKey", "endKey"
+	if len(args) != 2 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 2"))
+	}
+
+	startKey := args[0]
+	endKey := args[1]
+	fmt.Println("- start getProductsByRange ", startKey, endKey)
+
+	buffer, err := getProductsInRange(stub, startKey, endKey)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	fmt.Printf("- getProductsByRange queryResult:\n%s\n", buffer.String())
+	return shim.Success(buffer.Bytes())
+}
+
+// ===========================================================================
+// getProductsByPrefix - return the products whose puid starts with prefix, in
+// puid order, as a JSON array of {"Key","Record"}, e.g. "ACME-2024-" for every
+// product ACME issued in 2024. The range scanned is [prefix, prefix+U+10FFFF):
+// puids are valid UTF-8 and U+10FFFF is the largest code point, so every puid
+// made of the prefix followed by anything sorts inside it, except ones that
+// continue with U+10FFFF itself, a noncharacter no real puid has.
+// A "prefix~" end key would instead miss puids continuing with a character
+// after '~'. Composite keys and records that aren't products are skipped.
+// ===========================================================================
+func (t *SimpleChaincode) getProductsByPrefix(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "prefix"
+	if len(args) != 1 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 1"))
+	}
+
+	prefix := args[0]
+	if len(prefix) <= 0 {
+		return errorResponse("", validationError("1st argument must be a non-empty string, use exportProducts to read every product"))
+	}
+	err := validatePuid(prefix)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	fmt.Println("- start getProductsByPrefix ", prefix)
+
+	buffer, err := getProductsInRange(stub, prefix, prefix+string(utf8.MaxRune))
+	if err != nil {
+		return errorResponse("", err)
+	}
+	fmt.Printf("- getProductsByPrefix queryResult:\n%s\n", buffer.String())
+	return shim.Success(buffer.Bytes())
+}
+
+// getProductsInRange builds the JSON array of {"Key","Record"} of the products
+// whose puid lies in [startKey, endKey), skipping composite keys and records
+// that aren't products
+func getProductsInRange(stub shim.ChaincodeStubInterface, startKey string, endKey string) (*bytes.Buffer, error) {
+	resultsIterator, err := stub.GetStateByRange(productKeyRange(stub, startKey, endKey))
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	results := []QueryResult{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		if strings.ContainsRune(queryResponse.Key, 0) {
+			continue // composite key
+		}
+		p := product{}
+		if json.Unmarshal(queryResponse.Value, &p) != nil || !isAllowedDocType(p.ObjectType) {
+			continue
+		}
+		results = append(results, QueryResult{queryResponse.Key, queryResponse.Value})
+	}
+	return marshalQueryResults(results)
+}
+
+// ===========================================================================
+// getProductsModifiedSince - return the products whose UpdatedAt is after the
+// given Unix timestamp (seconds), as a JSON array of {"Key","Record"} ordered by
+// UpdatedAt, oldest first, so periodic sync jobs can pick up only what changed.
+// UpdatedAt is stamped by every mutation, so no separate modified~ index is kept;
+// the products are found with a full range scan and sorted here. The cost grows
+// with the whole product set, not with the number of changes, so keep it off the
+// hot path. Archived products are included, since archiving is a change too;
+// deleted products leave no record and do not show up.
+// ===========================================================================
+func (t *SimpleChaincode) getProductsModifiedSince(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "sinceTimestamp"
+	if len(args) != 1 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 1"))
+	}
+	since, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return errorResponse("", validationError("1st argument must be a numeric string"))
+	}
+	fmt.Println("- start getProductsModifiedSince ", since)
+
+	resultsIterator, err := stub.GetStateByRange(productKeyRange(stub, "", ""))
+	if err != nil {
+		return errorResponse("", err)
+	}
+	defer resultsIterator.Close()
+
+	type modifiedProduct struct {
+		key       string
+		value     []byte
+		updatedAt int64
+	}
+	var modified []modifiedProduct
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse("", err)
+		}
+		p := product{}
+		if json.Unmarshal(queryResponse.Value, &p) != nil || !isAllowedDocType(p.ObjectType) {
+			continue
+		}
+		if p.UpdatedAt > since {
+			modified = append(modified, modifiedProduct{queryResponse.Key, queryResponse.Value, p.UpdatedAt})
+		}
+	}
+	// keys come back in order, so the stable sort keeps equal timestamps ordered by puid
+	sort.SliceStable(modified, func(i, j int) bool {
+		return modified[i].updatedAt < modified[j].updatedAt
+	})
+
+	results := make([]QueryResult, 0, len(modified))
+	for _, m := range modified {
+		results = append(results, QueryResult{m.key, m.value})
+	}
+
+	buffer, err := marshalQueryResults(results)
+	if err != nil {
+		return errorResponse("", err)
+	}
+
+	fmt.Printf("- end getProductsModifiedSince: %d products\n", len(modified))
+	return shim.Success(buffer.Bytes())
+}
+
+// ===========================================================================
+// getUntransferredProducts - return the products that never changed owner, as
+// a JSON array of {"Key","Record"}, to find dead stock. A product counts as
+// untransferred when its OwnerHistory is empty: every ownership change appends
+// the previous owner to it, including a change of the majority co-owner by
+// transferShare, and products split off from another start with an empty one.
+// Records written before OwnerHistory existed have none and so are included
+// even if they changed hands back then; getHistoryForProduct shows whether
+// they did. Like getExpiredProducts this is a full range scan, for periodic
+// sweeps. Archived products are left out unless includeArchived is true.
+// ===========================================================================
+func (t *SimpleChaincode) getUntransferredProducts(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// ["includeArchived"]
+	if len(args) > 1 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 0 or 1"))
+	}
+	includeArchived, err := parseIncludeArchived(args, 0)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	fmt.Println("- start getUntransferredProducts")
+
+	resultsIterator, err := stub.GetStateByRange(productKeyRange(stub, "", ""))
+	if err != nil {
+		return errorResponse("", err)
+	}
+	defer resultsIterator.Close()
+
+	results := []QueryResult{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse("", err)
+		}
+		p := product{}
+		if json.Unmarshal(queryResponse.Value, &p) != nil || !isAllowedDocType(p.ObjectType) {
+			continue
+		}
+		if len(p.OwnerHistory) > 0 || (p.Archived && !includeArchived) {
+			continue
+		}
+
+		results = append(results, QueryResult{queryResponse.Key, queryResponse.Value})
+	}
+
+	buffer, err := marshalQueryResults(results)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	fmt.Printf("- getUntransferredProducts queryResult:\n%s\n", buffer.String())
+	return shim.Success(buffer.Bytes())
+}
+
+// maxDuplicateScanProducts caps the number of products findDuplicateProducts
+// reads without a type filter
+const maxDuplicateScanProducts = 10000
+
+// duplicateGroup is a set of products found by findDuplicateProducts to share a signature
+type duplicateGroup struct {
+	Ptype        string   `json:"ptype"`
+	Pname        string   `json:"pname"`
+	Manufacturer string   `json:"manufacturer"`
+	Puids        []string `json:"puids"` //sorted
+}
+
+// ===========================================================================
+// findDuplicateProducts - group products by their pname, ptype and
+// manufacturer signature and return the groups with more than one member, as a
+// JSON array of {"ptype", "pname", "manufacturer", "puids"} ordered by
+// signature, for data-quality review. Names are unique within a type for new
+// products, so groups come from records older than that rule. Portions
+// created by splitProduct keep their source's signature on purpose; a product
+// whose ParentPuids names another member of its group is left out of it.
+// The cost is linear in the number of products read: with a ptype only the
+// type~name~puid index entries of that type and their records are read,
+// otherwise every product record is, and the scan fails past
+// maxDuplicateScanProducts, asking for a type filter. Archived products are
+// left out unless includeArchived is true.
+// ===========================================================================
+func (t *SimpleChaincode) findDuplicateProducts(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0 (optional)  1 (optional)
+	// "ptype",      "includeArchived"
+	if len(args) > 2 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 0 to 2"))
+	}
+	ptype := ""
+	if len(args) > 0 {
+		ptype = strings.ToLower(args[0])
+	}
+	includeArchived, err := parseIncludeArchived(args, 1)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	fmt.Println("- start findDuplicateProducts ", ptype, includeArchived)
+
+	// ==== Read the candidates ====
+	var candidates []QueryResult
+	if len(ptype) > 0 {
+		indexNames := []string{"type~name~puid"}
+		if includeArchived {
+			indexNames = append(indexNames, archivedIndexPrefix+"type~name~puid")
+		}
+		for _, indexName := range indexNames {
+			resultsIterator, err := stub.GetStateByPartialCompositeKey(indexName, []string{ptype})
+			if err != nil {
+				return errorResponse("", err)
+			}
+			found, err := collectProductsFromIndexIterator(stub, resultsIterator)
+			resultsIterator.Close()
+			if err != nil {
+				return errorResponse("", err)
+			}
+			candidates = append(candidates, found...)
+		}
+	} else {
+		resultsIterator, err := stub.GetStateByRange(productKeyRange(stub, "", ""))
+		if err != nil {
+			return errorResponse("", err)
+		}
+		defer resultsIterator.Close()
+		for resultsIterator.HasNext() {
+			queryResponse, err := resultsIterator.Next()
+			if err != nil {
+				return errorResponse("", err)
+			}
+			if strings.ContainsRune(queryResponse.Key, 0) {
+				continue // composite key
+			}
+			if len(candidates) == maxDuplicateScanProducts {
+				return errorResponse("", validationError("More than %d products to scan, pass a ptype to bound the search", maxDuplicateScanProducts))
+			}
+			candidates = append(candidates, QueryResult{queryResponse.Key, queryResponse.Value})
+		}
+	}
+
+	// ==== Group them by signature ====
+	groups := map[string]*duplicateGroup{}
+	parents := map[string][]string{}
+	for _, candidate := range candidates {
+		p := product{}
+		if json.Unmarshal(candidate.Record, &p) != nil || !isAllowedDocType(p.ObjectType) {
+			continue
+		}
+		if p.Archived && !includeArchived {
+			continue
+		}
+		signature := p.Ptype + "\x00" + p.Pname + "\x00" + p.Manufacturer
+		group, ok := groups[signature]
+		if !ok {
+			group = &duplicateGroup{Ptype: p.Ptype, Pname: p.Pname, Manufacturer: p.Manufacturer}
+			groups[signature] = group
+		}
+		group.Puids = append(group.Puids, p.Puid)
+		parents[p.Puid] = p.ParentPuids
+	}
+
+	// ==== Keep the groups with more than one product once split portions are left out ====
+	signatures := make([]string, 0, len(groups))
+	for signature := range groups {
+		signatures = append(signatures, signature)
+	}
+	sort.Strings(signatures)
+	duplicates := []duplicateGroup{}
+	for _, signature := range signatures {
+		group := groups[signature]
+		members := map[string]bool{}
+		for _, puid := range group.Puids {
+			members[puid] = true
+		}
+		puids := []string{}
+		for _, puid := range group.Puids {
+			split := false
+			for _, parent := range parents[puid] {
+				if members[parent] {
+					split = true
+					break
+				}
+			}
+			if !split {
+				puids = append(puids, puid)
+			}
+		}
+		if len(puids) < 2 {
+			continue
+		}
+		sort.Strings(puids)
+		group.Puids = puids
+		duplicates = append(duplicates, *group)
+	}
+
+	duplicatesJSONasBytes, err := json.Marshal(duplicates)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	fmt.Printf("- end findDuplicateProducts: %d groups of %d products\n", len(duplicates), len(candidates))
+	return shim.Success(duplicatesJSONasBytes)
+}
+
+// ===========================================================================
+// getExpiredProducts - return the products whose ExpiryDate lies before the
+// transaction timestamp, as a JSON array of {"Key","Record"}.
+// Products are found with a full range scan and the dates compared here rather
+// than with a rich query: a numeric $lt selector would only work on CouchDB and
+// would need its own index on expiryDate, while the scan works on every state
+// database. It reads every product, so it is meant for periodic sweeps, not the
+// hot path. Archived products are left out unless includeArchived is true.
+// ===========================================================================
+func (t *SimpleChaincode) getExpiredProducts(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// ["includeArchived"]
+	if len(args) > 1 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 0 or 1"))
+	}
+	includeArchived, err := parseIncludeArchived(args, 0)
+	if err != nil {
+		return errorResponse("", err)
+	}
+
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return errorResponse("", err)
+	}
+	fmt.Println("- start getExpiredProducts ", txTimestamp.Seconds)
+
+	resultsIterator, err := stub.GetStateByRange(productKeyRange(stub, "", ""))
+	if err != nil {
+		return errorResponse("", err)
+	}
+	defer resultsIterator.Close()
+
+	results := []QueryResult{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse("", err)
+		}
+		p := product{}
+		if json.Unmarshal(queryResponse.Value, &p) != nil || !isAllowedDocType(p.ObjectType) {
+			continue
+		}
+		if p.ExpiryDate == 0 || p.ExpiryDate >= txTimestamp.Seconds || (p.Archived && !includeArchived) {
+			continue
+		}
+
+		results = append(results, QueryResult{queryResponse.Key, queryResponse.Value})
+	}
+
+	buffer, err := marshalQueryResults(results)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	fmt.Printf("- getExpiredProducts queryResult:\n%s\n", buffer.String())
+	return shim.Success(buffer.Bytes())
+}
+
+// ===========================================================================
+// proposeTransfer - first phase of a two-phase transfer. The current owner
+// proposes a new owner; nothing changes until the recipient calls acceptTransfer.
+// A product can have only one pending transfer at a time. The proposer's MSP is
+// recorded as the counterparty of a high-value transfer, see requireCoEndorsement.
+// ===========================================================================
+func (t *SimpleChaincode) proposeTransfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0         1
+	// "puid", "newOwner"
+	if len(args) != 2 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 2"))
+	}
+
+	puid := args[0]
+	newOwner := args[1]
+	if len(newOwner) <= 0 {
+		return errorResponse(puid, validationError("2nd argument must be a non-empty string"))
+	}
+	fmt.Println("- start proposeTransfer ", puid, newOwner)
+
+	productAsBytes, err := stub.GetState(productKey(stub, puid))
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to get product:%s", err))
+	} else if productAsBytes == nil {
+		return errorResponse(puid, notFoundError("Product does not exist"))
+	}
+	productToTransfer := product{}
+	err = json.Unmarshal(productAsBytes, &productToTransfer) //unmarshal it aka JSON.parse()
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	// ==== Only the current owner (or a regulator) may propose ====
+	err = assertOwnerOrRegulator(stub, productToTransfer.Owner)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = assertTransferable(&productToTransfer)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = assertNotOwner(&productToTransfer, newOwner)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	pendingKey, err := stub.CreateCompositeKey("pendingTransfer~puid", []string{puid})
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	pendingAsBytes, err := stub.GetState(pendingKey)
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to get pending transfer:%s", err))
+	} else if pendingAsBytes != nil {
+		return errorResponse(puid, conflictError("This product already has a pending transfer: %s", puid))
+	}
+
+	fromMSP, err := cid.GetMSPID(stub)
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to get caller MSP: %s", err))
+	}
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	pending := pendingTransfer{"pendingTransfer", puid, productToTransfer.Owner, newOwner, txTimestamp.Seconds, fromMSP}
+	pendingJSONasBytes, _ := json.Marshal(pending)
+	err = stub.PutState(pendingKey, pendingJSONasBytes)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	fmt.Println("- end proposeTransfer (success)")
+	return shim.Success(pendingJSONasBytes)
+}
+
+// ===========================================================================
+// acceptTransfer - second phase of a two-phase transfer. Must be submitted by
+// the proposed recipient, verified through the client identity.
+// ===========================================================================
+func (t *SimpleChaincode) acceptTransfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "puid"
+	if len(args) != 1 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 1"))
+	}
+
+	puid := args[0]
+	fmt.Println("- start acceptTransfer ", puid)
+
+	pendingKey, pending, err := getPendingTransfer(stub, puid)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	callerID, err := cid.GetID(stub)
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to get caller identity: %s", err))
+	}
+	if callerID != pending.To {
+		return errorResponse(puid, forbiddenError("Only the proposed recipient may accept this transfer: %s", pending.To))
+	}
+
+	productAsBytes, err := stub.GetState(productKey(stub, puid))
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to get product:%s", err))
+	} else if productAsBytes == nil {
+		return errorResponse(puid, notFoundError("Product does not exist"))
+	}
+	productToTransfer := product{}
+	err = json.Unmarshal(productAsBytes, &productToTransfer) //unmarshal it aka JSON.parse()
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	beforeTransfer := productToTransfer
+	if productToTransfer.Owner != pending.From {
+		return errorResponse(puid, conflictError("Product owner changed since the transfer was proposed"))
+	}
+
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = assertPendingMSP(pending, &productToTransfer)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = moveProductToOwner(stub, &productToTransfer, pending.To, pending.FromMSP, txTimestamp.Seconds)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = stub.DelState(pendingKey)
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to delete state:%s", err))
+	}
+
+	// ==== Notify subscribers of the ownership change ====
+	changed, err := productDiff(&beforeTransfer, &productToTransfer)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	eventJSONasBytes, err := json.Marshal(transferEvent{puid, pending.From, pending.To, txTimestamp.Seconds, productToTransfer.LastModifiedBy, stub.GetTxID(), changed})
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = stub.SetEvent(productTransferredEvent, eventJSONasBytes)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	fmt.Println("- end acceptTransfer (success)")
+	return shim.Success(nil)
+}
+
+// ===========================================================================
+// rejectTransfer - drop a pending transfer. The proposed recipient may reject
+// it and the owner who proposed it may cancel it.
+// ===========================================================================
+func (t *SimpleChaincode) rejectTransfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "puid"
+	if len(args) != 1 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 1"))
+	}
+
+	puid := args[0]
+	fmt.Println("- start rejectTransfer ", puid)
+
+	pendingKey, pending, err := getPendingTransfer(stub, puid)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	callerID, err := cid.GetID(stub)
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to get caller identity: %s", err))
+	}
+	if callerID != pending.To && callerID != pending.From {
+		return errorResponse(puid, forbiddenError("Only the proposing owner or the proposed recipient may reject this transfer"))
+	}
+
+	err = stub.DelState(pendingKey)
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to delete state:%s", err))
+	}
+
+	fmt.Println("- end rejectTransfer (success)")
+	return shim.Success(nil)
+}
+
+// ===========================================================================
+// swapProducts - exchange the owners of two products in one transaction, so
+// neither changes hands without the other. The caller must own puidA, and the
+// owner of puidB consents by first proposing the transfer of puidB to the
+// caller with proposeTransfer; the swap consumes that proposal. Every check is
+// made before the first write, and any failure leaves both products untouched.
+// ===========================================================================
+func (t *SimpleChaincode) swapProducts(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0         1
+	// "puidA", "puidB"
+	if len(args) != 2 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 2"))
+	}
+
+	puidA := args[0]
+	puidB := args[1]
+	if puidA == puidB {
+		return errorResponse(puidA, validationError("Cannot swap a product with itself"))
+	}
+	fmt.Println("- start swapProducts ", puidA, puidB)
+
+	products := make([]product, 2)
+	for i, puid := range []string{puidA, puidB} {
+		productAsBytes, err := stub.GetState(productKey(stub, puid))
+		if err != nil {
+			return errorResponse(puidA, fmt.Errorf("Failed to get product:%s", err))
+		} else if productAsBytes == nil {
+			return errorResponse(puidA, notFoundError("Product does not exist: %s", puid))
+		}
+		err = json.Unmarshal(productAsBytes, &products[i]) //unmarshal it aka JSON.parse()
+		if err != nil {
+			return errorResponse(puidA, err)
+		}
+		err = assertTransferable(&products[i])
+		if err != nil {
+			return errorResponse(puidA, err)
+		}
+	}
+	productA, productB := &products[0], &products[1]
+	ownerA, ownerB := productA.Owner, productB.Owner
+	if ownerA == ownerB {
+		return errorResponse(puidA, conflictError("Both products are owned by %s", ownerA))
+	}
+
+	// ==== The caller gives puidA, the owner of puidB agreed to give it back ====
+	err := assertOwnerOrRegulator(stub, ownerA)
+	if err != nil {
+		return errorResponse(puidA, err)
+	}
+	pendingKey, pending, err := getPendingTransfer(stub, puidB)
+	if err != nil {
+		return errorResponse(puidA, err)
+	}
+	if pending.From != ownerB || pending.To != ownerA {
+		return errorResponse(puidA, conflictError("The pending transfer of %s is not from %s to %s", puidB, ownerB, ownerA))
+	}
+
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return errorResponse(puidA, err)
+	}
+	for _, p := range products {
+		err = assertPendingMSP(pending, &p)
+		if err != nil {
+			return errorResponse(puidA, err)
+		}
+	}
+	err = moveProductToOwner(stub, productA, ownerB, pending.FromMSP, txTimestamp.Seconds)
+	if err != nil {
+		return errorResponse(puidA, err)
+	}
+	err = moveProductToOwner(stub, productB, ownerA, pending.FromMSP, txTimestamp.Seconds)
+	if err != nil {
+		return errorResponse(puidA, err)
+	}
+	err = stub.DelState(pendingKey)
+	if err != nil {
+		return errorResponse(puidA, fmt.Errorf("Failed to delete state:%s", err))
+	}
+
+	eventJSONasBytes, err := json.Marshal(swapEvent{puidA, puidB, ownerA, ownerB, txTimestamp.Seconds, stub.GetTxID()})
+	if err != nil {
+		return errorResponse(puidA, err)
+	}
+	err = stub.SetEvent(productsSwappedEvent, eventJSONasBytes)
+	if err != nil {
+		return errorResponse(puidA, err)
+	}
+
+	fmt.Println("- end swapProducts (success)")
+	return shim.Success(eventJSONasBytes)
+}
+
+// assertPendingMSP checks that a pending transfer recorded the proposer's MSP
+// when the product it moves needs it for requireCoEndorsement
+func assertPendingMSP(pending *pendingTransfer, product *product) error {
+	if product.Price > highValueThreshold && len(pending.FromMSP) <= 0 {
+		return conflictError("Product %s is priced above %d and the pending transfer of %s predates recording the proposer's MSP, it must be proposed again", product.Puid, highValueThreshold, pending.Puid)
+	}
+	return nil
+}
+
+// getPendingTransfer reads the pending transfer of a product and returns it with its state key
+func getPendingTransfer(stub shim.ChaincodeStubInterface, puid string) (string, *pendingTransfer, error) {
+	pendingKey, err := stub.CreateCompositeKey("pendingTransfer~puid", []string{puid})
+	if err != nil {
+		return "", nil, err
+	}
+	pendingAsBytes, err := stub.GetState(pendingKey)
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed to get pending transfer: %s", err)
+	} else if pendingAsBytes == nil {
+		return "", nil, notFoundError("No pending transfer for product: %s", puid)
+	}
+	pending := pendingTransfer{}
+	err = json.Unmarshal(pendingAsBytes, &pending)
+	if err != nil {
+		return "", nil, err
+	}
+	return pendingKey, &pending, nil
+}
+
+// sameEscrow reports whether two escrow holds, either of which may be nil, are equal
+func sameEscrow(a *escrowHold, b *escrowHold) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// escrowOwnerPrefix starts the owner of a product held in escrow, followed by the agent
+const escrowOwnerPrefix = "escrow:"
+
+// ===========================================================================
+// escrowProduct - hand a product to an escrow agent for a conditional sale. The
+// product's owner becomes escrowOwnerPrefix followed by the agent and its
+// Escrow records the original owner and the intended recipient, so the agent
+// can later either release it to the recipient or cancel and return it. Only
+// the owner (or a regulator) may escrow a product, with the same checks as a
+// transfer to the recipient. While in escrow the product cannot be transferred
+// any other way. Both moves show up in OwnerHistory like any other transfer.
+// ===========================================================================
+func (t *SimpleChaincode) escrowProduct(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0         1        2            3 (optional)
+	// "puid", "agent", "recipient", "expectedVersion"
+	if len(args) != 3 && len(args) != 4 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 3 or 4"))
+	}
+
+	puid := args[0]
+	agent := args[1]
+	recipient := args[2]
+	if len(agent) <= 0 || len(recipient) <= 0 {
+		return errorResponse(puid, validationError("Agent and recipient must be non-empty strings"))
+	}
+	fmt.Println("- start escrowProduct ", puid, agent, recipient)
+
+	productToEscrow, err := readProductForEscrow(stub, puid, args, 3)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = assertOwnerOrRegulator(stub, productToEscrow.Owner)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	// ==== The same checks as moving the product to the recipient ====
+	err = assertTransferable(productToEscrow)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = assertNotOwner(productToEscrow, recipient)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = assertRegisteredOwner(stub, recipient)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = assertCooledDown(stub, productToEscrow, txTimestamp.Seconds)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	productToEscrow.Escrow = &escrowHold{agent, productToEscrow.Owner, recipient, txTimestamp.Seconds}
+	err = reassignOwner(stub, productToEscrow, escrowOwnerPrefix+agent, txTimestamp.Seconds)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	return escrowResponse(stub, productEscrowedEvent, productToEscrow, productToEscrow.Escrow, txTimestamp.Seconds)
+}
+
+// ===========================================================================
+// releaseEscrow - complete an escrow, giving the product to the recipient named
+// by escrowProduct. Only the escrow agent may release, checked against the
+// submitting client identity. The product must still be transferable apart
+// from being in escrow, e.g. not recalled meanwhile, and, when priced above
+// highValueThreshold, recipientMSP is required as for transferProduct.
+// ===========================================================================
+func (t *SimpleChaincode) releaseEscrow(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0         1 (optional)        2 (optional)
+	// "puid", "expectedVersion", "recipientMSP"
+	if len(args) < 1 || len(args) > 3 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 1 to 3"))
+	}
+
+	puid := args[0]
+	fmt.Println("- start releaseEscrow ", puid)
+
+	escrowed, hold, err := readEscrowForAgent(stub, puid, args)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	escrowed.Escrow = nil
+	err = assertTransferable(escrowed)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = assertRegisteredOwner(stub, hold.Recipient)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = reassignOwner(stub, escrowed, hold.Recipient, txTimestamp.Seconds)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	recipientMSP := ""
+	if len(args) > 2 {
+		recipientMSP = args[2]
+	}
+	err = requireCoEndorsement(stub, escrowed, recipientMSP)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	return escrowResponse(stub, escrowReleasedEvent, escrowed, hold, txTimestamp.Seconds)
+}
+
+// ===========================================================================
+// cancelEscrow - end an escrow without completing it, giving the product back
+// to its original owner. Only the escrow agent may cancel, checked against the
+// submitting client identity. Returning a product is always allowed, even one
+// recalled or archived while in escrow.
+// ===========================================================================
+func (t *SimpleChaincode) cancelEscrow(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0         1 (optional)
+	// "puid", "expectedVersion"
+	if len(args) != 1 && len(args) != 2 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 1 or 2"))
+	}
+
+	puid := args[0]
+	fmt.Println("- start cancelEscrow ", puid)
+
+	escrowed, hold, err := readEscrowForAgent(stub, puid, args)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	escrowed.Escrow = nil
+	err = reassignOwner(stub, escrowed, hold.OriginalOwner, txTimestamp.Seconds)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	return escrowResponse(stub, escrowCancelledEvent, escrowed, hold, txTimestamp.Seconds)
+}
+
+// readProductForEscrow reads puid and checks the optional expected version at args[versionPos]
+func readProductForEscrow(stub shim.ChaincodeStubInterface, puid string, args []string, versionPos int) (*product, error) {
+	productAsBytes, err := stub.GetState(productKey(stub, puid))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get product:%s", err)
+	} else if productAsBytes == nil {
+		return nil, notFoundError("Product does not exist: %s", puid)
+	}
+	p := product{}
+	err = decodeProduct(puid, productAsBytes, &p)
+	if err != nil {
+		return nil, err
+	}
+	err = checkVersion(&p, args, versionPos)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// readEscrowForAgent reads a product in escrow, checking the optional expected
+// version at args[1] and that the submitting identity is its escrow agent
+func readEscrowForAgent(stub shim.ChaincodeStubInterface, puid string, args []string) (*product, *escrowHold, error) {
+	escrowed, err := readProductForEscrow(stub, puid, args, 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	hold := escrowed.Escrow
+	if hold == nil {
+		return nil, nil, conflictError("Product %s is not in escrow", puid)
+	}
+	callerID, err := cid.GetID(stub)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to get caller identity: %s", err)
+	}
+	if callerID != hold.Agent {
+		return nil, nil, forbiddenError("Caller is not the escrow agent of %s", puid)
+	}
+	return escrowed, hold, nil
+}
+
+// escrowResponse emits an escrow event for the product and returns the product
+func escrowResponse(stub shim.ChaincodeStubInterface, eventName string, p *product, hold *escrowHold, timestamp int64) pb.Response {
+	eventJSONasBytes, err := json.Marshal(escrowEvent{p.Puid, hold.Agent, hold.OriginalOwner, hold.Recipient, p.Owner, timestamp, stub.GetTxID()})
+	if err != nil {
+		return errorResponse(p.Puid, err)
+	}
+	err = stub.SetEvent(eventName, eventJSONasBytes)
+	if err != nil {
+		return errorResponse(p.Puid, err)
+	}
+	productJSONasBytes, err := marshalProduct(p)
+	if err != nil {
+		return errorResponse(p.Puid, err)
+	}
+	fmt.Println("- end " + eventName + " " + p.Puid)
+	return shim.Success(productJSONasBytes)
+}
+
+// ===========================================================================
+// sellProduct - transfer a product and record the sale price and currency on
+// it, so every sale shows up in the product's history. Use transferProduct for
+// moves without a price, such as gifts or internal transfers.
+// ===========================================================================
+func (t *SimpleChaincode) sellProduct(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0         1           2        3           4 (optional)        5 (optional)
+	// "puid", "newOwner", "price", "currency", "expectedVersion", "buyerMSP"
+	// buyerMSP is required for sales above highValueThreshold, see requireCoEndorsement.
+	if len(args) < 4 || len(args) > 6 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 4 to 6"))
+	}
+
+	puid := args[0]
+	newOwner := args[1]
+	price, err := strconv.ParseFloat(args[2], 64)
+	if err != nil {
+		return errorResponse(puid, validationError("3rd argument must be a numeric string"))
+	}
+	if math.IsNaN(price) || math.IsInf(price, 0) || price < 0 {
+		return errorResponse(puid, validationError("3rd argument must be a non-negative number"))
+	}
+	currency := strings.ToUpper(args[3])
+	if !allowedCurrencies[currency] {
+		return errorResponse(puid, validationError("Unsupported currency: %s", currency))
+	}
+	fmt.Println("- start sellProduct ", puid, newOwner, price, currency)
+
+	productAsBytes, err := stub.GetState(productKey(stub, puid))
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to get product:%s", err))
+	} else if productAsBytes == nil {
+		return errorResponse(puid, notFoundError("Product does not exist"))
+	}
+
+	productToSell := product{}
+	err = json.Unmarshal(productAsBytes, &productToSell) //unmarshal it aka JSON.parse()
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = checkVersion(&productToSell, args, 4)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	// ==== Only the current owner (or a regulator) may sell ====
+	err = assertOwnerOrRegulator(stub, productToSell.Owner)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	previousOwner := productToSell.Owner
+	productToSell.Price = price
+	productToSell.Currency = currency
+	buyerMSP := ""
+	if len(args) > 5 {
+		buyerMSP = args[5]
+	}
+	err = moveProductToOwner(stub, &productToSell, newOwner, buyerMSP, txTimestamp.Seconds)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	eventJSONasBytes, err := json.Marshal(saleEvent{puid, previousOwner, newOwner, price, currency, txTimestamp.Seconds})
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = stub.SetEvent(productSoldEvent, eventJSONasBytes)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+
+	fmt.Println("- end sellProduct (success)")
+	return shim.Success(nil)
+}
+
+//getHistoryForProdcut
+
+func (t *SimpleChaincode) queryProduct(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0              1 (optional)  2 (optional)
+	// "queryString", "limit",      "puid,pname,owner"
+	if len(args) < 1 || len(args) > 3 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 1 to 3"))
+	}
+
+	queryString := args[0]
+	err := validateQueryString(queryString)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	fields, err := parseProjection(args, 2)
+	if err != nil {
+		return errorResponse("", err)
+	}
+
+	// ==== With a limit, return at most that many records and say whether more matched ====
+	if len(args) > 1 && len(args[1]) > 0 {
+		limit, err := strconv.Atoi(args[1])
+		if err != nil || limit < 0 {
+			return errorResponse("", validationError("2nd argument must be a non-negative numeric string"))
+		}
+		if limit > maxQueryResults {
+			return errorResponse("", validationError("Limit must be at most %d, please paginate with queryProductWithPagination", maxQueryResults))
+		}
+		if limit > 0 {
+			queryResults, err := getQueryResultForQueryStringWithLimit(stub, queryString, limit, fields)
+			if err != nil {
+				return errorResponse("", err)
+			}
+			return shim.Success(queryResults)
+		}
+	}
+
+	queryResults, err := getQueryResultForQueryString(stub, queryString, fields)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	return shim.Success(queryResults)
+}
+
+// validateQueryString checks that an ad hoc query string is a JSON object with a
+// top-level "selector" object before it goes to the state database, whose own
+// error for a malformed query is hard to make sense of
+func validateQueryString(queryString string) error {
+	if len(strings.TrimSpace(queryString)) == 0 {
+		return validationError("Query string must not be empty")
+	}
+	var query map[string]interface{}
+	err := json.Unmarshal([]byte(queryString), &query)
+	if err != nil {
+		return validationError("Query string must be a JSON object, e.g. {\"selector\":{\"owner\":\"tom\"}}: %s", err)
+	}
+	selector, ok := query["selector"]
+	if !ok {
+		return validationError("Query string must have a top-level \"selector\"")
+	}
+	if _, ok := selector.(map[string]interface{}); !ok {
+		return validationError("Query \"selector\" must be a JSON object")
+	}
+	return nil
+}
+
+// CouchDB index definitions for the rich query selectors, as deployed from the
+// chaincode's META-INF/statedb/couchdb/indexes directory (metadata/statedb/couchdb/indexes
+// in this source tree). Without the index a selector on the field makes CouchDB scan every
+// document. getRecommendedIndexes returns them for deployment tooling.
+const (
+	IndexOwner  = `{"index":{"fields":["docType","owner"]},"ddoc":"indexOwnerDoc", "name":"indexOwner","type":"json"}`
+	IndexType   = `{"index":{"fields":["docType","ptype"]},"ddoc":"indexTypeDoc", "name":"indexType","type":"json"}`
+	IndexStatus = `{"index":{"fields":["docType","status"]},"ddoc":"indexStatusDoc", "name":"indexStatus","type":"json"}`
+)
+
+// recommendedIndexes maps each index definition to the file it is deployed as
+var recommendedIndexes = []struct {
+	File       string
+	Definition string
+}{
+	{"indexOwner.json", IndexOwner},
+	{"indexType.json", IndexType},
+	{"indexStatus.json", IndexStatus},
+}
+
+// ===========================================================================
+// getRecommendedIndexes - return the CouchDB indexes the rich queries need, as
+// [{"file": "indexOwner.json", "definition": {...}}, ...], so deployment tooling
+// can install them into META-INF/statedb/couchdb/indexes
+// ===========================================================================
+func (t *SimpleChaincode) getRecommendedIndexes(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 0"))
+	}
+
+	type indexFile struct {
+		File       string          `json:"file"`
+		Definition json.RawMessage `json:"definition"`
+	}
+	indexes := []indexFile{}
+	for _, index := range recommendedIndexes {
+		if !json.Valid([]byte(index.Definition)) {
+			return errorResponse("", fmt.Errorf("Index definition %s is not valid JSON", index.File))
+		}
+		indexes = append(indexes, indexFile{index.File, json.RawMessage(index.Definition)})
+	}
+	indexesJSONasBytes, err := json.Marshal(indexes)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	return shim.Success(indexesJSONasBytes)
+}
+
+// ===== Example: Parameterized rich query =================================================
+// queryProductByField queries for products whose field equals the passed in value.
+// The Mango selector is built here with json.Marshal, so clients don't hand-craft query
+// JSON and values can't break out of the selector.
+// Selecting by owner uses IndexOwner, by ptype IndexType and by status IndexStatus when
+// they are deployed.
+// Only available on state databases that support rich query (e.g. CouchDB)
+// Archived products are left out unless the optional includeArchived argument is true.
+// The optional docType selects the entity kind to search, "product" by default.
+// =========================================================================================
+func (t *SimpleChaincode) queryProductByField(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0        1       2                    3
+	// "owner", "bob", ["includeArchived"], ["docType"]
+	if len(args) < 2 || len(args) > 4 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 2 to 4"))
+	}
+
+	field := args[0]
+	value := queryFieldValue(field, args[1])
+	if !isQueryableField(field) {
+		return errorResponse("", validationError("Unknown field: %s, allowed fields: %v", field, queryableFields))
+	}
+	includeArchived, err := parseIncludeArchived(args, 2)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	docType, err := parseDocType(args, 3)
+	if err != nil {
+		return errorResponse("", err)
+	}
+
+	queryString, err := buildSelectorQuery(docType, field, value, includeArchived)
+	if err != nil {
+		return errorResponse("", err)
+	}
+
+	queryResults, err := getQueryResultForQueryString(stub, queryString, nil)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	return shim.Success(queryResults)
+}
+
+// defaultDocType is the docType of records created without one
+const defaultDocType = "product"
+
+// allowedDocTypes are the entity kinds this chaincode manages. They share the
+// product record layout and composite indexes; rich queries are scoped by docType.
+var allowedDocTypes = []string{"product", "component", "shipment"}
+
+// isAllowedDocType reports whether docType is listed in allowedDocTypes
+func isAllowedDocType(docType string) bool {
+	for _, allowed := range allowedDocTypes {
+		if allowed == docType {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDocType reads the optional docType at args[pos]. A missing or empty
+// argument means defaultDocType.
+func parseDocType(args []string, pos int) (string, error) {
+	if len(args) <= pos || len(args[pos]) == 0 {
+		return defaultDocType, nil
+	}
+	docType := strings.ToLower(args[pos])
+	if !isAllowedDocType(docType) {
+		return "", validationError("Unknown docType: %s, allowed docTypes: %v", docType, allowedDocTypes)
+	}
+	return docType, nil
+}
+
+// queryableFields are the product fields queryProductByField accepts
+var queryableFields = []string{"owner", "ptype", "pname", "status"}
+
+// queryFieldValue returns value as it is stored in field: lowercased, except
+// for owners, which are client identities and keep their case
+func queryFieldValue(field string, value string) string {
+	if field == "owner" {
+		return value
+	}
+	return strings.ToLower(value)
+}
+
+// isQueryableField reports whether field is listed in queryableFields
+func isQueryableField(field string) bool {
+	for _, allowed := range queryableFields {
+		if allowed == field {
+			return true
+		}
+	}
+	return false
+}
+
+// buildSelectorQuery returns {"selector":{"docType":"<docType>","<field>":"<value>"}}
+// with archived products excluded unless includeArchived is set
+func buildSelectorQuery(docType string, field string, value string, includeArchived bool) (string, error) {
+	query := map[string]interface{}{
+		"selector": productSelector(docType, field, value, includeArchived),
+	}
+	queryAsBytes, err := json.Marshal(query)
+	if err != nil {
+		return "", err
+	}
+	return string(queryAsBytes), nil
+}
+
+// ===== Example: Parameterized rich query with sort =======================================
+// queryProductSorted queries for products whose field equals the passed in value, ordered
+// by sortField in the given direction ("asc" or "desc").
+// CouchDB can only sort on indexed fields, so an index covering the selector fields and the
+// sort field must be deployed under META-INF/statedb/couchdb/indexes, for example to select
+// by owner and sort by pname:
+//
+//	{"index":{"fields":["docType","owner","pname"]},"ddoc":"indexOwnerNameDoc", "name":"indexOwnerName","type":"json"}
+//
+// Without a matching index the query fails with a "no index exists for this sort" error.
+// Only available on state databases that support rich query (e.g. CouchDB)
+// Archived products are left out unless the optional includeArchived argument is true.
+// The optional docType selects the entity kind to search, "product" by default.
+// =========================================================================================
+func (t *SimpleChaincode) queryProductSorted(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0        1        2          3       4                    5
+	// "owner", "bob", "pname", "asc", ["includeArchived"], ["docType"]
+	if len(args) < 4 || len(args) > 6 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 4 to 6"))
+	}
+
+	field := args[0]
+	value := queryFieldValue(field, args[1])
+	sortField := args[2]
+	direction := strings.ToLower(args[3])
+	if !isQueryableField(field) {
+		return errorResponse("", validationError("Unknown field: %s, allowed fields: %v", field, queryableFields))
+	}
+	if !isSortableField(sortField) {
+		return errorResponse("", validationError("Unknown sort field: %s, allowed fields: %v", sortField, sortableFields))
+	}
+	if direction != "asc" && direction != "desc" {
+		return errorResponse("", validationError("Sort direction must be asc or desc"))
+	}
+	includeArchived, err := parseIncludeArchived(args, 4)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	docType, err := parseDocType(args, 5)
+	if err != nil {
+		return errorResponse("", err)
+	}
+
+	queryAsBytes, err := json.Marshal(struct {
+		Selector map[string]interface{} `json:"selector"`
+		Sort     []map[string]string    `json:"sort"`
+	}{
+		productSelector(docType, field, value, includeArchived),
+		[]map[string]string{{sortField: direction}},
+	})
+	if err != nil {
+		return errorResponse("", err)
+	}
+
+	queryResults, err := getQueryResultForQueryString(stub, string(queryAsBytes), nil)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	return shim.Success(queryResults)
+}
+
+// productSelector matches records of the given docType whose field equals value.
+// Archived records are left out unless includeArchived is set; records written
+// before the archived field existed have no such field and still match.
+func productSelector(docType string, field string, value string, includeArchived bool) map[string]interface{} {
+	selector := map[string]interface{}{
+		"docType": docType,
+		field:     value,
+	}
+	if !includeArchived {
+		selector["archived"] = map[string]bool{"$ne": true}
+	}
+	return selector
+}
+
+// sortableFields are the product fields queryProductSorted can order by
+var sortableFields = []string{"owner", "ptype", "pname", "quantity", "createdAt", "updatedAt"}
+
+// isSortableField reports whether field is listed in sortableFields
+func isSortableField(field string) bool {
+	for _, allowed := range sortableFields {
+		if allowed == field {
+			return true
+		}
+	}
+	return false
+}
+
+// maxQueryResults caps the number of records an unpaginated rich query may return.
+// Fabric returns the whole response as one payload, so larger result sets must be
+// fetched page by page with queryProductWithPagination.
+const maxQueryResults = 1000
+
+// =========================================================================================
+// getQueryResultForQueryString executes the passed in query string.
+// Result set is built and returned as a byte array containing the JSON results.
+// A query matching more than maxQueryResults records fails rather than building an
+// unbounded response.
+// =========================================================================================
+func getQueryResultForQueryString(stub shim.ChaincodeStubInterface, queryString string, fields []string) ([]byte, error) {
+
+	fmt.Printf("- getQueryResultForQueryString queryString:\n%s\n", queryString)
+
+	resultsIterator, err := stub.GetQueryResult(queryString)
+	if err != nil {
+		return nil, richQueryError(err)
+	}
+	defer resultsIterator.Close()
+
+	buffer, truncated, err := constructQueryResponseFromIteratorWithLimit(resultsIterator, maxQueryResults, fields)
+	if err != nil {
+		return nil, err
+	}
+	if truncated {
+		return nil, validationError("Result set too large, more than %d records match, please paginate with queryProductWithPagination", maxQueryResults)
+	}
+
+	fmt.Printf("- getQueryResultForQueryString queryResult:\n%s\n", buffer.String())
+
+	return buffer.Bytes(), nil
+}
+
+// =========================================================================================
+// getQueryResultForQueryStringWithLimit executes the passed in query string and returns
+// at most limit records as {"Records":[...], "truncated": true|false}, where truncated
+// tells whether further records matched.
+// =========================================================================================
+func getQueryResultForQueryStringWithLimit(stub shim.ChaincodeStubInterface, queryString string, limit int, fields []string) ([]byte, error) {
+
+	fmt.Printf("- getQueryResultForQueryStringWithLimit queryString:\n%s\n", queryString)
+
+	resultsIterator, err := stub.GetQueryResult(queryString)
+	if err != nil {
+		return nil, richQueryError(err)
+	}
+	defer resultsIterator.Close()
+
+	buffer, truncated, err := constructQueryResponseFromIteratorWithLimit(resultsIterator, limit, fields)
+	if err != nil {
+		return nil, err
+	}
+
+	var wrapped bytes.Buffer
+	wrapped.WriteString("{\"Records\":")
+	wrapped.Write(buffer.Bytes())
+	wrapped.WriteString(", \"truncated\":")
+	wrapped.WriteString(strconv.FormatBool(truncated))
+	wrapped.WriteString("}")
+
+	fmt.Printf("- getQueryResultForQueryStringWithLimit queryResult:\n%s\n", wrapped.String())
+
+	return wrapped.Bytes(), nil
+}
+
+// =========================================================================================
+// constructQueryResponseFromIterator constructs a JSON array containing query results from
+// a given result iterator
+// =========================================================================================
+func constructQueryResponseFromIterator(resultsIterator shim.StateQueryIteratorInterface) (*bytes.Buffer, error) {
+	buffer, _, err := constructQueryResponseFromIteratorWithLimit(resultsIterator, 0, nil)
+	return buffer, err
+}
+
+// =========================================================================================
+// constructQueryResponseFromIteratorWithLimit is constructQueryResponseFromIterator
+// stopping after limit records (0 means no limit). It also reports whether the iterator
+// had records left when it stopped. With fields, each record is cut down to those
+// fields, see projectRecord. Each record is encoded into the response as it is read, so
+// only the response itself is held in memory, not a copy of every record as well.
+// =========================================================================================
+func constructQueryResponseFromIteratorWithLimit(resultsIterator shim.StateQueryIteratorInterface, limit int, fields []string) (*bytes.Buffer, bool, error) {
+	var buffer bytes.Buffer
+	count := 0
+	truncated := false
+	buffer.WriteString("[")
+	for resultsIterator.HasNext() {
+		if limit > 0 && count >= limit {
+			truncated = true
+			break
+		}
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, false, err
+		}
+		record := queryResponse.Value
+		if len(fields) > 0 {
+			record, err = projectRecord(record, fields)
+			if err != nil {
+				return nil, false, fmt.Errorf("Record for key %s: %s", queryResponse.Key, err)
+			}
+		}
+		err = writeQueryResult(&buffer, count, QueryResult{queryResponse.Key, record})
+		if err != nil {
+			return nil, false, err
+		}
+		count++
+	}
+	buffer.WriteString("]")
+	return &buffer, truncated, nil
+}
+
+// projectRecord returns a JSON object holding only the given fields of record.
+// Fields the record doesn't have are left out.
+func projectRecord(record []byte, fields []string) ([]byte, error) {
+	var all map[string]json.RawMessage
+	err := json.Unmarshal(record, &all)
+	if err != nil {
+		return nil, err
+	}
+	projected := make(map[string]json.RawMessage, len(fields))
+	for _, field := range fields {
+		if value, ok := all[field]; ok {
+			projected[field] = value
+		}
+	}
+	return json.Marshal(projected)
+}
+
+// productFieldNames lists the JSON field names of the product record
+func productFieldNames() []string {
+	productType := reflect.TypeOf(product{})
+	names := make([]string, 0, productType.NumField())
+	for i := 0; i < productType.NumField(); i++ {
+		name := strings.Split(productType.Field(i).Tag.Get("json"), ",")[0]
+		if len(name) > 0 && name != "-" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// parseProjection reads the optional comma-separated list of product fields at
+// args[pos]. A missing or empty argument means whole records.
+func parseProjection(args []string, pos int) ([]string, error) {
+	if len(args) <= pos || len(strings.TrimSpace(args[pos])) == 0 {
+		return nil, nil
+	}
+	known := productFieldNames()
+	var fields []string
+	for _, field := range strings.Split(args[pos], ",") {
+		field = strings.TrimSpace(field)
+		found := false
+		for _, name := range known {
+			if name == field {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, validationError("Unknown field: %s, allowed fields: %v", field, known)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// QueryResult is one member of the JSON arrays returned by queries: a state key
+// and the record stored under it
+type QueryResult struct {
+	Key    string          `json:"Key"`
+	Record json.RawMessage `json:"Record"`
+}
+
+// MarshalJSON writes {"Key":..., "Record":...} with the same layout the
+// hand-built query responses always had. The key is escaped properly and a
+// record that isn't valid JSON is an error rather than a broken response.
+func (r QueryResult) MarshalJSON() ([]byte, error) {
+	keyAsBytes, err := json.Marshal(r.Key)
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(r.Record) {
+		return nil, fmt.Errorf("Record for key %s is not valid JSON", r.Key)
+	}
+	var buffer bytes.Buffer
+	buffer.WriteString("{\"Key\":")
+	buffer.Write(keyAsBytes)
+	buffer.WriteString(", \"Record\":")
+	buffer.Write(r.Record)
+	buffer.WriteString("}")
+	return buffer.Bytes(), nil
+}
+
+// marshalQueryResults returns results as a JSON array. json.Marshal would compact
+// every member, so the members are joined here to keep the response byte for byte
+// what clients have been parsing.
+func marshalQueryResults(results []QueryResult) (*bytes.Buffer, error) {
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+	for i, result := range results {
+		err := writeQueryResult(&buffer, i, result)
+		if err != nil {
+			return nil, err
+		}
+	}
+	buffer.WriteString("]")
+	return &buffer, nil
+}
+
+// writeQueryResult appends result, the i-th member of a JSON array, to buffer.
+// A json.Encoder compacts what MarshalJSON returns just as json.Marshal does,
+// so the member is written directly.
+func writeQueryResult(buffer *bytes.Buffer, i int, result QueryResult) error {
+	resultAsBytes, err := result.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	// Add a comma before array members, suppress it for the first array member
+	if i > 0 {
+		buffer.WriteString(",")
+	}
+	buffer.Write(resultAsBytes)
+	return nil
+}
+
+// ===== Example: Pagination with Ad hoc Rich Query ========================================
+// queryProductWithPagination uses a query string, page size and a bookmark to perform a query
+// for products. Query string matching state database syntax is passed in and executed as is.
+// The number of fetched records would be equal to or lesser than the specified page size.
+// Only available on state databases that support rich query (e.g. CouchDB)
+// Paginated queries are only valid for read only transactions.
+// =========================================================================================
+func (t *SimpleChaincode) queryProductWithPagination(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0             1           2
+	// "queryString", "pageSize", "bookmark"
+	if len(args) != 3 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 3"))
+	}
+
+	queryString := args[0]
+	err := validateQueryString(queryString)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	pageSize, err := strconv.ParseInt(args[1], 10, 32)
+	if err != nil {
+		return errorResponse("", validationError("2nd argument must be a numeric string"))
+	}
+	bookmark := args[2]
+
+	queryResults, err := getQueryResultForQueryStringWithPagination(stub, queryString, int32(pageSize), bookmark)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	return shim.Success(queryResults)
+}
+
+// =========================================================================================
+// getQueryResultForQueryStringWithPagination executes the passed in query string with
+// pagination info. The response is a JSON object holding the Records array together with
+// the fetched record count and the bookmark to pass in for the next page.
+// =========================================================================================
+func getQueryResultForQueryStringWithPagination(stub shim.ChaincodeStubInterface, queryString string, pageSize int32, bookmark string) ([]byte, error) {
+
+	fmt.Printf("- getQueryResultForQueryStringWithPagination queryString:\n%s\n", queryString)
+
+	resultsIterator, responseMetadata, err := stub.GetQueryResultWithPagination(queryString, pageSize, bookmark)
+	if err != nil {
+		return nil, richQueryError(err)
+	}
+	defer resultsIterator.Close()
+
+	buffer, err := constructQueryResponseFromIterator(resultsIterator)
+	if err != nil {
+		return nil, err
+	}
+
+	bufferWithPaginationInfo := addPaginationMetadataToQueryResults(buffer, responseMetadata)
+
+	fmt.Printf("- getQueryResultForQueryStringWithPagination queryResult:\n%s\n", bufferWithPaginationInfo.String())
+
+	return bufferWithPaginationInfo.Bytes(), nil
+}
+
+// =========================================================================================
+// richQueryError explains a rich query failure caused by the state database. The
+// chaincode can't ask the peer which database it runs on, but LevelDB rejects every
+// rich query with an "... not supported for leveldb" error, so that is recognised here
+// and the caller pointed at the range based alternative.
+// =========================================================================================
+func richQueryError(err error) error {
+	if strings.Contains(strings.ToLower(err.Error()), "not supported for leveldb") {
+		return fmt.Errorf("Rich queries need CouchDB as the state database, use queryProductByRangePaginated on LevelDB: %s", err)
+	}
+	return err
+}
+
+// ===== Example: Pagination with Range Query ==============================================
+// queryProductByRangePaginated performs a range query on puids from startKey (inclusive)
+// to endKey (exclusive) and returns at most pageSize products, together with the fetched
+// record count and the bookmark to pass in for the next page, in the same format as
+// queryProductWithPagination. Empty start and end keys cover every product.
+// Unlike the rich query variant it works on every state database, LevelDB included.
+// Paginated queries are only valid for read only transactions.
+// =========================================================================================
+func (t *SimpleChaincode) queryProductByRangePaginated(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0           1         2           3
+	// "startKey", "endKey", "pageSize", "bookmark"
+	if len(args) != 4 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 4"))
+	}
+
+	startKey := args[0]
+	endKey := args[1]
+	pageSize, err := strconv.ParseInt(args[2], 10, 32)
+	if err != nil || pageSize <= 0 {
+		return errorResponse("", validationError("3rd argument must be a positive numeric string"))
+	}
+	bookmark := args[3]
+	fmt.Println("- start queryProductByRangePaginated ", startKey, endKey, pageSize, bookmark)
+
+	startKey, endKey = productKeyRange(stub, startKey, endKey)
+	resultsIterator, responseMetadata, err := stub.GetStateByRangeWithPagination(startKey, endKey, int32(pageSize), bookmark)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	defer resultsIterator.Close()
+
+	buffer, err := constructQueryResponseFromIterator(resultsIterator)
+	if err != nil {
+		return errorResponse("", err)
+	}
+
+	bufferWithPaginationInfo := addPaginationMetadataToQueryResults(buffer, responseMetadata)
+
+	fmt.Printf("- queryProductByRangePaginated queryResult:\n%s\n", bufferWithPaginationInfo.String())
+
+	return shim.Success(bufferWithPaginationInfo.Bytes())
+}
+
+// =========================================================================================
+// addPaginationMetadataToQueryResults wraps the query results array in a JSON object and
+// adds the pagination metadata (fetched record count and bookmark) alongside it. The
+// bookmark of a range query is a state key, which may hold quotes or the U+0000 of a
+// composite key, so it is encoded with json.Marshal.
+// =========================================================================================
+func addPaginationMetadataToQueryResults(buffer *bytes.Buffer, responseMetadata *pb.QueryResponseMetadata) *bytes.Buffer {
+
+	bookmarkJSONasBytes, _ := json.Marshal(responseMetadata.Bookmark)
+
+	var wrapped bytes.Buffer
+	wrapped.WriteString("{\"Records\":")
+	wrapped.Write(buffer.Bytes())
+	wrapped.WriteString(", \"ResponseMetadata\":{\"RecordsCount\":")
+	wrapped.WriteString(strconv.FormatInt(int64(responseMetadata.FetchedRecordsCount), 10))
+	wrapped.WriteString(", \"Bookmark\":")
+	wrapped.Write(bookmarkJSONasBytes)
+	wrapped.WriteString("}}")
+
+	return &wrapped
+}
+
+// ===========================================================================
+// getHistoryForProduct returns every historic value of a product. Optional
+// start and end Unix timestamps (seconds, inclusive) restrict the output to
+// changes made within that window; an empty value leaves that side open.
+// With summary "true" only {"changeCount", "firstTs", "lastTs", "deleted"} is
+// returned for the changes in the window, see historySummary.
+// ===========================================================================
+func (t *SimpleChaincode) getHistoryForProduct(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0        1 (optional)  2 (optional)  3 (optional)
+	// "puid", "startTs",     "endTs",      "summary"
+	if len(args) < 1 || len(args) > 4 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 1 to 4"))
+	}
+
+	Puid := args[0]
+
+	var startTs, endTs int64 = 0, math.MaxInt64
+	var err error
+	if len(args) > 1 && len(args[1]) > 0 {
+		startTs, err = strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return errorResponse(Puid, validationError("2nd argument must be a numeric string"))
+		}
+	}
+	if len(args) > 2 && len(args[2]) > 0 {
+		endTs, err = strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return errorResponse(Puid, validationError("3rd argument must be a numeric string"))
+		}
+	}
+
+	summary := false
+	if len(args) > 3 && len(args[3]) > 0 {
+		summary, err = strconv.ParseBool(args[3])
+		if err != nil {
+			return errorResponse(Puid, validationError("4th argument must be true or false"))
+		}
+	}
+
+	fmt.Printf("- start getHistoryForProduct: %s\n", Puid)
+
+	if summary {
+		summaryJSONasBytes, err := getHistorySummaryInRange(stub, Puid, startTs, endTs)
+		if err != nil {
+			return errorResponse(Puid, err)
+		}
+		return shim.Success(summaryJSONasBytes)
+	}
+
+	buffer, err := getHistoryForKeyInRange(stub, Puid, startTs, endTs)
+	if err != nil {
+		return errorResponse(Puid, err)
+	}
+
+	fmt.Printf("- getHistoryForProduct returning:\n%s\n", buffer.String())
+
+	return shim.Success(buffer.Bytes())
+}
+
+// ===========================================================================
+// getHistoryForKeyInRange builds the JSON array of historic values of a key
+// whose change timestamps (Unix seconds) fall within [startTs, endTs]
+// ===========================================================================
+func getHistoryForKeyInRange(stub shim.ChaincodeStubInterface, puid string, startTs int64, endTs int64) (*bytes.Buffer, error) {
+	// buffer is a JSON array containing historic values for the product
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+
+	bArrayMemberAlreadyWritten := false
+	err := walkHistoryInRange(stub, puid, startTs, endTs, func(response *queryresult.KeyModification) error {
+		// if it was a delete operation on given key, then we need to set the
+		//corresponding value null. Else, we will write the response.Value
+		//as-is (as the Value itself a JSON product)
+		historyResult := HistoryResult{
+			TxId:      response.TxId,
+			Timestamp: time.Unix(response.Timestamp.Seconds, int64(response.Timestamp.Nanos)).UTC().Format(time.RFC3339),
+			IsDelete:  response.IsDelete,
+		}
+		if !response.IsDelete {
+			historyResult.Value = response.Value
+		}
+		historyAsBytes, err := historyResult.MarshalJSON()
+		if err != nil {
+			return err
+		}
+
+		// Add a comma before array members, suppress it for the first array member
+		if bArrayMemberAlreadyWritten == true {
+			buffer.WriteString(",")
+		}
+		buffer.Write(historyAsBytes)
+		bArrayMemberAlreadyWritten = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	buffer.WriteString("]")
+
+	return &buffer, nil
+
+}
+
+// historySummary counts the changes of a key instead of listing them. firstTs
+// and lastTs are the Unix seconds of the oldest and newest change, 0 when there
+// are none, and deleted tells whether the newest change was a delete.
+type historySummary struct {
+	ChangeCount int   `json:"changeCount"`
+	FirstTs     int64 `json:"firstTs"`
+	LastTs      int64 `json:"lastTs"`
+	Deleted     bool  `json:"deleted"`
+}
+
+// getHistorySummaryInRange summarizes the changes of a key whose timestamps
+// (Unix seconds) fall within [startTs, endTs] in one pass over its history,
+// without keeping any of the values
+func getHistorySummaryInRange(stub shim.ChaincodeStubInterface, puid string, startTs int64, endTs int64) ([]byte, error) {
+	summary := historySummary{}
+	err := walkHistoryInRange(stub, puid, startTs, endTs, func(response *queryresult.KeyModification) error {
+		if summary.ChangeCount == 0 || response.Timestamp.Seconds < summary.FirstTs {
+			summary.FirstTs = response.Timestamp.Seconds
+		}
+		if summary.ChangeCount == 0 || response.Timestamp.Seconds >= summary.LastTs {
+			summary.LastTs = response.Timestamp.Seconds
+			summary.Deleted = response.IsDelete
+		}
+		summary.ChangeCount++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(summary)
+}
+
+// walkHistoryInRange calls visit for every change of a key, in the order the
+// history database returns them, whose timestamp (Unix seconds) falls within
+// [startTs, endTs], stopping at the first error visit returns
+func walkHistoryInRange(stub shim.ChaincodeStubInterface, puid string, startTs int64, endTs int64, visit func(*queryresult.KeyModification) error) error {
+	resultsIterator, err := stub.GetHistoryForKey(productKey(stub, puid))
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		// skip changes outside the requested time window
+		if response.Timestamp.Seconds < startTs || response.Timestamp.Seconds > endTs {
+			continue
+		}
+		err = visit(response)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chainAnomaly is one inconsistency found by verifyOwnershipChain
+type chainAnomaly struct {
+	TxID      string `json:"txId"`
+	Timestamp int64  `json:"timestamp"` //Unix seconds
+	Kind      string `json:"kind"`
+	Message   string `json:"message"`
+}
+
+// ownershipChainReport is the result of verifyOwnershipChain
+type ownershipChainReport struct {
+	Puid       string         `json:"puid"`
+	Versions   int            `json:"versions"`  //changes walked, deletes included
+	Deletions  int            `json:"deletions"` //changes that deleted the product
+	Consistent bool           `json:"consistent"`
+	Anomalies  []chainAnomaly `json:"anomalies"`
+}
+
+// chainLink is the ownership state a version of a product left behind
+type chainLink struct {
+	owner        string
+	ownerHistory []string
+	restoredFrom string
+}
 
-	// Handle different functions
-	if function == "initProduct" { //create a new product
-		return t.initProduct(stub, args)
-	} else if function == "transferProduct" { //change owner of a specific product
-		return t.transferProduct(stub, args)
-	} else if function == "readProduct" { //read a product
-		return t.readProduct(stub, args)
-	} else if function == "queryProduct" { //find product based on an ad hoc rich query
-		return t.queryProduct(stub, args)
-	} else if function == "getHistoryForProduct" { //get history of values for a product
-		return t.getHistoryForProduct(stub, args)
+// ===========================================================================
+// verifyOwnershipChain - walk the whole history of a product and check that
+// its ownership changes are contiguous: a version that changes the owner must
+// append the previous owner to OwnerHistory, and a version that keeps the
+// owner must keep OwnerHistory as it was. A product's first version, and the
+// first after a delete, start a new chain with an empty OwnerHistory, unless
+// restoreProduct wrote it, in which case it must match the version it was
+// restored from. Every break is reported as an anomaly with its TxId; a version
+// that is not a product record is reported too, and the version after it is
+// not checked, as there is nothing to compare it with. Records created before
+// OwnerHistory existed count as having an empty one.
+// ===========================================================================
+func (t *SimpleChaincode) verifyOwnershipChain(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "puid"
+	if len(args) != 1 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 1"))
 	}
 
-	fmt.Println("invoke did not find func: " + function) //error
-	return shim.Error("Received unknown function invocation")
-}
+	puid := args[0]
+	fmt.Println("- start verifyOwnershipChain ", puid)
 
-// ============================================================
-// initProduct - create a new product, store into chaincode state
-// ============================================================
-func (t *SimpleChaincode) initProduct(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	var err error
+	// ==== Collect the versions, oldest first ====
+	versions := []*queryresult.KeyModification{}
+	err := walkHistoryInRange(stub, puid, 0, math.MaxInt64, func(response *queryresult.KeyModification) error {
+		versions = append(versions, response)
+		return nil
+	})
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	if len(versions) == 0 {
+		return errorResponse(puid, notFoundError("No history found for %s", puid))
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		a, b := versions[i].Timestamp, versions[j].Timestamp
+		return a.Seconds < b.Seconds || (a.Seconds == b.Seconds && a.Nanos < b.Nanos)
+	})
 
-	if len(args) != 4 {
-		return shim.Error("Incorrect number of arguments. Expecting 4")
+	// ==== Check each version against the one before it ====
+	report := ownershipChainReport{Puid: puid, Versions: len(versions), Anomalies: []chainAnomaly{}}
+	seen := map[string]chainLink{} //by TxId, to check restores against their source
+	var prev *chainLink            //nil at the start of a chain
+	unknown := false               //the previous version could not be decoded
+	for _, version := range versions {
+		anomaly := func(kind string, format string, args ...interface{}) {
+			report.Anomalies = append(report.Anomalies, chainAnomaly{version.TxId, version.Timestamp.Seconds, kind, fmt.Sprintf(format, args...)})
+		}
+		if version.IsDelete {
+			report.Deletions++
+			prev, unknown = nil, false
+			continue
+		}
+		p := product{}
+		if json.Unmarshal(version.Value, &p) != nil {
+			anomaly("undecodable", "Version is not a valid product record")
+			prev, unknown = nil, true
+			continue
+		}
+		if p.OwnerHistory == nil { //record predates OwnerHistory
+			p.OwnerHistory = []string{}
+		}
+		link := chainLink{p.Owner, p.OwnerHistory, p.RestoredFrom}
+		seen[version.TxId] = link
+
+		switch {
+		case unknown:
+			// nothing to compare with
+		case len(link.restoredFrom) > 0 && (prev == nil || prev.restoredFrom != link.restoredFrom):
+			source, ok := seen[link.restoredFrom]
+			if !ok {
+				anomaly("restoreSourceMissing", "Restored from transaction %s, which is not an earlier version of %s", link.restoredFrom, puid)
+			} else if link.owner != source.owner || !equalStrings(link.ownerHistory, source.ownerHistory) {
+				anomaly("restoreMismatch", "Owner %s with history %v does not match owner %s with history %v restored from transaction %s", link.owner, link.ownerHistory, source.owner, source.ownerHistory, link.restoredFrom)
+			}
+		case prev == nil:
+			if len(link.ownerHistory) > 0 {
+				anomaly("historyWithoutTransfers", "Chain starts with owner %s but already has previous owners %v", link.owner, link.ownerHistory)
+			}
+		case link.owner != prev.owner:
+			expected := append(append([]string{}, prev.ownerHistory...), prev.owner)
+			if len(link.ownerHistory) == 0 || link.ownerHistory[len(link.ownerHistory)-1] != prev.owner {
+				anomaly("ownerGap", "Owner changed from %s to %s but the last previous owner recorded is not %s", prev.owner, link.owner, prev.owner)
+			} else if !equalStrings(link.ownerHistory, expected) {
+				anomaly("historyRewritten", "Owner changed from %s to %s and previous owners changed from %v to %v", prev.owner, link.owner, prev.ownerHistory, link.ownerHistory)
+			}
+		case !equalStrings(link.ownerHistory, prev.ownerHistory):
+			anomaly("historyRewritten", "Owner stayed %s but previous owners changed from %v to %v", link.owner, prev.ownerHistory, link.ownerHistory)
+		}
+		prev, unknown = &link, false
 	}
+	report.Consistent = len(report.Anomalies) == 0
 
-	// ==== Input sanitation ====
-	fmt.Println("- start init product")
-	if len(args[0]) <= 0 {
-		return shim.Error("1st argument must be a non-empty string")
+	reportJSONasBytes, err := json.Marshal(report)
+	if err != nil {
+		return errorResponse(puid, err)
 	}
-	if len(args[1]) <= 0 {
-		return shim.Error("2nd argument must be a non-empty string")
+	fmt.Println("- end verifyOwnershipChain ", puid, len(report.Anomalies))
+	return shim.Success(reportJSONasBytes)
+}
+
+// equalStrings reports whether a and b hold the same strings in the same order
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
 	}
-	if len(args[2]) <= 0 {
-		return shim.Error("3rd argument must be a non-empty string")
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
 	}
-	if len(args[3]) <= 0 {
-		return shim.Error("4th argument must be a non-empty string")
+	return true
+}
+
+// fieldHistoryEntry is one change of a field in the timeline returned by getFieldHistory
+type fieldHistoryEntry struct {
+	TxID      string          `json:"txId"`
+	Timestamp string          `json:"timestamp"` //RFC 3339, UTC
+	Value     json.RawMessage `json:"value"`     //null when the product was deleted or lacked the field
+}
+
+// ===========================================================================
+// getFieldHistory - return how one field of a product changed over time, as a
+// JSON array of {"txId", "timestamp", "value"} ordered oldest first. Every
+// version in the product's history is decoded and only the field is kept; a
+// version where the field has the same value as in the version before is left
+// out, so each entry is a real change. A delete, or a version written before
+// the field existed, gives a null value. The field must be one of the product
+// JSON field names, e.g. owner or status.
+// ===========================================================================
+func (t *SimpleChaincode) getFieldHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0        1
+	// "puid", "owner"
+	if len(args) != 2 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 2"))
 	}
 
-	productUID := args[0]
-	pname := strings.ToLower(args[1])
-	ptype := strings.ToLower(args[2])
-	owner := strings.ToLower(args[3])
+	puid := args[0]
+	fields, err := parseProjection(args, 1)
 	if err != nil {
-		return shim.Error("3rd argument must be a numeric string")
+		return errorResponse(puid, err)
 	}
+	if len(fields) != 1 {
+		return errorResponse(puid, validationError("2nd argument must be a single product field name"))
+	}
+	field := fields[0]
+	fmt.Println("- start getFieldHistory ", puid, field)
 
-	// ==== Check if product already exists ====
-	productAsBytes, err := stub.GetState(productUID)
+	entries, err := fieldTimeline(stub, puid, field)
 	if err != nil {
-		return shim.Error("Failed to get product: " + err.Error())
-	} else if productAsBytes != nil {
-		fmt.Println("This product already exists: " + productUID)
-		return shim.Error("This product already exists: " + productUID)
+		return errorResponse(puid, err)
 	}
-
-	// ==== Create product object and marshal to JSON ====
-	objectType := "product"
-	product := &product{objectType, productUID, pname, ptype, owner}
-	productJSONasBytes, err := json.Marshal(product)
+	entriesJSONasBytes, err := json.Marshal(entries)
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(puid, err)
 	}
+	fmt.Printf("- end getFieldHistory: %d changes of %s\n", len(entries), field)
+	return shim.Success(entriesJSONasBytes)
+}
 
-	// === Save product to state ===
-	err = stub.PutState(productUID, productJSONasBytes)
+// fieldTimeline returns the changes of one field of a product, oldest first,
+// as described at getFieldHistory
+func fieldTimeline(stub shim.ChaincodeStubInterface, puid string, field string) ([]fieldHistoryEntry, error) {
+	versions, err := productVersions(stub, puid, math.MaxInt64)
 	if err != nil {
-		return shim.Error(err.Error())
+		return nil, err
 	}
+	return timelineOf(puid, versions, field)
+}
 
-	indexName := "type~name"
-	colorNameIndexKey, err := stub.CreateCompositeKey(indexName, []string{product.Ptype, product.Pname})
+// productVersions returns the changes of a product made at or before until,
+// in Unix nanoseconds, oldest first
+func productVersions(stub shim.ChaincodeStubInterface, puid string, until int64) ([]*queryresult.KeyModification, error) {
+	versions := []*queryresult.KeyModification{}
+	err := walkHistoryInRange(stub, puid, 0, math.MaxInt64, func(response *queryresult.KeyModification) error {
+		if time.Unix(response.Timestamp.Seconds, int64(response.Timestamp.Nanos)).UnixNano() <= until {
+			versions = append(versions, response)
+		}
+		return nil
+	})
 	if err != nil {
-		return shim.Error(err.Error())
+		return nil, err
 	}
-
-	value := []byte{0x00}
-	stub.PutState(colorNameIndexKey, value)
-
-	fmt.Println("- end init product")
-	return shim.Success(nil)
+	sort.SliceStable(versions, func(i, j int) bool {
+		a, b := versions[i].Timestamp, versions[j].Timestamp
+		return a.Seconds < b.Seconds || (a.Seconds == b.Seconds && a.Nanos < b.Nanos)
+	})
+	return versions, nil
 }
 
-func (t *SimpleChaincode) readProduct(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	var Puid, jsonResp string
-	var err error
-
-	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting product ID of the product to query")
+// timelineOf returns the changes of one field across versions, which must be
+// sorted oldest first, as described at getFieldHistory
+func timelineOf(puid string, versions []*queryresult.KeyModification, field string) ([]fieldHistoryEntry, error) {
+	entries := []fieldHistoryEntry{}
+	var last []byte
+	for _, version := range versions {
+		value := []byte("null")
+		if !version.IsDelete {
+			var record map[string]json.RawMessage
+			if json.Unmarshal(version.Value, &record) != nil {
+				return nil, &codedError{codeCorruptRecord, fmt.Sprintf("Value of %s at transaction %s is not a valid product, it may be corrupt", puid, version.TxId)}
+			}
+			if raw, ok := record[field]; ok {
+				var compacted bytes.Buffer
+				err := json.Compact(&compacted, raw)
+				if err != nil {
+					return nil, err
+				}
+				value = compacted.Bytes()
+			}
+		}
+		if last != nil && bytes.Equal(value, last) {
+			continue // unchanged
+		}
+		last = value
+		entries = append(entries, fieldHistoryEntry{
+			TxID:      version.TxId,
+			Timestamp: time.Unix(version.Timestamp.Seconds, int64(version.Timestamp.Nanos)).UTC().Format(time.RFC3339),
+			Value:     json.RawMessage(value),
+		})
 	}
+	return entries, nil
+}
 
-	Puid = args[0]
-	valAsbytes, err := stub.GetState(Puid) //get the product from chaincode state
+// outOfRangeReadings returns the sensor readings of a product outside
+// sensorRanges logged at or before until, in Unix nanoseconds, ordered by
+// type, then time, as they are keyed
+func outOfRangeReadings(stub shim.ChaincodeStubInterface, puid string, until int64) ([]sensorReading, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("puid~sensor~timestamp", []string{puid})
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + Puid + "\"}"
-		return shim.Error(jsonResp)
-	} else if valAsbytes == nil {
-		jsonResp = "{\"Error\":\"Marble does not exist: " + Puid + "\"}"
-		return shim.Error(jsonResp)
+		return nil, err
 	}
+	defer resultsIterator.Close()
 
-	return shim.Success(valAsbytes)
+	readings := []sensorReading{}
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return nil, err
+		}
+		if len(compositeKeyParts) != 3 {
+			continue
+		}
+		loggedAt, err := strconv.ParseInt(compositeKeyParts[2], 10, 64)
+		if err != nil || loggedAt > until {
+			continue
+		}
+		reading := sensorReading{}
+		err = json.Unmarshal(responseRange.Value, &reading)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decode sensor reading: %s", err)
+		}
+		if reading.OutOfRange {
+			readings = append(readings, reading)
+		}
+	}
+	return readings, nil
 }
 
-func (t *SimpleChaincode) transferProduct(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+// provenanceCertificateSchema is the version of the certificateContent layout
+const provenanceCertificateSchema = 1
+
+// certificateNotice is the notice of every provenance certificate
+const certificateNotice = "Not signed by the chaincode. The digest is an unkeyed SHA-256 that anyone can recompute, so it only shows the content is intact. Check this certificate with verifyCertificate, which compares it with the ledger."
+
+// provenanceCertificate is the document returned by getProvenanceCertificate
+type provenanceCertificate struct {
+	Content certificateContent `json:"content"`
+	Digest  string             `json:"digest"` //hex SHA-256 of Content, see certificateDigest
+	Notice  string             `json:"notice"` //certificateNotice
+}
+
+// certificateContent is the part of a provenance certificate its digest covers
+type certificateContent struct {
+	Schema  int             `json:"schema"`
+	Puid    string          `json:"puid"`
+	Product json.RawMessage `json:"product"` //the product record as stored
+	//OwnershipHistory is the owner field's timeline, oldest first, see getFieldHistory
+	OwnershipHistory []fieldHistoryEntry   `json:"ownershipHistory"`
+	Compliance       certificateCompliance `json:"compliance"`
+	TxID             string                `json:"txId"`        //transaction that generated the certificate
+	GeneratedAt      string                `json:"generatedAt"` //its timestamp, RFC 3339 with nanoseconds, UTC
+}
+
+// certificateCompliance is the sensor compliance record of a certified product
+type certificateCompliance struct {
+	Breached   bool            `json:"breached"`   //the product's ComplianceBreached flag
+	OutOfRange []sensorReading `json:"outOfRange"` //every reading outside sensorRanges, ordered by type, then time
+}
+
+// ===========================================================================
+// getProvenanceCertificate - assemble a certificate for a product: its current
+// record, the timeline of its owners, its sensor compliance flag and out of
+// range readings, and the TxId and timestamp of the generating transaction,
+// with a hex SHA-256 digest of all of that. The certificate is not signed:
+// the chaincode holds no signing key, and anyone can recompute the digest of
+// altered content, so a consumer given only the JSON cannot tell it is
+// genuine. Its notice says so. verifyCertificate checks it against the ledger
+// instead. Called as a query, the TxId is that of the query proposal, which is
+// never committed.
+// ===========================================================================
+func (t *SimpleChaincode) getProvenanceCertificate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	if len(args) < 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
+	//   0
+	// "puid"
+	if len(args) != 1 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 1"))
 	}
 
 	puid := args[0]
-	newOwner := strings.ToLower(args[1])
-	fmt.Println("- start product transfer ", puid, newOwner)
+	fmt.Println("- start getProvenanceCertificate ", puid)
 
-	productAsBytes, err := stub.GetState(puid)
+	productAsBytes, err := stub.GetState(productKey(stub, puid))
 	if err != nil {
-		return shim.Error("Failed to get product:" + err.Error())
+		return errorResponse(puid, fmt.Errorf("Failed to get product:%s", err))
 	} else if productAsBytes == nil {
-		return shim.Error("Product does not exist")
+		return errorResponse(puid, notFoundError("Product does not exist: %s", puid))
+	}
+	current := product{}
+	err = decodeProduct(puid, productAsBytes, &current)
+	if err != nil {
+		return errorResponse(puid, err)
 	}
 
-	productToTransfer := product{}
-	err = json.Unmarshal(productAsBytes, &productToTransfer) //unmarshal it aka JSON.parse()
+	owners, err := fieldTimeline(stub, puid, "owner")
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(puid, err)
+	}
+	outOfRange, err := outOfRangeReadings(stub, puid, math.MaxInt64)
+	if err != nil {
+		return errorResponse(puid, err)
 	}
-	productToTransfer.Owner = newOwner //change the owner
 
-	productJSONasBytes, _ := json.Marshal(productToTransfer)
-	err = stub.PutState(puid, productJSONasBytes) //rewrite the product
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	certificate := provenanceCertificate{Content: certificateContent{
+		Schema:           provenanceCertificateSchema,
+		Puid:             puid,
+		Product:          json.RawMessage(productAsBytes),
+		OwnershipHistory: owners,
+		Compliance:       certificateCompliance{current.ComplianceBreached, outOfRange},
+		TxID:             stub.GetTxID(),
+		GeneratedAt:      time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC().Format(time.RFC3339Nano),
+	}, Notice: certificateNotice}
+	certificate.Digest, err = certificateDigest(&certificate.Content)
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(puid, err)
 	}
 
-	fmt.Println("- end of product transfer (success)")
-	return shim.Success(nil)
+	certificateJSONasBytes, err := json.Marshal(certificate)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	fmt.Println("- end getProvenanceCertificate ", puid, certificate.Digest)
+	return shim.Success(certificateJSONasBytes)
 }
 
-//getHistoryForProdcut
+// certificateDigest returns the hex SHA-256 of content encoded with json.Marshal.
+// The encoding of a struct is fixed and json.Marshal compacts the raw product
+// record, so a certificate that was only reformatted, e.g. pretty printed,
+// still gives the same digest.
+func certificateDigest(content *certificateContent) (string, error) {
+	contentJSONasBytes, err := json.Marshal(content)
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256(contentJSONasBytes)
+	return hex.EncodeToString(digest[:]), nil
+}
 
-func (t *SimpleChaincode) queryProduct(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+// sameJSON reports whether a and b encode to the same JSON
+func sameJSON(a interface{}, b interface{}) bool {
+	aJSONasBytes, errA := json.Marshal(a)
+	bJSONasBytes, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(aJSONasBytes, bJSONasBytes)
+}
+
+// ===========================================================================
+// verifyCertificate - check a certificate returned by getProvenanceCertificate
+// against the ledger. The digest proves nothing by itself, since anyone can
+// recompute it, so every certified fact but the TxId is rebuilt from the
+// product's history as of the certificate's generatedAt and compared:
+//   - digestValid: the digest matches the content
+//   - onLedger: the certified product was the product's value at generatedAt
+//   - ownershipHistoryValid: the owner timeline up to then matches
+//   - complianceValid: the compliance flag matches the certified product and
+//     the out of range readings logged up to then match
+//   - current: the certified product is still the product's current value
+//
+// valid is all of these but current, so a certificate stays valid after the
+// product changes, it then certifies an earlier state. The TxId is not
+// checked, a query's TxId is never committed, and unchecked lists it.
+// ===========================================================================
+func (t *SimpleChaincode) verifyCertificate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
 	//   0
-	// "queryString"
-	if len(args) < 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+	// "{\"content\":{...},\"digest\":\"...\",\"notice\":\"...\"}"
+	if len(args) != 1 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 1"))
 	}
 
-	queryString := args[0]
+	certificate := provenanceCertificate{}
+	err := unmarshalJSON([]byte(args[0]), &certificate, true)
+	if err != nil {
+		return errorResponse("", validationError("1st argument must be a provenance certificate: %s", err))
+	}
+	content := &certificate.Content
+	puid := content.Puid
+	if len(puid) <= 0 || len(content.Product) == 0 {
+		return errorResponse("", validationError("Certificate must have a puid and a product"))
+	}
+	if content.Schema != provenanceCertificateSchema {
+		return errorResponse(puid, validationError("Unsupported certificate schema %d, expecting %d", content.Schema, provenanceCertificateSchema))
+	}
+	generatedAt, err := time.Parse(time.RFC3339Nano, content.GeneratedAt)
+	if err != nil {
+		return errorResponse(puid, validationError("Certificate generatedAt must be an RFC 3339 timestamp: %s", err))
+	}
+	fmt.Println("- start verifyCertificate ", puid)
 
-	queryResults, err := getQueryResultForQueryString(stub, queryString)
+	digest, err := certificateDigest(content)
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(puid, validationError("Certificate content can't be encoded: %s", err))
+	}
+	var certified bytes.Buffer
+	err = json.Compact(&certified, content.Product)
+	if err != nil {
+		return errorResponse(puid, validationError("Certified product is not valid JSON: %s", err))
+	}
+	certifiedProduct := product{}
+	err = json.Unmarshal(certified.Bytes(), &certifiedProduct)
+	if err != nil {
+		return errorResponse(puid, validationError("Certified product is not a product: %s", err))
 	}
-	return shim.Success(queryResults)
-}
 
-// =========================================================================================
-// getQueryResultForQueryString executes the passed in query string.
-// Result set is built and returned as a byte array containing the JSON results.
-// =========================================================================================
-func getQueryResultForQueryString(stub shim.ChaincodeStubInterface, queryString string) ([]byte, error) {
+	// ==== The certified record must be the last version up to generatedAt ====
+	until := generatedAt.UnixNano()
+	versions, err := productVersions(stub, puid, until)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	onLedger := false
+	if len(versions) > 0 {
+		last := versions[len(versions)-1]
+		var value bytes.Buffer
+		onLedger = !last.IsDelete && json.Compact(&value, last.Value) == nil && bytes.Equal(value.Bytes(), certified.Bytes())
+	}
 
-	fmt.Printf("- getQueryResultForQueryString queryString:\n%s\n", queryString)
+	// ==== Rebuild the certified history as of generatedAt ====
+	owners, err := timelineOf(puid, versions, "owner")
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	outOfRange, err := outOfRangeReadings(stub, puid, until)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	ownershipHistoryValid := sameJSON(owners, content.OwnershipHistory)
+	complianceValid := content.Compliance.Breached == certifiedProduct.ComplianceBreached && sameJSON(outOfRange, content.Compliance.OutOfRange)
 
-	resultsIterator, err := stub.GetQueryResult(queryString)
+	productAsBytes, err := stub.GetState(productKey(stub, puid))
 	if err != nil {
-		return nil, err
+		return errorResponse(puid, fmt.Errorf("Failed to get product:%s", err))
 	}
-	defer resultsIterator.Close()
+	var value bytes.Buffer
+	isCurrent := productAsBytes != nil && json.Compact(&value, productAsBytes) == nil && bytes.Equal(value.Bytes(), certified.Bytes())
 
-	// buffer is a JSON array containing QueryRecords
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
+	digestValid := digest == strings.ToLower(certificate.Digest)
+	resultJSONasBytes, err := json.Marshal(struct {
+		DigestValid           bool     `json:"digestValid"`
+		OnLedger              bool     `json:"onLedger"`
+		OwnershipHistoryValid bool     `json:"ownershipHistoryValid"`
+		ComplianceValid       bool     `json:"complianceValid"`
+		Current               bool     `json:"current"`
+		Valid                 bool     `json:"valid"`
+		Unchecked             []string `json:"unchecked"`
+	}{digestValid, onLedger, ownershipHistoryValid, complianceValid, isCurrent,
+		digestValid && onLedger && ownershipHistoryValid && complianceValid, []string{"txId"}})
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	fmt.Println("- end verifyCertificate " + string(resultJSONasBytes))
+	return shim.Success(resultJSONasBytes)
+}
 
-	bArrayMemberAlreadyWritten := false
+// maxAuditLogProducts caps the number of products getAuditLog walks the history of
+const maxAuditLogProducts = 200
+
+// auditLogEntry is one change in the feed returned by getAuditLog
+type auditLogEntry struct {
+	Puid      string          `json:"puid"`
+	TxID      string          `json:"txId"`
+	Timestamp string          `json:"timestamp"` //RFC 3339, UTC
+	IsDelete  bool            `json:"isDelete"`
+	Value     json.RawMessage `json:"value"` //null for a delete
+	nanos     int64           //sort key, Unix nanoseconds
+}
+
+// ===========================================================================
+// getAuditLog - return every change made within a time window to the products
+// whose puid starts with prefix, as one JSON array ordered by timestamp, oldest
+// first. Fabric has no channel-wide history, so this walks GetHistoryForKey of
+// each product found by the prefix scan of getProductsByPrefix, and its cost
+// grows with the number of products and changes; the prefix is required and
+// at most maxAuditLogProducts products may match. Deleted products are no
+// longer in state and so are not found by the scan; use getHistoryForProduct
+// for them. Timestamps are Unix seconds, inclusive; an empty one leaves that
+// side of the window open.
+// ===========================================================================
+func (t *SimpleChaincode) getAuditLog(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0         1 (optional)  2 (optional)
+	// "prefix", "startTs",     "endTs"
+	if len(args) < 1 || len(args) > 3 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 1 to 3"))
+	}
+
+	prefix := args[0]
+	if len(prefix) <= 0 {
+		return errorResponse("", validationError("1st argument must be a non-empty string"))
+	}
+	err := validatePuid(prefix)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	var startTs, endTs int64 = 0, math.MaxInt64
+	if len(args) > 1 && len(args[1]) > 0 {
+		startTs, err = strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return errorResponse("", validationError("2nd argument must be a numeric string"))
+		}
+	}
+	if len(args) > 2 && len(args[2]) > 0 {
+		endTs, err = strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return errorResponse("", validationError("3rd argument must be a numeric string"))
+		}
+	}
+	fmt.Println("- start getAuditLog ", prefix, startTs, endTs)
+
+	// ==== Find the products, without reading past the cap ====
+	resultsIterator, err := stub.GetStateByRange(productKeyRange(stub, prefix, prefix+string(utf8.MaxRune)))
+	if err != nil {
+		return errorResponse("", err)
+	}
+	defer resultsIterator.Close()
+	puids := []string{}
 	for resultsIterator.HasNext() {
 		queryResponse, err := resultsIterator.Next()
 		if err != nil {
-			return nil, err
+			return errorResponse("", err)
 		}
-		// Add a comma before array members, suppress it for the first array member
-		if bArrayMemberAlreadyWritten == true {
-			buffer.WriteString(",")
+		if strings.ContainsRune(queryResponse.Key, 0) {
+			continue // composite key
+		}
+		p := product{}
+		if json.Unmarshal(queryResponse.Value, &p) != nil || !isAllowedDocType(p.ObjectType) {
+			continue
+		}
+		if len(puids) == maxAuditLogProducts {
+			return errorResponse("", validationError("More than %d products start with %s, use a longer prefix", maxAuditLogProducts, prefix))
 		}
-		buffer.WriteString("{\"Key\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(queryResponse.Key)
-		buffer.WriteString("\"")
+		puids = append(puids, p.Puid)
+	}
 
-		buffer.WriteString(", \"Record\":")
-		// Record is a JSON object, so we write as-is
-		buffer.WriteString(string(queryResponse.Value))
-		buffer.WriteString("}")
-		bArrayMemberAlreadyWritten = true
+	// ==== Merge their histories ====
+	entries := []auditLogEntry{}
+	for _, puid := range puids {
+		err = walkHistoryInRange(stub, puid, startTs, endTs, func(response *queryresult.KeyModification) error {
+			entry := auditLogEntry{
+				Puid:      puid,
+				TxID:      response.TxId,
+				Timestamp: time.Unix(response.Timestamp.Seconds, int64(response.Timestamp.Nanos)).UTC().Format(time.RFC3339),
+				IsDelete:  response.IsDelete,
+				Value:     json.RawMessage("null"),
+				nanos:     response.Timestamp.Seconds*int64(time.Second) + int64(response.Timestamp.Nanos),
+			}
+			if !response.IsDelete {
+				if !json.Valid(response.Value) {
+					return fmt.Errorf("Value of %s at transaction %s is not valid JSON", puid, response.TxId)
+				}
+				entry.Value = response.Value
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+		if err != nil {
+			return errorResponse(puid, err)
+		}
 	}
-	buffer.WriteString("]")
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].nanos < entries[j].nanos
+	})
 
-	fmt.Printf("- getQueryResultForQueryString queryResult:\n%s\n", buffer.String())
+	entriesJSONasBytes, err := json.Marshal(entries)
+	if err != nil {
+		return errorResponse("", err)
+	}
+	fmt.Printf("- end getAuditLog: %d changes of %d products\n", len(entries), len(puids))
+	return shim.Success(entriesJSONasBytes)
+}
+
+// HistoryResult is one member of the JSON arrays returned by the history queries
+type HistoryResult struct {
+	TxId      string          `json:"TxId"`
+	Value     json.RawMessage `json:"Value"` //nil for a delete
+	Timestamp string          `json:"Timestamp"`
+	IsDelete  bool            `json:"IsDelete,string"`
+}
 
+// MarshalJSON writes {"TxId":..., "Value":..., "Timestamp":..., "IsDelete":"..."}
+// with the layout the hand-built history responses always had, escaping the
+// strings properly and rejecting a Value that isn't valid JSON
+func (r HistoryResult) MarshalJSON() ([]byte, error) {
+	value := []byte("null")
+	if r.Value != nil {
+		if !json.Valid(r.Value) {
+			return nil, fmt.Errorf("Value of transaction %s is not valid JSON", r.TxId)
+		}
+		value = r.Value
+	}
+	txIDAsBytes, err := json.Marshal(r.TxId)
+	if err != nil {
+		return nil, err
+	}
+	timestampAsBytes, err := json.Marshal(r.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+	var buffer bytes.Buffer
+	buffer.WriteString("{\"TxId\":")
+	buffer.Write(txIDAsBytes)
+	buffer.WriteString(", \"Value\":")
+	buffer.Write(value)
+	buffer.WriteString(", \"Timestamp\":")
+	buffer.Write(timestampAsBytes)
+	buffer.WriteString(", \"IsDelete\":")
+	buffer.WriteString("\"" + strconv.FormatBool(r.IsDelete) + "\"")
+	buffer.WriteString("}")
 	return buffer.Bytes(), nil
 }
 
-func (t *SimpleChaincode) getHistoryForProduct(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+// ===========================================================================
+// getProductWithHistory - return {"current": {...}, "history": [...]} for a
+// product in one call, saving the readProduct + getHistoryForProduct round trip
+// ===========================================================================
+func (t *SimpleChaincode) getProductWithHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	if len(args) < 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+	//   0
+	// "puid"
+	if len(args) != 1 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 1"))
 	}
 
-	Puid := args[0]
-
-	fmt.Printf("- start getHistoryForProduct: %s\n", Puid)
+	puid := args[0]
+	productAsBytes, err := stub.GetState(productKey(stub, puid))
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to get state for %s", puid))
+	} else if productAsBytes == nil {
+		return errorResponse(puid, notFoundError("Product does not exist: %s", puid))
+	}
 
-	resultsIterator, err := stub.GetHistoryForKey(Puid)
+	historyBuffer, err := getHistoryForKeyInRange(stub, puid, 0, math.MaxInt64)
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(puid, err)
 	}
-	defer resultsIterator.Close()
 
-	// buffer is a JSON array containing historic values for the product
 	var buffer bytes.Buffer
-	buffer.WriteString("[")
+	buffer.WriteString("{\"current\":")
+	buffer.Write(productAsBytes)
+	buffer.WriteString(", \"history\":")
+	buffer.Write(historyBuffer.Bytes())
+	buffer.WriteString("}")
 
-	bArrayMemberAlreadyWritten := false
+	return shim.Success(buffer.Bytes())
+}
+
+// ===========================================================================
+// restoreProduct - roll a product back to the value written by a given
+// transaction, e.g. to undo a mistaken transfer. The product's history is
+// searched for the TxId and that value becomes the current state again, with
+// Version, UpdatedAt and LastModifiedBy moved forward and RestoredFrom set, so
+// the restore itself shows up in history as a new change. A deleted product
+// can be brought back the same way. Only admins may restore. The restore is
+// refused while the product has a pending transfer, or when the escrow hold
+// of the restored value differs from the current one, as neither is rolled
+// back with the record: reject the transfer or settle the escrow first.
+// ===========================================================================
+func (t *SimpleChaincode) restoreProduct(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0        1
+	// "puid", "txId"
+	if len(args) != 2 {
+		return errorResponse("", validationError("Incorrect number of arguments. Expecting 2"))
+	}
+
+	puid := args[0]
+	targetTxID := args[1]
+	err := assertAdmin(stub)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	fmt.Println("- start restoreProduct ", puid, targetTxID)
+
+	// ==== Find the value written by the target transaction ====
+	resultsIterator, err := stub.GetHistoryForKey(productKey(stub, puid))
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	defer resultsIterator.Close()
+
+	var restoredAsBytes []byte
 	for resultsIterator.HasNext() {
 		response, err := resultsIterator.Next()
 		if err != nil {
-			return shim.Error(err.Error())
+			return errorResponse(puid, err)
 		}
-		// Add a comma before array members, suppress it for the first array member
-		if bArrayMemberAlreadyWritten == true {
-			buffer.WriteString(",")
+		if response.TxId != targetTxID {
+			continue
 		}
-		buffer.WriteString("{\"TxId\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(response.TxId)
-		buffer.WriteString("\"")
-
-		buffer.WriteString(", \"Value\":")
-		// if it was a delete operation on given key, then we need to set the
-		//corresponding value null. Else, we will write the response.Value
-		//as-is (as the Value itself a JSON product)
 		if response.IsDelete {
-			buffer.WriteString("null")
-		} else {
-			buffer.WriteString(string(response.Value))
+			return errorResponse(puid, conflictError("Transaction %s deleted the product, there is nothing to restore", targetTxID))
 		}
+		restoredAsBytes = response.Value
+		break
+	}
+	if restoredAsBytes == nil {
+		return errorResponse(puid, notFoundError("Transaction %s is not in the history of %s", targetTxID, puid))
+	}
+	restored := product{}
+	err = decodeProduct(puid, restoredAsBytes, &restored)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
 
-		buffer.WriteString(", \"Timestamp\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(time.Unix(response.Timestamp.Seconds, int64(response.Timestamp.Nanos)).String())
-		buffer.WriteString("\"")
-
-		buffer.WriteString(", \"IsDelete\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(strconv.FormatBool(response.IsDelete))
-		buffer.WriteString("\"")
+	// ==== Compare with the current state, if the product still exists ====
+	productAsBytes, err := stub.GetState(productKey(stub, puid))
+	if err != nil {
+		return errorResponse(puid, fmt.Errorf("Failed to get product:%s", err))
+	}
+	var current *product
+	var currentEscrow *escrowHold
+	if productAsBytes != nil {
+		current = &product{}
+		err = decodeProduct(puid, productAsBytes, current)
+		if err != nil {
+			return errorResponse(puid, err)
+		}
+		restored.Version = current.Version
+		currentEscrow = current.Escrow
+	}
+	if !sameEscrow(currentEscrow, restored.Escrow) {
+		return errorResponse(puid, conflictError("The escrow of %s at %s differs from its current escrow, settle the escrow before restoring", puid, targetTxID))
+	}
+	_, _, err = getPendingTransfer(stub, puid)
+	if err == nil {
+		return errorResponse(puid, conflictError("Product %s has a pending transfer, reject it before restoring", puid))
+	} else if errorCode(err) != codeNotFound {
+		return errorResponse(puid, err)
+	}
 
-		buffer.WriteString("}")
-		bArrayMemberAlreadyWritten = true
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return errorResponse(puid, err)
 	}
-	buffer.WriteString("]")
+	restored.RestoredFrom = targetTxID
+	restored.LastModifiedBy = submitterID(stub)
+	markModified(&restored, txTimestamp.Seconds)
 
-	fmt.Printf("- getHistoryForProduct returning:\n%s\n", buffer.String())
+	restoredJSONasBytes, err := marshalProduct(&restored)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	err = stub.PutState(productKey(stub, puid), restoredJSONasBytes)
+	if err != nil {
+		return errorResponse(puid, err)
+	}
+	if current != nil {
+		err = updateProductIndexes(stub, current, &restored)
+	} else {
+		err = createProductIndexes(stub, &restored)
+	}
+	if err != nil {
+		return errorResponse(puid, err)
+	}
 
-	return shim.Success(buffer.Bytes())
+	fmt.Println("- end restoreProduct (success)")
+	return shim.Success(restoredJSONasBytes)
 }
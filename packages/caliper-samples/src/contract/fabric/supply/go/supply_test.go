@@ -0,0 +1,1943 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/common/attrmgr"
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	"github.com/hyperledger/fabric/protos/msp"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// testStub is a shim.MockStub that also answers what the mock leaves out:
+// the creator, transient data, key history, rich queries and events
+type testStub struct {
+	*shim.MockStub
+	cc        *SimpleChaincode
+	args      [][]byte
+	creator   []byte
+	transient map[string][]byte
+	history   map[string][]*queryresult.KeyModification
+	//queryResults is what GetQueryResult returns, whatever the query; lastQuery is the query
+	queryResults []*queryresult.KV
+	lastQuery    string
+	events       []*pb.ChaincodeEvent
+	//failPutState makes PutState fail for the keys it returns true for
+	failPutState func(key string) bool
+	//now is the transaction timestamp of the next invoke, Unix seconds
+	now   int64
+	txNum int
+}
+
+// testIdentity is a client identity: its serialized creator and its cid.GetID
+type testIdentity struct {
+	creator []byte
+	id      string
+}
+
+func newTestStub(t *testing.T) *testStub {
+	cc := new(SimpleChaincode)
+	stub := &testStub{
+		MockStub: shim.NewMockStub("supply", cc),
+		cc:       cc,
+		history:  make(map[string][]*queryresult.KeyModification),
+		now:      1700000000,
+	}
+	stub.ChannelID = "mychannel"
+	return stub
+}
+
+// as makes identity the submitter of the following invokes
+func (stub *testStub) as(identity testIdentity) *testStub {
+	stub.creator = identity.creator
+	return stub
+}
+
+// invoke runs one transaction, a second after the previous one
+func (stub *testStub) invoke(function string, args ...string) pb.Response {
+	stub.txNum++
+	txID := fmt.Sprintf("tx%d", stub.txNum)
+	stub.args = [][]byte{[]byte(function)}
+	for _, arg := range args {
+		stub.args = append(stub.args, []byte(arg))
+	}
+	stub.MockTransactionStart(txID)
+	stub.TxTimestamp = &timestamp.Timestamp{Seconds: stub.now}
+	res := stub.cc.Invoke(stub)
+	stub.MockTransactionEnd(txID)
+	stub.transient = nil
+	stub.now++
+	return res
+}
+
+// init instantiates or upgrades the chaincode with args
+func (stub *testStub) init(args ...string) pb.Response {
+	stub.args = [][]byte{[]byte("init")}
+	for _, arg := range args {
+		stub.args = append(stub.args, []byte(arg))
+	}
+	stub.MockTransactionStart("init")
+	stub.TxTimestamp = &timestamp.Timestamp{Seconds: stub.now}
+	res := stub.cc.Init(stub)
+	stub.MockTransactionEnd("init")
+	return res
+}
+
+// putRaw writes value under key outside of any invoke, e.g. a corrupt record
+func (stub *testStub) putRaw(t *testing.T, key string, value []byte) {
+	stub.MockTransactionStart("raw")
+	err := stub.PutState(key, value)
+	stub.MockTransactionEnd("raw")
+	if err != nil {
+		t.Fatalf("PutState %s: %s", key, err)
+	}
+}
+
+func (stub *testStub) GetArgs() [][]byte {
+	return stub.args
+}
+
+func (stub *testStub) GetStringArgs() []string {
+	args := make([]string, 0, len(stub.args))
+	for _, arg := range stub.args {
+		args = append(args, string(arg))
+	}
+	return args
+}
+
+func (stub *testStub) GetFunctionAndParameters() (string, []string) {
+	args := stub.GetStringArgs()
+	if len(args) == 0 {
+		return "", []string{}
+	}
+	return args[0], args[1:]
+}
+
+func (stub *testStub) GetCreator() ([]byte, error) {
+	return stub.creator, nil
+}
+
+func (stub *testStub) GetTransient() (map[string][]byte, error) {
+	return stub.transient, nil
+}
+
+func (stub *testStub) PutState(key string, value []byte) error {
+	if stub.failPutState != nil && stub.failPutState(key) {
+		return fmt.Errorf("PutState of %q failed", key)
+	}
+	err := stub.MockStub.PutState(key, value)
+	if err != nil {
+		return err
+	}
+	stub.record(key, value, false)
+	return nil
+}
+
+func (stub *testStub) DelState(key string) error {
+	_, existed := stub.State[key]
+	err := stub.MockStub.DelState(key)
+	if err == nil && existed {
+		stub.record(key, nil, true)
+	}
+	return err
+}
+
+func (stub *testStub) record(key string, value []byte, isDelete bool) {
+	stub.history[key] = append(stub.history[key], &queryresult.KeyModification{
+		TxId:      stub.TxID,
+		Value:     value,
+		Timestamp: stub.TxTimestamp,
+		IsDelete:  isDelete,
+	})
+}
+
+// GetStateByRange treats empty keys as the peer does, where the mock doesn't:
+// an empty start begins after the composite keys and an empty end is open
+func (stub *testStub) GetStateByRange(startKey string, endKey string) (shim.StateQueryIteratorInterface, error) {
+	if startKey == "" {
+		startKey = "\x01"
+	}
+	if endKey == "" {
+		endKey = string(utf8.MaxRune)
+	}
+	return stub.MockStub.GetStateByRange(startKey, endKey)
+}
+
+func (stub *testStub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	return &historyIterator{modifications: stub.history[key]}, nil
+}
+
+func (stub *testStub) GetQueryResult(query string) (shim.StateQueryIteratorInterface, error) {
+	stub.lastQuery = query
+	return &kvIterator{kvs: stub.queryResults}, nil
+}
+
+func (stub *testStub) SetEvent(name string, payload []byte) error {
+	stub.events = append(stub.events, &pb.ChaincodeEvent{EventName: name, Payload: payload})
+	return nil
+}
+
+// historyIterator walks recorded key modifications, oldest first like the peer
+type historyIterator struct {
+	modifications []*queryresult.KeyModification
+	next          int
+}
+
+func (iter *historyIterator) HasNext() bool {
+	return iter.next < len(iter.modifications)
+}
+
+func (iter *historyIterator) Next() (*queryresult.KeyModification, error) {
+	iter.next++
+	return iter.modifications[iter.next-1], nil
+}
+
+func (iter *historyIterator) Close() error {
+	return nil
+}
+
+// kvIterator walks canned rich query results
+type kvIterator struct {
+	kvs  []*queryresult.KV
+	next int
+}
+
+func (iter *kvIterator) HasNext() bool {
+	return iter.next < len(iter.kvs)
+}
+
+func (iter *kvIterator) Next() (*queryresult.KV, error) {
+	iter.next++
+	return iter.kvs[iter.next-1], nil
+}
+
+func (iter *kvIterator) Close() error {
+	return nil
+}
+
+// newIdentity creates a self-signed client certificate of mspID named cn, carrying
+// the role attribute the way the Fabric CA does when role is not empty
+func newIdentity(t *testing.T, mspID string, cn string, role string) testIdentity {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Unix(0, 0),
+		NotAfter:     time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	if len(role) > 0 {
+		attrs, err := json.Marshal(attrmgr.Attributes{Attrs: map[string]string{roleAttribute: role}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.ExtraExtensions = []pkix.Extension{{Id: attrmgr.AttrOID, Value: attrs}}
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creator, err := proto.Marshal(&msp.SerializedIdentity{
+		Mspid:   mspID,
+		IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := cid.GetID(&testStub{creator: creator})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testIdentity{creator, id}
+}
+
+// testIdentities are the identities most tests use: a manufacturer of adminMSPID
+// minting the products, two plain clients owning them and a regulator
+type testIdentities struct {
+	manufacturer, alice, bob, regulator testIdentity
+}
+
+func newTestIdentities(t *testing.T) testIdentities {
+	return testIdentities{
+		manufacturer: newIdentity(t, adminMSPID, "manufacturer", manufacturerRole),
+		alice:        newIdentity(t, "Org2MSP", "alice", ""),
+		bob:          newIdentity(t, "Org2MSP", "bob", ""),
+		regulator:    newIdentity(t, "Org3MSP", "regulator", regulatorRole),
+	}
+}
+
+// checkInvoke invokes function and fails the test unless it succeeds
+func checkInvoke(t *testing.T, stub *testStub, function string, args ...string) []byte {
+	t.Helper()
+	res := stub.invoke(function, args...)
+	if res.Status != shim.OK {
+		t.Fatalf("%s %v failed: %s", function, args, res.Message)
+	}
+	return res.Payload
+}
+
+// checkInvokeFails invokes function, fails the test unless it fails with code
+// and returns the decoded error envelope
+func checkInvokeFails(t *testing.T, stub *testStub, code string, function string, args ...string) map[string]string {
+	t.Helper()
+	res := stub.invoke(function, args...)
+	if res.Status == shim.OK {
+		t.Fatalf("%s %v succeeded, expected %s", function, args, code)
+	}
+	envelope := map[string]string{}
+	err := json.Unmarshal([]byte(res.Message), &envelope)
+	if err != nil {
+		t.Fatalf("%s %v: error is not a JSON envelope: %s", function, args, res.Message)
+	}
+	if envelope["code"] != code {
+		t.Fatalf("%s %v failed with %s, expected %s: %s", function, args, envelope["code"], code, envelope["message"])
+	}
+	return envelope
+}
+
+// initTestProduct mints a product owned by owner as the manufacturer
+func initTestProduct(t *testing.T, stub *testStub, ids testIdentities, puid string, pname string, ptype string, owner testIdentity, optional ...string) {
+	t.Helper()
+	stub.as(ids.manufacturer)
+	checkInvoke(t, stub, "initProduct", append([]string{puid, pname, ptype, owner.id}, optional...)...)
+}
+
+// readTestProduct returns the stored record of puid
+func readTestProduct(t *testing.T, stub *testStub, puid string) product {
+	t.Helper()
+	p := product{}
+	err := json.Unmarshal(checkInvoke(t, stub, "readProduct", puid), &p)
+	if err != nil {
+		t.Fatalf("readProduct %s: %s", puid, err)
+	}
+	return p
+}
+
+// keysUnder lists the state keys of the composite index indexName starting with attributes
+func keysUnder(t *testing.T, stub *testStub, indexName string, attributes ...string) []string {
+	t.Helper()
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(indexName, attributes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resultsIterator.Close()
+	keys := []string{}
+	for resultsIterator.HasNext() {
+		kv, err := resultsIterator.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, kv.Key)
+	}
+	return keys
+}
+
+func TestDeleteProduct(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	initTestProduct(t, stub, ids, "p1", "widget", "10", ids.alice)
+	initTestProduct(t, stub, ids, "p2", "gadget", "10", ids.alice)
+	stub.as(ids.alice)
+	checkInvoke(t, stub, "logSensorReading", "p1", "temperature", "5.5")
+	checkInvoke(t, stub, "proposeTransfer", "p1", ids.bob.id)
+
+	stub.as(ids.bob)
+	checkInvokeFails(t, stub, codeForbidden, "deleteProduct", "p1")
+
+	stub.as(ids.alice)
+	checkInvoke(t, stub, "deleteProduct", "p1")
+	if value, _ := stub.GetState("p1"); value != nil {
+		t.Fatalf("p1 still in state: %s", value)
+	}
+	for _, indexName := range productIndexNames {
+		for _, key := range keysUnder(t, stub, indexName) {
+			_, parts, _ := stub.SplitCompositeKey(key)
+			if parts[len(parts)-1] == "p1" {
+				t.Errorf("index entry of p1 left behind: %q", key)
+			}
+		}
+	}
+	if keys := keysUnder(t, stub, "type~name~puid", "10", "gadget"); len(keys) != 1 {
+		t.Errorf("index entry of p2 removed, got %v", keys)
+	}
+	if keys := keysUnder(t, stub, "puid~sensor~timestamp", "p1"); len(keys) != 0 {
+		t.Errorf("sensor readings of p1 left behind: %q", keys)
+	}
+	if keys := keysUnder(t, stub, "pendingTransfer~puid", "p1"); len(keys) != 0 {
+		t.Errorf("pending transfer of p1 left behind: %q", keys)
+	}
+
+	checkInvokeFails(t, stub, codeNotFound, "deleteProduct", "p1")
+}
+
+func TestTransferProductEvent(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	initTestProduct(t, stub, ids, "p1", "widget", "10", ids.alice)
+
+	stub.as(ids.alice)
+	transferredAt := stub.now
+	checkInvoke(t, stub, "transferProduct", "p1", ids.bob.id)
+
+	event := stub.events[len(stub.events)-1]
+	if event.EventName != productTransferredEvent {
+		t.Fatalf("last event is %s, expected %s", event.EventName, productTransferredEvent)
+	}
+	payload := map[string]interface{}{}
+	err := json.Unmarshal(event.Payload, &payload)
+	if err != nil {
+		t.Fatalf("event payload is not JSON: %s", err)
+	}
+	for _, field := range []string{"puid", "previousOwner", "newOwner", "timestamp", "initiatedBy", "txId", "changed"} {
+		if _, ok := payload[field]; !ok {
+			t.Errorf("event payload has no %s: %s", field, event.Payload)
+		}
+	}
+	if payload["puid"] != "p1" || payload["previousOwner"] != ids.alice.id || payload["newOwner"] != ids.bob.id {
+		t.Errorf("unexpected event payload: %s", event.Payload)
+	}
+	if payload["timestamp"] != float64(transferredAt) {
+		t.Errorf("event timestamp is %v, expected %d", payload["timestamp"], transferredAt)
+	}
+	if payload["txId"] != stub.history["p1"][len(stub.history["p1"])-1].TxId {
+		t.Errorf("event txId %v is not the transaction that wrote p1", payload["txId"])
+	}
+
+	// ==== A refused transfer emits nothing ====
+	eventCount := len(stub.events)
+	checkInvokeFails(t, stub, codeForbidden, "transferProduct", "p1", ids.alice.id)
+	if len(stub.events) != eventCount {
+		t.Errorf("refused transfer emitted %s", stub.events[len(stub.events)-1].EventName)
+	}
+}
+
+func TestTransferProductRequiresOwner(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	initTestProduct(t, stub, ids, "p1", "widget", "10", ids.alice)
+
+	// ==== Neither a stranger nor a client without a creator may transfer ====
+	stub.as(ids.bob)
+	checkInvokeFails(t, stub, codeForbidden, "transferProduct", "p1", ids.bob.id)
+	stub.as(testIdentity{})
+	stub.invoke("transferProduct", "p1", ids.bob.id)
+	if owner := readTestProduct(t, stub, "p1").Owner; owner != ids.alice.id {
+		t.Fatalf("p1 was transferred by a client without a creator to %s", owner)
+	}
+
+	// ==== The owner may, and the owner keeps its case ====
+	stub.as(ids.alice)
+	checkInvoke(t, stub, "transferProduct", "p1", ids.bob.id)
+	if owner := readTestProduct(t, stub, "p1").Owner; owner != ids.bob.id {
+		t.Fatalf("owner is %s, expected %s", owner, ids.bob.id)
+	}
+
+	// ==== A regulator may force a transfer of a product it does not own ====
+	stub.now += defaultTransferCooldownSeconds
+	stub.as(ids.regulator)
+	checkInvoke(t, stub, "transferProduct", "p1", ids.alice.id)
+	if owner := readTestProduct(t, stub, "p1").Owner; owner != ids.alice.id {
+		t.Fatalf("owner is %s after the regulator's transfer, expected %s", owner, ids.alice.id)
+	}
+}
+
+func TestProductMutationsRequireOwner(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	initTestProduct(t, stub, ids, "p1", "widget", "10", ids.alice)
+
+	mutations := [][]string{
+		{"updateProduct", "p1", "gizmo", "10"},
+		{"changeStatus", "p1", statusInTransit},
+		{"logSensorReading", "p1", "temperature", "5.5"},
+		{"logLocation", "p1", "Warehouse-7, Mumbai"},
+		{"setMetadata", "p1", `{"grade":"A"}`},
+		{"deleteProduct", "p1"},
+	}
+	stub.as(ids.bob)
+	for _, mutation := range mutations {
+		checkInvokeFails(t, stub, codeForbidden, mutation[0], mutation[1:]...)
+	}
+	stub.as(ids.alice)
+	for _, mutation := range mutations {
+		checkInvoke(t, stub, mutation[0], mutation[1:]...)
+	}
+}
+
+func TestReadProductMissingError(t *testing.T) {
+	stub := newTestStub(t)
+
+	res := stub.invoke("readProduct", "nope")
+	expected := `{"code":"NOT_FOUND","message":"Product does not exist: nope","error":"Product does not exist: nope","puid":"nope"}`
+	if res.Message != expected {
+		t.Fatalf("readProduct of a missing product returned %s, expected %s", res.Message, expected)
+	}
+
+	envelope := checkInvokeFails(t, stub, codeNotFound, "transferProduct", "nope", "bob")
+	if envelope["puid"] != "nope" || envelope["error"] != envelope["message"] {
+		t.Errorf("unexpected transferProduct error envelope: %v", envelope)
+	}
+}
+
+// historyOf returns the decoded getHistoryForProduct entries of puid within the window
+func historyOf(t *testing.T, stub *testStub, puid string, startTs string, endTs string) []HistoryResult {
+	t.Helper()
+	entries := []HistoryResult{}
+	err := json.Unmarshal(checkInvoke(t, stub, "getHistoryForProduct", puid, startTs, endTs), &entries)
+	if err != nil {
+		t.Fatalf("getHistoryForProduct %s: %s", puid, err)
+	}
+	return entries
+}
+
+func TestGetHistoryForProductInRange(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	createdAt := stub.now
+	initTestProduct(t, stub, ids, "p1", "widget", "10", ids.alice)
+	stub.as(ids.alice)
+	stub.now = createdAt + 100
+	checkInvoke(t, stub, "updateProduct", "p1", "gizmo", "10")
+	stub.now = createdAt + 200
+	checkInvoke(t, stub, "updateProduct", "p1", "gadget", "10")
+
+	for _, test := range []struct {
+		startTs, endTs string
+		expected       int
+	}{
+		{"", "", 3},
+		{strconv.FormatInt(createdAt+50, 10), strconv.FormatInt(createdAt+150, 10), 1},
+		{strconv.FormatInt(createdAt+100, 10), strconv.FormatInt(createdAt+200, 10), 2}, //both ends inclusive
+		{strconv.FormatInt(createdAt+101, 10), "", 1},
+		{"", strconv.FormatInt(createdAt-1, 10), 0},
+	} {
+		entries := historyOf(t, stub, "p1", test.startTs, test.endTs)
+		if len(entries) != test.expected {
+			t.Errorf("history within [%s, %s] has %d entries, expected %d", test.startTs, test.endTs, len(entries), test.expected)
+		}
+	}
+
+	entries := historyOf(t, stub, "p1", strconv.FormatInt(createdAt+50, 10), strconv.FormatInt(createdAt+150, 10))
+	p := product{}
+	err := json.Unmarshal(entries[0].Value, &p)
+	if err != nil || p.Pname != "gizmo" {
+		t.Errorf("history within the window holds %s, expected the gizmo version", entries[0].Value)
+	}
+	checkInvokeFails(t, stub, codeValidation, "getHistoryForProduct", "p1", "yesterday")
+}
+
+func TestInitProductBatchDropsForgedFields(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	initTestProduct(t, stub, ids, "p0", "gadget", "10", ids.bob)
+	forged := fmt.Sprintf(`[{"puid":"p1","pname":"Widget","ptype":"10","owner":%q,"quantity":3,"weight":2,"unit":"kg",`+
+		`"childPuids":["p0"],"parentPuids":["p0"],"escrow":{"agent":%q,"originalOwner":%q,"recipient":%q},`+
+		`"owners":{%q:10},"archived":true,"serialNo":7,"price":99,"currency":"USD","lastTransferAt":4102444800,`+
+		`"complianceBreached":true,"restoredFrom":"tx0","lastModifiedBy":"x","transferReasonHash":"abc","requestId":"r1",`+
+		`"metadata":{"origin":"forged"},"status":"sold","version":40,"createdAt":1,"createdBy":"x","ownerHistory":["x"]}]`,
+		ids.alice.id, ids.manufacturer.id, ids.manufacturer.id, ids.alice.id, ids.bob.id)
+
+	stub.as(ids.manufacturer)
+	mintedAt := stub.now
+	checkInvoke(t, stub, "initProductBatch", forged)
+	p := readTestProduct(t, stub, "p1")
+	expected := product{
+		ObjectType:   defaultDocType,
+		Puid:         "p1",
+		Pname:        "widget",
+		DisplayName:  "Widget",
+		Ptype:        "10",
+		Owner:        ids.alice.id,
+		OwnerHistory: []string{},
+		Status:       statusManufactured,
+		Quantity:     3,
+		CreatedAt:    mintedAt,
+		UpdatedAt:    mintedAt,
+		Version:      1,
+		CreatedBy:    ids.manufacturer.id,
+		Weight:       2,
+		Unit:         "kg",
+	}
+	gotJSON, _ := json.Marshal(p)
+	expectedJSON, _ := json.Marshal(expected)
+	if !bytes.Equal(gotJSON, expectedJSON) {
+		t.Fatalf("batch product kept forged fields:\n got %s\nwant %s", gotJSON, expectedJSON)
+	}
+
+	// ==== The forged child is not recalled with it, nor is the transfer held up ====
+	stub.as(ids.alice)
+	checkInvoke(t, stub, "recallProduct", "p1", "contaminated")
+	if status := readTestProduct(t, stub, "p0").Status; status == statusRecalled {
+		t.Errorf("p0 of another owner was recalled")
+	}
+	stub.as(ids.manufacturer)
+	checkInvoke(t, stub, "initProductBatch", `[{"puid":"p2","pname":"sprocket","ptype":"10","owner":"`+ids.alice.id+`","lastTransferAt":4102444800}]`)
+	stub.as(ids.alice)
+	checkInvoke(t, stub, "transferProduct", "p2", ids.bob.id)
+
+	// ==== With StrictArgs the forged fields are refused ====
+	stub.as(ids.manufacturer)
+	checkInvoke(t, stub, "setConfig", `{"strictArgs":true}`)
+	envelope := checkInvokeFails(t, stub, codeValidation, "initProductBatch", `[{"puid":"p3","pname":"bolt","ptype":"10","owner":"`+ids.alice.id+`","childPuids":["p0"]}]`)
+	if !strings.Contains(envelope["message"], "childPuids") {
+		t.Errorf("error does not name the forged field: %s", envelope["message"])
+	}
+	checkInvokeFails(t, stub, codeValidation, "initProductBatch", `[{"puid":"p3","pname":"bolt","ptype":"10","owner":"`+ids.alice.id+`","quantity":-1}]`)
+}
+
+func TestInitProductRejectsNonNumericQuantity(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	stub.as(ids.manufacturer)
+
+	for quantity, message := range map[string]string{
+		"ten": "5th argument must be a numeric string",
+		"1.5": "5th argument must be a numeric string",
+		"0":   "5th argument must be a positive number",
+	} {
+		envelope := checkInvokeFails(t, stub, codeValidation, "initProduct", "p1", "widget", "10", ids.alice.id, quantity)
+		if envelope["message"] != message {
+			t.Errorf("quantity %q rejected with %q, expected %q", quantity, envelope["message"], message)
+		}
+	}
+	if value, _ := stub.GetState("p1"); value != nil {
+		t.Fatalf("rejected product was stored: %s", value)
+	}
+	checkInvoke(t, stub, "initProduct", "p1", "widget", "10", ids.alice.id, "12")
+	if quantity := readTestProduct(t, stub, "p1").Quantity; quantity != 12 {
+		t.Errorf("quantity is %d, expected 12", quantity)
+	}
+}
+
+// puidsOf returns the keys of a JSON array of QueryResult, in order
+func puidsOf(t *testing.T, payload []byte) []string {
+	t.Helper()
+	results := []QueryResult{}
+	err := json.Unmarshal(payload, &results)
+	if err != nil {
+		t.Fatalf("results are not a JSON array of records: %s: %s", err, payload)
+	}
+	puids := []string{}
+	for _, result := range results {
+		p := product{}
+		err = json.Unmarshal(result.Record, &p)
+		if err != nil || p.Puid != result.Key {
+			t.Fatalf("record of %s is not its product: %s", result.Key, result.Record)
+		}
+		puids = append(puids, result.Key)
+	}
+	return puids
+}
+
+// indexEntriesOf lists the entries of productIndexNames ending in puid
+func indexEntriesOf(t *testing.T, stub *testStub, puid string) []string {
+	t.Helper()
+	entries := []string{}
+	for _, indexName := range productIndexNames {
+		for _, key := range keysUnder(t, stub, indexName) {
+			_, parts, _ := stub.SplitCompositeKey(key)
+			if parts[len(parts)-1] == puid {
+				entries = append(entries, key)
+			}
+		}
+	}
+	return entries
+}
+
+func TestSplitProduct(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	initTestProduct(t, stub, ids, "p1", "widget", "10", ids.alice, "10")
+
+	stub.as(ids.bob)
+	checkInvokeFails(t, stub, codeForbidden, "splitProduct", "p1", "4")
+	stub.as(ids.alice)
+	checkInvokeFails(t, stub, codeValidation, "splitProduct", "p1", "0")
+	checkInvokeFails(t, stub, codeConflict, "splitProduct", "p1", "11")
+
+	// ==== The child takes the amount and a puid derived from the transaction ====
+	childPuid := fmt.Sprintf("p1-tx%d", stub.txNum+1)
+	child := product{}
+	json.Unmarshal(checkInvoke(t, stub, "splitProduct", "p1", "4"), &child)
+	if child.Puid != childPuid || child.Quantity != 4 || !reflect.DeepEqual(child.ParentPuids, []string{"p1"}) {
+		t.Fatalf("split off %s quantity %d parents %v, expected %s quantity 4 parents [p1]", child.Puid, child.Quantity, child.ParentPuids, childPuid)
+	}
+	source := readTestProduct(t, stub, "p1")
+	if source.Quantity+child.Quantity != 10 || !reflect.DeepEqual(source.ChildPuids, []string{childPuid}) {
+		t.Errorf("source left with quantity %d children %v", source.Quantity, source.ChildPuids)
+	}
+	if stored := readTestProduct(t, stub, childPuid); stored.Owner != ids.alice.id || stored.Version != 1 {
+		t.Errorf("stored child has owner %s version %d", stored.Owner, stored.Version)
+	}
+	if entries := indexEntriesOf(t, stub, childPuid); len(entries) != len(productIndexNames) {
+		t.Errorf("child indexed under %q, expected one entry per index", entries)
+	}
+	checkInvokeFails(t, stub, codeConflict, "splitProduct", "p1", "7")
+
+	// ==== A recall reaches the split-off product ====
+	checkInvoke(t, stub, "recallProduct", "p1", "contaminated")
+	for _, puid := range []string{"p1", childPuid} {
+		if status := readTestProduct(t, stub, puid).Status; status != statusRecalled {
+			t.Errorf("%s has status %s after recalling p1", puid, status)
+		}
+	}
+	checkInvokeFails(t, stub, codeConflict, "splitProduct", "p1", "1")
+}
+
+func TestMergeProduct(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	initTestProduct(t, stub, ids, "p1", "widget", "10", ids.alice, "3")
+	initTestProduct(t, stub, ids, "p2", "widget", "20", ids.alice, "2")
+	initTestProduct(t, stub, ids, "p3", "gadget", "10", ids.bob, "2")
+	initTestProduct(t, stub, ids, "p4", "sprocket", "10", ids.alice, "2")
+
+	stub.as(ids.alice)
+	checkInvokeFails(t, stub, codeConflict, "mergeProduct", "p1", "p2")
+	checkInvokeFails(t, stub, codeConflict, "mergeProduct", "p1", "p3")
+	checkInvokeFails(t, stub, codeValidation, "mergeProduct", "p1", "p1")
+	stub.as(ids.bob)
+	checkInvokeFails(t, stub, codeForbidden, "mergeProduct", "p1", "p4")
+
+	// ==== The source is folded into the target and removed with its records ====
+	stub.as(ids.alice)
+	checkInvoke(t, stub, "proposeTransfer", "p4", ids.bob.id)
+	checkInvoke(t, stub, "mergeProduct", "p1", "p4")
+	target := readTestProduct(t, stub, "p1")
+	if target.Quantity != 5 || !reflect.DeepEqual(target.ParentPuids, []string{"p4"}) {
+		t.Errorf("merged p1 has quantity %d parents %v, expected 5 and [p4]", target.Quantity, target.ParentPuids)
+	}
+	if value, _ := stub.GetState("p4"); value != nil {
+		t.Errorf("merged p4 still in state: %s", value)
+	}
+	if entries := indexEntriesOf(t, stub, "p4"); len(entries) != 0 {
+		t.Errorf("index entries of merged p4 left behind: %q", entries)
+	}
+	if keys := keysUnder(t, stub, "pendingTransfer~puid", "p4"); len(keys) != 0 {
+		t.Errorf("pending transfer of merged p4 left behind: %q", keys)
+	}
+	if entries := indexEntriesOf(t, stub, "p1"); len(entries) != len(productIndexNames) {
+		t.Errorf("p1 indexed under %q, expected one entry per index", entries)
+	}
+	checkInvokeFails(t, stub, codeNotFound, "mergeProduct", "p1", "p4")
+}
+
+func TestGetProductsByType(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	initTestProduct(t, stub, ids, "p1", "widget", "10", ids.alice)
+	initTestProduct(t, stub, ids, "p2", "widget", "20", ids.alice)
+	initTestProduct(t, stub, ids, "p3", "gadget", "10", ids.bob)
+
+	for ptype, expected := range map[string][]string{
+		"10": {"p3", "p1"}, //ordered by name, then puid
+		"20": {"p2"},
+		"30": {},
+	} {
+		puids := puidsOf(t, checkInvoke(t, stub, "getProductsByType", ptype))
+		if !reflect.DeepEqual(puids, expected) {
+			t.Errorf("products of type %s are %v, expected %v", ptype, puids, expected)
+		}
+	}
+}
+
+func TestProductPrivateDetails(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	initTestProduct(t, stub, ids, "p1", "widget", "10", ids.alice)
+	details := `{"puid":"p1","cost":12.5,"supplierContract":"ACME-2019-04"}`
+
+	stub.as(ids.alice)
+	checkInvokeFails(t, stub, codeValidation, "initProductPrivateDetails")
+	stub.transient = map[string][]byte{"product_private": []byte(details)}
+	checkInvoke(t, stub, "initProductPrivateDetails")
+	if _, ok := stub.PvtState[productPrivateCollection]["p1"]; !ok {
+		t.Fatalf("private details not written to %s", productPrivateCollection)
+	}
+
+	private := productPrivateDetails{}
+	err := json.Unmarshal(checkInvoke(t, stub, "readProductPrivate", "p1"), &private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if private.Cost != 12.5 || private.SupplierContract != "ACME-2019-04" {
+		t.Errorf("unexpected private details: %+v", private)
+	}
+
+	public := string(checkInvoke(t, stub, "readProduct", "p1"))
+	for _, secret := range []string{"cost", "12.5", "supplierContract", "ACME"} {
+		if strings.Contains(public, secret) {
+			t.Errorf("readProduct leaks %s: %s", secret, public)
+		}
+	}
+
+	stub.as(ids.bob)
+	stub.transient = map[string][]byte{"product_private": []byte(details)}
+	checkInvokeFails(t, stub, codeForbidden, "initProductPrivateDetails")
+}
+
+func TestInitProductValidatesPuid(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	stub.as(ids.manufacturer)
+
+	for _, puid := range []string{
+		"p\x001",
+		"\x00",
+		strings.Repeat("p", maxPuidLength+1),
+		" p1",
+		"p1\t",
+		"p\xff1",
+		configKey,
+	} {
+		checkInvokeFails(t, stub, codeValidation, "initProduct", puid, "widget", "10", ids.alice.id)
+	}
+	if len(stub.State) != 0 {
+		t.Fatalf("rejected puids left %d keys in state", len(stub.State))
+	}
+
+	longest := strings.Repeat("p", maxPuidLength)
+	checkInvoke(t, stub, "initProduct", longest, "widget", "10", ids.alice.id)
+	readTestProduct(t, stub, longest)
+}
+
+func TestTransferProductStaleVersion(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	initTestProduct(t, stub, ids, "p1", "widget", "10", ids.alice)
+	if version := readTestProduct(t, stub, "p1").Version; version != 1 {
+		t.Fatalf("new product has version %d, expected 1", version)
+	}
+
+	// ==== Two clients read version 1, the second write is stale ====
+	stub.as(ids.regulator)
+	checkInvoke(t, stub, "transferProduct", "p1", ids.bob.id, "1")
+	stub.now += defaultTransferCooldownSeconds
+	envelope := checkInvokeFails(t, stub, codeConflict, "transferProduct", "p1", ids.alice.id, "1")
+	if envelope["message"] != "Version mismatch for p1: expected 1, current 2" {
+		t.Errorf("unexpected stale version error: %s", envelope["message"])
+	}
+	if p := readTestProduct(t, stub, "p1"); p.Owner != ids.bob.id || p.Version != 2 {
+		t.Fatalf("stale transfer changed p1: owner %s, version %d", p.Owner, p.Version)
+	}
+
+	checkInvokeFails(t, stub, codeValidation, "transferProduct", "p1", ids.alice.id, "two")
+	checkInvoke(t, stub, "transferProduct", "p1", ids.alice.id, "2")
+	if version := readTestProduct(t, stub, "p1").Version; version != 3 {
+		t.Errorf("version is %d after the second transfer, expected 3", version)
+	}
+}
+
+func TestInitProductResponse(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	stub.as(ids.manufacturer)
+	createdAt := stub.now
+
+	response := struct {
+		Puid      string `json:"puid"`
+		IndexKey  string `json:"indexKey"`
+		Timestamp int64  `json:"timestamp"`
+	}{}
+	err := json.Unmarshal(checkInvoke(t, stub, "initProduct", "p1", "Widget", "10", ids.alice.id), &response)
+	if err != nil {
+		t.Fatalf("initProduct payload is not JSON: %s", err)
+	}
+	indexKey, _ := stub.CreateCompositeKey("type~name~puid", []string{"10", "widget", "p1"})
+	if response.Puid != "p1" || response.IndexKey != indexKey || response.Timestamp != createdAt {
+		t.Errorf("unexpected initProduct payload: %+v", response)
+	}
+	if _, ok := stub.State[response.IndexKey]; !ok {
+		t.Errorf("returned index key %q is not in state", response.IndexKey)
+	}
+
+	// ==== A generated puid is returned ====
+	err = json.Unmarshal(checkInvoke(t, stub, "initProduct", "", "gadget", "10", ids.alice.id), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(response.Puid, generatedPuidPrefix) {
+		t.Fatalf("generated puid %s lacks %s", response.Puid, generatedPuidPrefix)
+	}
+	readTestProduct(t, stub, response.Puid)
+}
+
+func TestGetHistoryForProductTimestamps(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	stub.now = 1700000000
+	initTestProduct(t, stub, ids, "p1", "widget", "10", ids.alice)
+
+	payload := checkInvoke(t, stub, "getHistoryForProduct", "p1")
+	if !strings.Contains(string(payload), `"Timestamp":"2023-11-14T22:13:20Z"`) {
+		t.Errorf("history timestamp is not RFC3339: %s", payload)
+	}
+	entries := historyOf(t, stub, "p1", "", "")
+	if entries[0].TxId != stub.history["p1"][0].TxId {
+		t.Errorf("history TxId is %s, expected %s", entries[0].TxId, stub.history["p1"][0].TxId)
+	}
+}
+
+func TestInitProductRequiresManufacturerRole(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+
+	stub.as(ids.alice)
+	envelope := checkInvokeFails(t, stub, codeForbidden, "initProduct", "p1", "widget", "10", ids.alice.id)
+	if envelope["message"] != "Caller certificate has no role attribute, manufacturer required" {
+		t.Errorf("unexpected error for a certificate without a role: %s", envelope["message"])
+	}
+	stub.as(ids.regulator)
+	envelope = checkInvokeFails(t, stub, codeForbidden, "initProduct", "p1", "widget", "10", ids.alice.id)
+	if envelope["message"] != "Caller role is regulator, manufacturer required" {
+		t.Errorf("unexpected error for a regulator: %s", envelope["message"])
+	}
+	if value, _ := stub.GetState("p1"); value != nil {
+		t.Fatalf("product minted without the manufacturer role: %s", value)
+	}
+
+	stub.as(ids.manufacturer)
+	checkInvoke(t, stub, "initProduct", "p1", "widget", "10", ids.alice.id)
+	if createdBy := readTestProduct(t, stub, "p1").CreatedBy; createdBy != ids.manufacturer.id {
+		t.Errorf("CreatedBy is %s, expected the manufacturer", createdBy)
+	}
+}
+
+func TestInitProductIndexWriteFailure(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	stub.failPutState = func(key string) bool {
+		return strings.HasPrefix(key, "\x00owner~puid\x00")
+	}
+
+	stub.as(ids.manufacturer)
+	envelope := checkInvokeFails(t, stub, codeInternal, "initProduct", "p1", "widget", "10", ids.alice.id)
+	if !strings.Contains(envelope["message"], "owner~puid") {
+		t.Errorf("index write failure not reported: %s", envelope["message"])
+	}
+}
+
+func TestSellProductValidatesPrice(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	initTestProduct(t, stub, ids, "p1", "widget", "10", ids.alice)
+
+	stub.as(ids.alice)
+	for _, price := range []string{"NaN", "Inf", "-Inf", "-1", "ten"} {
+		checkInvokeFails(t, stub, codeValidation, "sellProduct", "p1", ids.bob.id, price, "USD")
+	}
+	checkInvokeFails(t, stub, codeValidation, "sellProduct", "p1", ids.bob.id, "12.5", "XYZ")
+	checkInvoke(t, stub, "sellProduct", "p1", ids.bob.id, "12.5", "usd")
+	if p := readTestProduct(t, stub, "p1"); p.Owner != ids.bob.id || p.Price != 12.5 || p.Currency != "USD" {
+		t.Errorf("sold p1 has owner %s, price %g %s", p.Owner, p.Price, p.Currency)
+	}
+}
+
+func TestGetProductsByOwnerAndType(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	initTestProduct(t, stub, ids, "p1", "phone", "electronics", ids.alice)
+	initTestProduct(t, stub, ids, "p2", "laptop", "electronics", ids.alice)
+	initTestProduct(t, stub, ids, "p3", "apple", "food", ids.alice)
+	initTestProduct(t, stub, ids, "p4", "tablet", "electronics", ids.bob)
+
+	productsOf := func(owner testIdentity, ptype string) []string {
+		return puidsOf(t, checkInvoke(t, stub, "getProductsByOwnerAndType", owner.id, ptype))
+	}
+	if puids := productsOf(ids.alice, "electronics"); !reflect.DeepEqual(puids, []string{"p1", "p2"}) {
+		t.Errorf("alice's electronics are %v, expected [p1 p2]", puids)
+	}
+	if puids := productsOf(ids.alice, "food"); !reflect.DeepEqual(puids, []string{"p3"}) {
+		t.Errorf("alice's food is %v, expected [p3]", puids)
+	}
+
+	// ==== A transfer moves the entry to the new owner ====
+	stub.as(ids.alice)
+	checkInvoke(t, stub, "transferProduct", "p1", ids.bob.id)
+	if puids := productsOf(ids.alice, "electronics"); !reflect.DeepEqual(puids, []string{"p2"}) {
+		t.Errorf("alice's electronics are %v after the transfer, expected [p2]", puids)
+	}
+	if puids := productsOf(ids.bob, "electronics"); !reflect.DeepEqual(puids, []string{"p1", "p4"}) {
+		t.Errorf("bob's electronics are %v after the transfer, expected [p1 p4]", puids)
+	}
+}
+
+func TestExportProductsSkipsCompositeKeys(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	stub.as(ids.manufacturer)
+	checkInvoke(t, stub, "setConfig", `{"maxMetadataBytes":8192}`)
+	initTestProduct(t, stub, ids, "p1", "widget", "10", ids.alice)
+	initTestProduct(t, stub, ids, "p2", "gadget", "20", ids.alice)
+	stub.as(ids.alice)
+	checkInvoke(t, stub, "proposeTransfer", "p1", ids.bob.id)
+	checkInvoke(t, stub, "logSensorReading", "p2", "temperature", "5.5")
+
+	compositeKeys := 0
+	for key := range stub.State {
+		if strings.ContainsRune(key, 0) {
+			compositeKeys++
+		}
+	}
+	if compositeKeys == 0 {
+		t.Fatal("no composite keys in state to skip")
+	}
+	if puids := puidsOf(t, checkInvoke(t, stub, "exportProducts")); !reflect.DeepEqual(puids, []string{"p1", "p2"}) {
+		t.Errorf("exported %v, expected [p1 p2]", puids)
+	}
+}
+
+func TestGetExpiredProducts(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	expiresAt := func(seconds int64) string {
+		return strconv.FormatInt(stub.now+seconds, 10)
+	}
+	stub.as(ids.manufacturer)
+	checkInvokeFails(t, stub, codeValidation, "initProduct", "p0", "stale", "10", ids.alice.id, "", "", "", "", expiresAt(-1))
+	initTestProduct(t, stub, ids, "p1", "milk", "10", ids.alice, "", "", "", "", expiresAt(10))
+	initTestProduct(t, stub, ids, "p2", "cheese", "10", ids.alice, "", "", "", "", expiresAt(1000))
+	initTestProduct(t, stub, ids, "p3", "salt", "10", ids.alice)
+
+	if puids := puidsOf(t, checkInvoke(t, stub, "getExpiredProducts")); len(puids) != 0 {
+		t.Errorf("expired before any expiry date: %v", puids)
+	}
+	stub.now += 100
+	if puids := puidsOf(t, checkInvoke(t, stub, "getExpiredProducts")); !reflect.DeepEqual(puids, []string{"p1"}) {
+		t.Errorf("expired products are %v, expected [p1]", puids)
+	}
+	stub.now += 1000
+	if puids := puidsOf(t, checkInvoke(t, stub, "getExpiredProducts")); !reflect.DeepEqual(puids, []string{"p1", "p2"}) {
+		t.Errorf("expired products are %v, expected [p1 p2]", puids)
+	}
+}
+
+func TestInitProductUniqueNameWithinType(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	initTestProduct(t, stub, ids, "p1", "widget", "10", ids.alice)
+
+	envelope := checkInvokeFails(t, stub, codeAlreadyExists, "initProduct", "p2", "Widget", "10", ids.bob.id)
+	if envelope["message"] != "A product of type 10 named widget already exists: p1" {
+		t.Errorf("unexpected duplicate name error: %s", envelope["message"])
+	}
+	if value, _ := stub.GetState("p2"); value != nil {
+		t.Fatalf("duplicate product was stored: %s", value)
+	}
+	// the same name is fine in another type
+	checkInvoke(t, stub, "initProduct", "p2", "widget", "20", ids.bob.id)
+}
+
+func TestQueryProductValidatesQueryString(t *testing.T) {
+	stub := newTestStub(t)
+
+	for queryString, message := range map[string]string{
+		"":                       "Query string must not be empty",
+		"   ":                    "Query string must not be empty",
+		"owner":                  "Query string must be a JSON object",
+		`{"selector":`:           "Query string must be a JSON object",
+		`["selector"]`:           "Query string must be a JSON object",
+		`{"owner":"tom"}`:        `Query string must have a top-level "selector"`,
+		`{"selector":"owner"}`:   `Query "selector" must be a JSON object`,
+		`{"selector":["owner"]}`: `Query "selector" must be a JSON object`,
+	} {
+		envelope := checkInvokeFails(t, stub, codeValidation, "queryProduct", queryString)
+		if !strings.HasPrefix(envelope["message"], message) {
+			t.Errorf("query %q rejected with %q, expected %q", queryString, envelope["message"], message)
+		}
+	}
+	if len(stub.lastQuery) > 0 {
+		t.Fatalf("a malformed query reached GetQueryResult: %s", stub.lastQuery)
+	}
+
+	checkInvoke(t, stub, "queryProduct", `{"selector":{"owner":"tom"}}`)
+	if len(stub.lastQuery) == 0 {
+		t.Fatal("a valid query did not reach GetQueryResult")
+	}
+}
+
+func TestTransferProductBlockedStatus(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	initTestProduct(t, stub, ids, "p1", "widget", "10", ids.alice)
+	initTestProduct(t, stub, ids, "p2", "gadget", "10", ids.alice)
+	initTestProduct(t, stub, ids, "p3", "gizmo", "10", ids.alice)
+
+	stub.as(ids.alice)
+	checkInvoke(t, stub, "recallProduct", "p1", "contaminated batch")
+	envelope := checkInvokeFails(t, stub, codeConflict, "transferProduct", "p1", ids.bob.id)
+	if envelope["message"] != "Product p1 cannot be transferred while its status is recalled" {
+		t.Errorf("unexpected error for a recalled product: %s", envelope["message"])
+	}
+	checkInvoke(t, stub, "archiveProduct", "p2")
+	checkInvokeFails(t, stub, codeConflict, "transferProduct", "p2", ids.bob.id)
+
+	// ==== The blocked set can be changed ====
+	defer func(statuses []string) { transferBlockedStatuses = statuses }(transferBlockedStatuses)
+	transferBlockedStatuses = append([]string{statusInTransit}, transferBlockedStatuses...)
+	checkInvoke(t, stub, "changeStatus", "p3", statusInTransit)
+	envelope = checkInvokeFails(t, stub, codeConflict, "transferProduct", "p3", ids.bob.id)
+	if !strings.Contains(envelope["message"], statusInTransit) {
+		t.Errorf("error does not name the blocking status: %s", envelope["message"])
+	}
+	if owner := readTestProduct(t, stub, "p3").Owner; owner != ids.alice.id {
+		t.Fatalf("blocked product was transferred to %s", owner)
+	}
+}
+
+func TestTransferProductConfidentialReason(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	initTestProduct(t, stub, ids, "p1", "widget", "10", ids.alice)
+	reason := "PO-2019-0042, settlement of invoice 17"
+
+	stub.as(ids.alice)
+	stub.transient = map[string][]byte{transferReasonTransientKey: []byte(reason)}
+	checkInvoke(t, stub, "transferProduct", "p1", ids.bob.id)
+
+	reasonHash := sha256.Sum256([]byte(reason))
+	if hash := readTestProduct(t, stub, "p1").TransferReasonHash; hash != hex.EncodeToString(reasonHash[:]) {
+		t.Errorf("TransferReasonHash is %q, expected the SHA-256 of the reason", hash)
+	}
+	for key, modifications := range stub.history {
+		for _, modification := range modifications {
+			if strings.Contains(string(modification.Value), "PO-2019") {
+				t.Errorf("reason written in plaintext under %q", key)
+			}
+		}
+	}
+	for _, event := range stub.events {
+		if strings.Contains(string(event.Payload), "PO-2019") {
+			t.Errorf("reason emitted in plaintext in %s", event.EventName)
+		}
+	}
+
+	// ==== A transfer without a reason clears the hash ====
+	stub.now += defaultTransferCooldownSeconds
+	stub.as(ids.bob)
+	checkInvoke(t, stub, "transferProduct", "p1", ids.alice.id)
+	if hash := readTestProduct(t, stub, "p1").TransferReasonHash; hash != "" {
+		t.Errorf("TransferReasonHash kept %q after a transfer without a reason", hash)
+	}
+}
+
+func TestQueryResultSpecialCharacters(t *testing.T) {
+	buffer, err := marshalQueryResults([]QueryResult{
+		{`p"1\`, json.RawMessage(`{"pname":"say \"hi\""}`)},
+		{"p2\n", json.RawMessage(`{"pname":"<&>ü"}`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `[{"Key":"p\"1\\", "Record":{"pname":"say \"hi\""}},{"Key":"p2\n", "Record":{"pname":"<&>ü"}}]`
+	if buffer.String() != expected {
+		t.Errorf("marshalQueryResults wrote\n%s\nexpected\n%s", buffer.String(), expected)
+	}
+	_, err = marshalQueryResults([]QueryResult{{"p1", json.RawMessage(`{"pname":`)}})
+	if err == nil {
+		t.Error("a record that isn't JSON was marshalled")
+	}
+
+	// ==== Through a handler ====
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	pname := `the "best" \widget\ <&> ü`
+	initTestProduct(t, stub, ids, "p1", pname, "10", ids.alice)
+	payload := checkInvoke(t, stub, "getProductsByType", "10")
+	if !strings.HasPrefix(string(payload), `[{"Key":"p1", "Record":{`) {
+		t.Errorf("unexpected result layout: %s", payload)
+	}
+	results := []QueryResult{}
+	err = json.Unmarshal(payload, &results)
+	if err != nil {
+		t.Fatalf("result with special characters is not valid JSON: %s: %s", err, payload)
+	}
+	p := product{}
+	err = json.Unmarshal(results[0].Record, &p)
+	if err != nil || p.DisplayName != pname {
+		t.Errorf("record did not survive the round trip: %s", results[0].Record)
+	}
+
+	// ==== A bookmark is a state key, which may hold anything ====
+	bookmark := "owner~puid\x00say \"hi\"\\\x00p1\x00"
+	wrapped := addPaginationMetadataToQueryResults(bytes.NewBufferString("[]"), &pb.QueryResponseMetadata{FetchedRecordsCount: 0, Bookmark: bookmark})
+	page := struct {
+		ResponseMetadata struct {
+			Bookmark string
+		}
+	}{}
+	err = json.Unmarshal(wrapped.Bytes(), &page)
+	if err != nil || page.ResponseMetadata.Bookmark != bookmark {
+		t.Errorf("bookmark %q did not survive the round trip: %s", bookmark, wrapped.Bytes())
+	}
+	if expected := `{"Records":[], "ResponseMetadata":{"RecordsCount":0, "Bookmark":"p2"}}`; addPaginationMetadataToQueryResults(bytes.NewBufferString("[]"), &pb.QueryResponseMetadata{Bookmark: "p2"}).String() != expected {
+		t.Errorf("pagination layout changed, expected %s", expected)
+	}
+}
+
+func TestMergeProductCarriesComplianceBreach(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	initTestProduct(t, stub, ids, "p1", "vaccine", "10", ids.alice)
+	initTestProduct(t, stub, ids, "p2", "more vaccine", "10", ids.alice)
+
+	stub.as(ids.alice)
+	checkInvoke(t, stub, "logSensorReading", "p1", "temperature", "5")
+	checkInvoke(t, stub, "logSensorReading", "p2", "temperature", "20")
+	checkInvoke(t, stub, "mergeProduct", "p1", "p2")
+	if !readTestProduct(t, stub, "p1").ComplianceBreached {
+		t.Errorf("merging breached p2 into p1 left p1 compliant")
+	}
+	if keys := keysUnder(t, stub, "puid~sensor~timestamp", "p2"); len(keys) != 0 {
+		t.Errorf("sensor readings of merged p2 left behind: %q", keys)
+	}
+	if keys := keysUnder(t, stub, "puid~sensor~timestamp", "p1"); len(keys) != 1 {
+		t.Errorf("sensor readings of p1 changed by the merge: %q", keys)
+	}
+}
+
+func TestTransferShare(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	for _, puid := range []string{"p1", "p2", "p3", "p4", "p5", "p6"} {
+		initTestProduct(t, stub, ids, puid, "widget"+puid, "10", ids.alice)
+	}
+
+	// ==== Shares move, Owner follows the largest one ====
+	stub.as(ids.bob)
+	checkInvokeFails(t, stub, codeForbidden, "transferShare", "p1", ids.alice.id, ids.bob.id, "40")
+	stub.as(ids.alice)
+	checkInvoke(t, stub, "transferShare", "p1", ids.alice.id, ids.bob.id, "40")
+	p := readTestProduct(t, stub, "p1")
+	if p.Owner != ids.alice.id || p.Owners[ids.alice.id] != 60 || p.Owners[ids.bob.id] != 40 || len(p.OwnerHistory) != 0 {
+		t.Fatalf("after 40%% to bob p1 has owner %s, owners %v, history %v", p.Owner, p.Owners, p.OwnerHistory)
+	}
+	checkInvokeFails(t, stub, codeConflict, "transferShare", "p1", ids.alice.id, ids.bob.id, "70")
+	checkInvoke(t, stub, "transferShare", "p1", ids.alice.id, ids.bob.id, "20")
+	p = readTestProduct(t, stub, "p1")
+	if p.Owner != ids.bob.id || !reflect.DeepEqual(p.OwnerHistory, []string{ids.alice.id}) {
+		t.Fatalf("after 60%% to bob p1 has owner %s, history %v", p.Owner, p.OwnerHistory)
+	}
+	if keys := keysUnder(t, stub, "owner~puid", ids.bob.id, "p1"); len(keys) != 1 {
+		t.Errorf("p1 not indexed under its new owner: %v", keys)
+	}
+
+	// ==== A high-value product changing majority owner needs the new owner's org ====
+	checkInvoke(t, stub, "sellProduct", "p2", ids.bob.id, "20000", "USD", "", "Org2MSP")
+	stub.now += defaultTransferCooldownSeconds
+	stub.as(ids.bob)
+	checkInvoke(t, stub, "transferShare", "p2", ids.bob.id, ids.regulator.id, "10")
+	checkInvokeFails(t, stub, codeValidation, "transferShare", "p2", ids.bob.id, ids.regulator.id, "50")
+	checkInvoke(t, stub, "transferShare", "p2", ids.bob.id, ids.regulator.id, "50", "", "Org3MSP")
+	endorsement := struct {
+		Orgs []string `json:"orgs"`
+	}{}
+	json.Unmarshal(checkInvoke(t, stub, "getProductEndorsement", "p2"), &endorsement)
+	if !reflect.DeepEqual(endorsement.Orgs, []string{"Org2MSP", "Org3MSP"}) {
+		t.Errorf("p2 has endorsement orgs %v, expected Org2MSP and Org3MSP", endorsement.Orgs)
+	}
+
+	// ==== Products that may not change hands are refused ====
+	stub.as(ids.alice)
+	checkInvoke(t, stub, "recallProduct", "p3", "contaminated")
+	checkInvokeFails(t, stub, codeConflict, "transferShare", "p3", ids.alice.id, ids.bob.id, "50")
+	checkInvoke(t, stub, "archiveProduct", "p4")
+	checkInvokeFails(t, stub, codeConflict, "transferShare", "p4", ids.alice.id, ids.bob.id, "50")
+	checkInvoke(t, stub, "escrowProduct", "p5", ids.bob.id, ids.bob.id)
+	stub.as(ids.regulator)
+	checkInvokeFails(t, stub, codeConflict, "transferShare", "p5", escrowOwnerPrefix+ids.bob.id, ids.alice.id, "50")
+	stub.as(ids.alice)
+	checkInvoke(t, stub, "proposeTransfer", "p6", ids.bob.id)
+	checkInvokeFails(t, stub, codeConflict, "transferShare", "p6", ids.alice.id, ids.bob.id, "50")
+
+	stub.putRaw(t, "p7", []byte(`{"puid":`))
+	checkInvokeFails(t, stub, codeCorruptRecord, "transferShare", "p7", ids.alice.id, ids.bob.id, "50")
+}
+
+func TestGetProductsByRangeBoundaries(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	for i, puid := range []string{"a1", "a2", "b1", "b2", "c1"} {
+		initTestProduct(t, stub, ids, puid, "widget"+strconv.Itoa(i), "10", ids.alice)
+	}
+
+	for _, test := range []struct {
+		startKey, endKey string
+		expected         []string
+	}{
+		{"a2", "b2", []string{"a2", "b1"}}, //start included, end excluded
+		{"a2", "c1", []string{"a2", "b1", "b2"}},
+		{"b", "", []string{"b1", "b2", "c1"}}, //empty end runs to the last product
+		{"", "a2", []string{"a1"}},
+		{"", "", []string{"a1", "a2", "b1", "b2", "c1"}},
+		{"b1", "b1", []string{}},
+		{"d", "", []string{}},
+	} {
+		puids := puidsOf(t, checkInvoke(t, stub, "getProductsByRange", test.startKey, test.endKey))
+		if !reflect.DeepEqual(puids, test.expected) {
+			t.Errorf("range [%q, %q) returned %v, expected %v", test.startKey, test.endKey, puids, test.expected)
+		}
+	}
+}
+
+func TestGetProductsByPrefix(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	for i, puid := range []string{"ACME-2", "ACME-10", "ACME-1", "ACME-1-A", "ACME-1é", "ACM", "BCME-1"} {
+		initTestProduct(t, stub, ids, puid, fmt.Sprintf("widget%d", i), "10", ids.alice)
+	}
+
+	for prefix, expected := range map[string][]string{
+		"ACME-1":  {"ACME-1", "ACME-1-A", "ACME-10", "ACME-1é"},
+		"ACME-10": {"ACME-10"},
+		"ACME-":   {"ACME-1", "ACME-1-A", "ACME-10", "ACME-1é", "ACME-2"},
+		"ACME-3":  {},
+	} {
+		if puids := puidsOf(t, checkInvoke(t, stub, "getProductsByPrefix", prefix)); !reflect.DeepEqual(puids, expected) {
+			t.Errorf("prefix %q matched %q, expected %q", prefix, puids, expected)
+		}
+	}
+	for _, function := range []string{"getProductsByPrefix", "getAuditLog"} {
+		checkInvokeFails(t, stub, codeValidation, function, "")
+		checkInvokeFails(t, stub, codeValidation, function, "ACME\x00")
+		checkInvokeFails(t, stub, codeValidation, function, " ACME")
+	}
+}
+
+func TestTransferProductToCurrentOwner(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	initTestProduct(t, stub, ids, "p1", "widget", "10", ids.alice)
+	writes := len(stub.history["p1"])
+
+	stub.as(ids.alice)
+	envelope := checkInvokeFails(t, stub, codeConflict, "transferProduct", "p1", ids.alice.id)
+	if envelope["message"] != "Product p1 is already owned by "+ids.alice.id {
+		t.Errorf("unexpected self-transfer error: %s", envelope["message"])
+	}
+	if len(stub.history["p1"]) != writes {
+		t.Errorf("self-transfer added %d history entries", len(stub.history["p1"])-writes)
+	}
+	checkInvokeFails(t, stub, codeConflict, "transferProductsBatch", `{"p1":"`+ids.alice.id+`"}`)
+
+	// ==== Owners are compared exactly, an id differing in case is another owner ====
+	upperAlice := newIdentity(t, "Org2MSP", "ALICE", "")
+	checkInvoke(t, stub, "transferProduct", "p1", upperAlice.id)
+	if owner := readTestProduct(t, stub, "p1").Owner; owner != upperAlice.id {
+		t.Errorf("p1 owned by %s, expected %s", owner, upperAlice.id)
+	}
+}
+
+func TestTransferProductsBatchAdminOverride(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	admin := newIdentity(t, adminMSPID, "admin", adminRole)
+	outsideAdmin := newIdentity(t, "Org2MSP", "admin", adminRole)
+	initTestProduct(t, stub, ids, "p1", "widget", "10", ids.alice)
+	batch := `{"p1":"` + ids.bob.id + `"}`
+
+	for _, identity := range []testIdentity{ids.bob, ids.manufacturer, outsideAdmin} {
+		stub.as(identity)
+		checkInvokeFails(t, stub, codeForbidden, "transferProductsBatch", batch)
+	}
+	stub.as(admin)
+	checkInvoke(t, stub, "transferProductsBatch", batch)
+	if owner := readTestProduct(t, stub, "p1").Owner; owner != ids.bob.id {
+		t.Errorf("p1 owned by %s after the admin batch, expected bob", owner)
+	}
+}
+
+// partnerChaincode reads a product through getProductForCC, as another chaincode would
+type partnerChaincode struct{}
+
+func (partnerChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	return shim.Success(nil)
+}
+
+func (partnerChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	_, args := stub.GetFunctionAndParameters()
+	return stub.InvokeChaincode("supply", [][]byte{[]byte("getProductForCC"), []byte(args[0])}, "")
+}
+
+func TestGetProductForCC(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	initTestProduct(t, stub, ids, "p1", "Widget", "10", ids.alice, "5")
+
+	partner := shim.NewMockStub("partner", partnerChaincode{})
+	partner.MockPeerChaincode("supply", stub.MockStub)
+	res := partner.MockInvoke("cc1", [][]byte{[]byte("read"), []byte("p1")})
+	if res.Status != shim.OK {
+		t.Fatalf("getProductForCC through InvokeChaincode failed: %s", res.Message)
+	}
+	expected := ccProduct{
+		Schema:      ccProductSchema,
+		Puid:        "p1",
+		DocType:     "product",
+		Pname:       "widget",
+		DisplayName: "Widget",
+		Ptype:       "10",
+		Owner:       ids.alice.id,
+		Status:      statusManufactured,
+		Quantity:    5,
+		Version:     1,
+		UpdatedAt:   readTestProduct(t, stub, "p1").UpdatedAt,
+	}
+	expectedJSONasBytes, _ := json.Marshal(expected)
+	if string(res.Payload) != string(expectedJSONasBytes) {
+		t.Errorf("getProductForCC returned\n%s\nexpected\n%s", res.Payload, expectedJSONasBytes)
+	}
+
+	res = partner.MockInvoke("cc2", [][]byte{[]byte("read"), []byte("nope")})
+	envelope := map[string]string{}
+	if res.Status == shim.OK || json.Unmarshal([]byte(res.Message), &envelope) != nil || envelope["code"] != codeNotFound {
+		t.Errorf("getProductForCC of a missing product returned %d %s", res.Status, res.Message)
+	}
+}
+
+// totalKgOf returns the totalKg reported by getTotalWeightByOwner for owner
+func totalKgOf(t *testing.T, stub *testStub, owner testIdentity) float64 {
+	t.Helper()
+	total := struct {
+		TotalKg float64 `json:"totalKg"`
+	}{}
+	err := json.Unmarshal(checkInvoke(t, stub, "getTotalWeightByOwner", owner.id), &total)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return total.TotalKg
+}
+
+func TestWeightFollowsSplitMergeAndClone(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	initTestProduct(t, stub, ids, "p1", "flour", "10", ids.alice, "10", "", "", "", "", "", "", "", "", "20", "kg")
+	initTestProduct(t, stub, ids, "p2", "more flour", "10", ids.alice, "1", "", "", "", "", "", "", "", "", "500", "g")
+
+	stub.as(ids.alice)
+	child := product{}
+	json.Unmarshal(checkInvoke(t, stub, "splitProduct", "p1", "4"), &child)
+	if child.Weight != 8 || child.Unit != "kg" {
+		t.Errorf("split off 4 of 10 weighs %g %s, expected 8 kg", child.Weight, child.Unit)
+	}
+	if p := readTestProduct(t, stub, "p1"); p.Weight != 12 {
+		t.Errorf("source of the split weighs %g, expected 12", p.Weight)
+	}
+	if total := totalKgOf(t, stub, ids.alice); total != 20.5 {
+		t.Errorf("alice holds %g kg after the split, expected 20.5", total)
+	}
+
+	checkInvoke(t, stub, "mergeProduct", "p1", "p2")
+	if p := readTestProduct(t, stub, "p1"); p.Weight != 12.5 || p.Unit != "kg" {
+		t.Errorf("merged p1 weighs %g %s, expected 12.5 kg", p.Weight, p.Unit)
+	}
+	if total := totalKgOf(t, stub, ids.alice); total != 20.5 {
+		t.Errorf("alice holds %g kg after the merge, expected 20.5", total)
+	}
+
+	stub.as(ids.manufacturer)
+	checkInvoke(t, stub, "cloneProduct", "p1", "p3", "flour copy")
+	if p := readTestProduct(t, stub, "p3"); p.Weight != 12.5 || p.Unit != "kg" {
+		t.Errorf("clone weighs %g %s, expected 12.5 kg", p.Weight, p.Unit)
+	}
+}
+
+func TestTransferProductCorruptRecord(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	stub.putRaw(t, "p1", []byte(`{"puid":"p1","owner":`))
+	stub.putRaw(t, "p2", []byte("{\"puid\":\"p2\xff\"}"))
+
+	stub.as(ids.regulator)
+	envelope := checkInvokeFails(t, stub, codeCorruptRecord, "transferProduct", "p1", ids.bob.id)
+	if envelope["puid"] != "p1" || !strings.HasPrefix(envelope["message"], "Stored record of p1 is not a valid product, it may be corrupt") {
+		t.Errorf("unexpected error for invalid JSON: %v", envelope)
+	}
+	envelope = checkInvokeFails(t, stub, codeCorruptRecord, "transferProduct", "p2", ids.bob.id)
+	if envelope["message"] != "Stored record of p2 is not valid UTF-8, it may be corrupt" {
+		t.Errorf("unexpected error for invalid UTF-8: %s", envelope["message"])
+	}
+	checkInvokeFails(t, stub, codeNotFound, "transferProduct", "p3", ids.bob.id)
+}
+
+func TestGetUntransferredProducts(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	initTestProduct(t, stub, ids, "p1", "widget", "10", ids.alice)
+	initTestProduct(t, stub, ids, "p2", "gadget", "10", ids.alice)
+	initTestProduct(t, stub, ids, "p3", "gizmo", "10", ids.alice)
+	stub.as(ids.alice)
+	checkInvoke(t, stub, "transferProduct", "p2", ids.bob.id)
+	checkInvoke(t, stub, "updateProduct", "p3", "gizmo2", "10") //a change that isn't a transfer
+
+	if puids := puidsOf(t, checkInvoke(t, stub, "getUntransferredProducts")); !reflect.DeepEqual(puids, []string{"p1", "p3"}) {
+		t.Errorf("untransferred products are %v, expected [p1 p3]", puids)
+	}
+}
+
+func TestProductRecordSizeGuard(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	initTestProduct(t, stub, ids, "p1", "widget", "10", ids.alice)
+
+	stub.as(ids.alice)
+	envelope := checkInvokeFails(t, stub, codeValidation, "setMetadata", "p1", fmt.Sprintf(`{"notes":"%s"}`, strings.Repeat("x", defaultMaxMetadataBytes)))
+	if !strings.HasPrefix(envelope["message"], "Metadata of p1 would be") {
+		t.Errorf("unexpected error for metadata over the cap: %s", envelope["message"])
+	}
+
+	// ==== Metadata within its cap can still make the record too large once escaped ====
+	stub.as(ids.manufacturer)
+	checkInvoke(t, stub, "setConfig", fmt.Sprintf(`{"maxMetadataBytes":%d}`, maxProductRecordBytes))
+	stub.as(ids.alice)
+	quotes := strings.Repeat(`\"`, maxProductRecordBytes*3/4)
+	envelope = checkInvokeFails(t, stub, codeValidation, "setMetadata", "p1", fmt.Sprintf(`{"notes":"%s"}`, quotes))
+	if !strings.HasPrefix(envelope["message"], "Product record too large: p1 would be") {
+		t.Errorf("unexpected error for an oversized record: %s", envelope["message"])
+	}
+	if metadata := readTestProduct(t, stub, "p1").Metadata; len(metadata) != 0 {
+		t.Errorf("oversized metadata was stored")
+	}
+	checkInvoke(t, stub, "setMetadata", "p1", `{"grade":"A"}`)
+}
+
+func TestNamespaceKeysByChannel(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	stub.as(ids.manufacturer)
+	checkInvoke(t, stub, "setConfig", `{"namespaceKeysByChannel":true}`)
+	initTestProduct(t, stub, ids, "p1", "widget", "10", ids.alice)
+	initTestProduct(t, stub, ids, "p2", "gadget", "10", ids.alice)
+
+	key := "mychannel" + channelKeySeparator + "p1"
+	if _, ok := stub.State[key]; !ok {
+		t.Fatalf("p1 is not stored under %q", key)
+	}
+	if _, ok := stub.State["p1"]; ok {
+		t.Fatal("p1 is stored under its bare puid too")
+	}
+	if p := readTestProduct(t, stub, "p1"); p.Puid != "p1" {
+		t.Errorf("record under the prefixed key has puid %s", p.Puid)
+	}
+	// index entries keep bare puids
+	if keys := keysUnder(t, stub, "type~name~puid", "10", "widget", "p1"); len(keys) != 1 {
+		t.Errorf("type~name~puid entry of p1 not found under its bare puid")
+	}
+	results := []QueryResult{}
+	err := json.Unmarshal(checkInvoke(t, stub, "getProductsByRange", "p1", ""), &results)
+	if err != nil || len(results) != 2 || results[0].Key != key {
+		t.Errorf("range over the bare puids returned %v", results)
+	}
+
+	// ==== Another channel doesn't see the records ====
+	stub.ChannelID = "otherchannel"
+	checkInvokeFails(t, stub, codeNotFound, "readProduct", "p1")
+	stub.ChannelID = "mychannel"
+
+	// ==== The option can't change while products are stored ====
+	stub.as(ids.manufacturer)
+	checkInvokeFails(t, stub, codeConflict, "setConfig", `{"namespaceKeysByChannel":false}`)
+	stub.as(ids.alice)
+	checkInvoke(t, stub, "deleteProduct", "p1")
+	checkInvoke(t, stub, "deleteProduct", "p2")
+	stub.as(ids.manufacturer)
+	checkInvoke(t, stub, "setConfig", `{"namespaceKeysByChannel":false}`)
+	initTestProduct(t, stub, ids, "p1", "widget", "10", ids.alice)
+	if _, ok := stub.State["p1"]; !ok {
+		t.Fatal("p1 is not stored under its bare puid with the option off")
+	}
+}
+
+func TestTransferCooldown(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	initTestProduct(t, stub, ids, "p1", "widget", "10", ids.alice)
+
+	stub.as(ids.alice)
+	transferredAt := stub.now
+	checkInvoke(t, stub, "transferProduct", "p1", ids.bob.id)
+	if lastTransferAt := readTestProduct(t, stub, "p1").LastTransferAt; lastTransferAt != transferredAt {
+		t.Fatalf("LastTransferAt is %d, expected %d", lastTransferAt, transferredAt)
+	}
+
+	stub.as(ids.bob)
+	stub.now = transferredAt + 10
+	envelope := checkInvokeFails(t, stub, codeConflict, "transferProduct", "p1", ids.alice.id)
+	expected := fmt.Sprintf("Product p1 was transferred 10s ago, it can be transferred again in %ds", defaultTransferCooldownSeconds-10)
+	if envelope["message"] != expected {
+		t.Errorf("cooldown error is %q, expected %q", envelope["message"], expected)
+	}
+
+	stub.now = transferredAt + defaultTransferCooldownSeconds
+	checkInvoke(t, stub, "transferProduct", "p1", ids.alice.id)
+
+	// ==== The cooldown is configurable ====
+	stub.as(ids.manufacturer)
+	checkInvoke(t, stub, "setConfig", `{"transferCooldownSeconds":0}`)
+	stub.as(ids.alice)
+	checkInvoke(t, stub, "transferProduct", "p1", ids.bob.id)
+}
+
+func TestDisplayNameKeepsCase(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	initTestProduct(t, stub, ids, "p1", "iPhone", "Electronics", ids.alice)
+
+	p := readTestProduct(t, stub, "p1")
+	if p.DisplayName != "iPhone" || p.Pname != "iphone" || p.Owner != ids.alice.id {
+		t.Errorf("unexpected names after a round trip: displayName %s, pname %s, owner %s", p.DisplayName, p.Pname, p.Owner)
+	}
+	if puids := puidsOf(t, checkInvoke(t, stub, "getProductsByType", "electronics")); len(puids) != 1 {
+		t.Errorf("lowercased type not indexed: %v", puids)
+	}
+
+	stub.as(ids.alice)
+	checkInvoke(t, stub, "updateProduct", "p1", "iPad Pro", "electronics")
+	if p = readTestProduct(t, stub, "p1"); p.DisplayName != "iPad Pro" || p.Pname != "ipad pro" {
+		t.Errorf("unexpected names after updateProduct: displayName %s, pname %s", p.DisplayName, p.Pname)
+	}
+}
+
+func TestRecommendedIndexes(t *testing.T) {
+	for _, definition := range []string{IndexOwner, IndexType, IndexStatus} {
+		index := struct {
+			Index struct {
+				Fields []string `json:"fields"`
+			} `json:"index"`
+			Ddoc string `json:"ddoc"`
+			Name string `json:"name"`
+			Type string `json:"type"`
+		}{}
+		err := unmarshalJSON([]byte(definition), &index, true)
+		if err != nil {
+			t.Errorf("index definition is not a valid CouchDB index: %s: %s", err, definition)
+			continue
+		}
+		if len(index.Index.Fields) == 0 || index.Index.Fields[0] != "docType" || len(index.Name) == 0 || index.Type != "json" {
+			t.Errorf("unexpected index definition: %s", definition)
+		}
+	}
+
+	stub := newTestStub(t)
+	indexes := []struct {
+		File       string          `json:"file"`
+		Definition json.RawMessage `json:"definition"`
+	}{}
+	err := json.Unmarshal(checkInvoke(t, stub, "getRecommendedIndexes"), &indexes)
+	if err != nil {
+		t.Fatalf("getRecommendedIndexes did not return JSON: %s", err)
+	}
+	if len(indexes) != len(recommendedIndexes) {
+		t.Fatalf("getRecommendedIndexes returned %d indexes, expected %d", len(indexes), len(recommendedIndexes))
+	}
+	for i, index := range indexes {
+		var definition bytes.Buffer
+		json.Compact(&definition, []byte(recommendedIndexes[i].Definition))
+		if index.File != recommendedIndexes[i].File || string(index.Definition) != definition.String() {
+			t.Errorf("index %d is %s %s, expected %s", i, index.File, index.Definition, recommendedIndexes[i].File)
+		}
+	}
+}
+
+func TestGetProductsByStatus(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	initTestProduct(t, stub, ids, "p1", "widget", "10", ids.alice)
+	initTestProduct(t, stub, ids, "p2", "gadget", "10", ids.alice)
+
+	productsIn := func(status string) []string {
+		return puidsOf(t, checkInvoke(t, stub, "getProductsByStatus", status))
+	}
+	if puids := productsIn(statusManufactured); !reflect.DeepEqual(puids, []string{"p1", "p2"}) {
+		t.Errorf("manufactured products are %v, expected [p1 p2]", puids)
+	}
+
+	stub.as(ids.alice)
+	checkInvoke(t, stub, "changeStatus", "p1", statusInTransit)
+	if puids := productsIn(statusManufactured); !reflect.DeepEqual(puids, []string{"p2"}) {
+		t.Errorf("manufactured products are %v after the change, expected [p2]", puids)
+	}
+	if puids := productsIn(statusInTransit); !reflect.DeepEqual(puids, []string{"p1"}) {
+		t.Errorf("in-transit products are %v after the change, expected [p1]", puids)
+	}
+	if keys := keysUnder(t, stub, "status~puid", statusManufactured, "p1"); len(keys) != 0 {
+		t.Errorf("old status entry of p1 left behind: %q", keys)
+	}
+}
+
+// cannedResults returns n rich query results, products p0 to p<n-1>
+func cannedResults(n int) []*queryresult.KV {
+	kvs := make([]*queryresult.KV, n)
+	for i := range kvs {
+		puid := "p" + strconv.Itoa(i)
+		kvs[i] = &queryresult.KV{Key: puid, Value: []byte(`{"docType":"product","puid":"` + puid + `","owner":"tom"}`)}
+	}
+	return kvs
+}
+
+func TestQueryProductResultCap(t *testing.T) {
+	stub := newTestStub(t)
+	query := `{"selector":{"owner":"tom"}}`
+
+	stub.queryResults = cannedResults(maxQueryResults)
+	if puids := puidsOf(t, checkInvoke(t, stub, "queryProduct", query)); len(puids) != maxQueryResults {
+		t.Fatalf("queryProduct returned %d of %d records", len(puids), maxQueryResults)
+	}
+
+	stub.queryResults = cannedResults(maxQueryResults + 1)
+	envelope := checkInvokeFails(t, stub, codeValidation, "queryProduct", query)
+	if !strings.HasPrefix(envelope["message"], "Result set too large") || !strings.Contains(envelope["message"], "queryProductWithPagination") {
+		t.Errorf("unexpected error for a result set over the cap: %s", envelope["message"])
+	}
+
+	// ==== A limit returns that many and says more matched ====
+	limited := struct {
+		Records   []QueryResult `json:"Records"`
+		Truncated bool          `json:"truncated"`
+	}{}
+	err := json.Unmarshal(checkInvoke(t, stub, "queryProduct", query, "10"), &limited)
+	if err != nil || len(limited.Records) != 10 || !limited.Truncated {
+		t.Errorf("limited query returned %d records, truncated %t: %v", len(limited.Records), limited.Truncated, err)
+	}
+}
+
+func TestEscrow(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	agent := newIdentity(t, "Org2MSP", "agent", "")
+	initTestProduct(t, stub, ids, "p1", "widget", "10", ids.alice)
+	initTestProduct(t, stub, ids, "p2", "gadget", "10", ids.alice)
+
+	stub.as(ids.bob)
+	checkInvokeFails(t, stub, codeForbidden, "escrowProduct", "p1", agent.id, ids.bob.id)
+	stub.as(ids.alice)
+	for _, puid := range []string{"p1", "p2"} {
+		checkInvoke(t, stub, "escrowProduct", puid, agent.id, ids.bob.id)
+		p := readTestProduct(t, stub, puid)
+		if p.Owner != escrowOwnerPrefix+agent.id || p.Escrow == nil || p.Escrow.OriginalOwner != ids.alice.id || p.Escrow.Recipient != ids.bob.id {
+			t.Fatalf("unexpected escrow of %s: owner %s, escrow %+v", puid, p.Owner, p.Escrow)
+		}
+	}
+	stub.as(ids.regulator)
+	checkInvokeFails(t, stub, codeConflict, "transferProduct", "p1", ids.bob.id)
+
+	// ==== Only the agent may release or cancel ====
+	stub.now += defaultTransferCooldownSeconds
+	for _, identity := range []testIdentity{ids.alice, ids.bob} {
+		stub.as(identity)
+		checkInvokeFails(t, stub, codeForbidden, "releaseEscrow", "p1")
+		checkInvokeFails(t, stub, codeForbidden, "cancelEscrow", "p1")
+	}
+
+	// ==== Release gives the product to the recipient ====
+	stub.as(agent)
+	checkInvoke(t, stub, "releaseEscrow", "p1")
+	if p := readTestProduct(t, stub, "p1"); p.Owner != ids.bob.id || p.Escrow != nil {
+		t.Errorf("released p1 has owner %s, escrow %+v", p.Owner, p.Escrow)
+	}
+
+	// ==== Cancel gives it back to the original owner ====
+	checkInvoke(t, stub, "cancelEscrow", "p2")
+	if p := readTestProduct(t, stub, "p2"); p.Owner != ids.alice.id || p.Escrow != nil {
+		t.Errorf("cancelled p2 has owner %s, escrow %+v", p.Owner, p.Escrow)
+	}
+	checkInvokeFails(t, stub, codeConflict, "releaseEscrow", "p2")
+}
+
+func TestStrictArgs(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	initTestProduct(t, stub, ids, "p1", "widget", "10", ids.alice)
+	misspelt := `{"puid":"p1","cost":12.5,"suplierContract":"ACME-2019-04"}`
+
+	// ==== Extra positional arguments are refused either way ====
+	checkInvokeFails(t, stub, codeValidation, "readProduct", "p1", "extra")
+
+	// ==== Off, unknown JSON fields are dropped ====
+	stub.as(ids.alice)
+	stub.transient = map[string][]byte{"product_private": []byte(misspelt)}
+	checkInvoke(t, stub, "initProductPrivateDetails")
+
+	// ==== On, they are refused ====
+	stub.as(ids.manufacturer)
+	checkInvoke(t, stub, "setConfig", `{"strictArgs":true}`)
+	stub.as(ids.alice)
+	stub.transient = map[string][]byte{"product_private": []byte(misspelt)}
+	envelope := checkInvokeFails(t, stub, codeValidation, "initProductPrivateDetails")
+	if !strings.Contains(envelope["message"], "suplierContract") {
+		t.Errorf("error does not name the unknown field: %s", envelope["message"])
+	}
+	checkInvokeFails(t, stub, codeValidation, "readProduct", "p1", "extra")
+
+	// ==== And off again ====
+	stub.as(ids.manufacturer)
+	checkInvoke(t, stub, "setConfig", `{"strictArgs":false}`)
+	stub.as(ids.alice)
+	stub.transient = map[string][]byte{"product_private": []byte(misspelt)}
+	checkInvoke(t, stub, "initProductPrivateDetails")
+}
+
+func TestInitConfig(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+
+	for _, config := range []string{
+		`{"strictOwners":`,
+		`{"strictOwners":"yes"}`,
+		`{"maxMetadata":4096}`,
+		`{"maxMetadataBytes":0}`,
+		`{"transferCooldownSeconds":-1}`,
+		`{"strictOwners":true} {}`,
+	} {
+		res := stub.init(config)
+		envelope := map[string]string{}
+		if res.Status == shim.OK || json.Unmarshal([]byte(res.Message), &envelope) != nil || envelope["code"] != codeValidation {
+			t.Errorf("Init accepted malformed config %s: %d %s", config, res.Status, res.Message)
+		}
+	}
+	if _, ok := stub.State[configKey]; ok {
+		t.Fatal("malformed config was stored")
+	}
+
+	if res := stub.init(`{"strictOwners":true,"maxMetadataBytes":8192,"transferCooldownSeconds":30}`); res.Status != shim.OK {
+		t.Fatalf("Init with a valid config failed: %s", res.Message)
+	}
+	expected := chaincodeConfig{StrictOwners: true, MaxMetadataBytes: 8192, TransferCooldownSeconds: 30}
+	config := chaincodeConfig{}
+	err := json.Unmarshal(stub.State[configKey], &config)
+	if err != nil || config != expected {
+		t.Errorf("stored config is %s, expected %+v", stub.State[configKey], expected)
+	}
+	err = json.Unmarshal(checkInvoke(t, stub, "getConfig"), &config)
+	if err != nil || config != expected {
+		t.Errorf("getConfig returned %+v, expected %+v", config, expected)
+	}
+
+	// ==== An upgrade without a config changes nothing ====
+	if res := stub.init(); res.Status != shim.OK {
+		t.Fatalf("Init without a config failed: %s", res.Message)
+	}
+	err = json.Unmarshal(checkInvoke(t, stub, "getConfig"), &config)
+	if err != nil || config != expected {
+		t.Errorf("config is %+v after an upgrade without one, expected %+v", config, expected)
+	}
+
+	// ==== setConfig is for admins only ====
+	stub.as(ids.alice)
+	checkInvokeFails(t, stub, codeForbidden, "setConfig", `{"strictOwners":false}`)
+	stub.as(ids.manufacturer)
+	checkInvoke(t, stub, "setConfig", `{"strictOwners":false}`)
+}
+
+func TestReadProductHTTPStatus(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	initTestProduct(t, stub, ids, "p1", "widget", "10", ids.alice)
+	stub.putRaw(t, "p2", []byte(`{"puid":`))
+
+	for _, test := range []struct {
+		function string
+		args     []string
+		status   int32
+	}{
+		{"readProduct", []string{"p1"}, shim.OK},
+		{"readProduct", []string{"nope"}, 404},
+		{"readProduct", []string{}, 400},
+		{"readProductStrict", []string{"p1"}, shim.OK},
+		{"readProductStrict", []string{"nope"}, 404},
+		{"readProductStrict", []string{" p1"}, 400},
+		{"readProductStrict", []string{configKey}, 400},
+		{"readProductStrict", []string{"p2"}, shim.ERROR},
+	} {
+		if res := stub.invoke(test.function, test.args...); res.Status != test.status {
+			t.Errorf("%s %q returned status %d, expected %d: %s", test.function, test.args, res.Status, test.status, res.Message)
+		}
+	}
+}
+
+func TestRestoreProductRefusesEscrowAndPendingChanges(t *testing.T) {
+	stub := newTestStub(t)
+	ids := newTestIdentities(t)
+	initTestProduct(t, stub, ids, "p1", "widget", "10", ids.alice)
+	initTestProduct(t, stub, ids, "p2", "gadget", "10", ids.alice)
+	createdP1 := stub.history["p1"][0].TxId
+	createdP2 := stub.history["p2"][0].TxId
+
+	// ==== Rolling back across an escrow ====
+	stub.as(ids.alice)
+	checkInvoke(t, stub, "escrowProduct", "p1", ids.bob.id, ids.bob.id)
+	stub.as(ids.manufacturer)
+	checkInvokeFails(t, stub, codeConflict, "restoreProduct", "p1", createdP1)
+	if p := readTestProduct(t, stub, "p1"); p.Escrow == nil {
+		t.Fatal("refused restore dropped the escrow")
+	}
+
+	// ==== Rolling back under a pending transfer ====
+	stub.as(ids.alice)
+	checkInvoke(t, stub, "updateProduct", "p2", "gizmo", "10")
+	checkInvoke(t, stub, "proposeTransfer", "p2", ids.bob.id)
+	stub.as(ids.manufacturer)
+	checkInvokeFails(t, stub, codeConflict, "restoreProduct", "p2", createdP2)
+	stub.as(ids.alice)
+	checkInvoke(t, stub, "rejectTransfer", "p2")
+	stub.as(ids.manufacturer)
+	checkInvoke(t, stub, "restoreProduct", "p2", createdP2)
+	if p := readTestProduct(t, stub, "p2"); p.Pname != "gadget" || p.RestoredFrom != createdP2 {
+		t.Errorf("restored p2 has pname %s, restoredFrom %s", p.Pname, p.RestoredFrom)
+	}
+
+	// ==== A deleted product comes back ====
+	stub.as(ids.alice)
+	checkInvoke(t, stub, "deleteProduct", "p2")
+	stub.as(ids.manufacturer)
+	checkInvoke(t, stub, "restoreProduct", "p2", createdP2)
+	if keys := keysUnder(t, stub, "type~name~puid", "10", "gadget", "p2"); len(keys) != 1 {
+		t.Errorf("restored p2 is not indexed")
+	}
+
+	// ==== A corrupt version is reported as such ====
+	stub.history["p2"][0].Value = []byte(`{"puid":`)
+	checkInvokeFails(t, stub, codeCorruptRecord, "restoreProduct", "p2", createdP2)
+}